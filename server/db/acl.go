@@ -0,0 +1,196 @@
+package db
+
+import (
+	"myfileserver/lib"
+	"time"
+)
+
+// 访问权限，后面的权限包含前面的权限
+const (
+	AclAccessRead   = "read"   // 查看和下载
+	AclAccessWrite  = "write"  // 上传、新建、修改和删除其中的文件
+	AclAccessManage = "manage" // 管理该目录的访问权限
+)
+
+// 授权对象的类型
+const (
+	AclTargetUser  = "user"
+	AclTargetGroup = "group"
+)
+
+type AclEntry struct {
+	Id         int64  `json:"id"`
+	Path       string `json:"path"`        // 授权的目录，相对于服务的根目录
+	TargetType string `json:"target_type"` // 授权对象的类型
+	TargetId   int64  `json:"target_id"`   // 授权对象的ID
+	Access     string `json:"access"`      // 访问权限
+	MountName  string `json:"mount_name"`  // 挂载到用户根目录下显示的名称
+	CreatedBy  int64  `json:"created_by"`  // 创建者的用户ID
+	CreatedAt  string `json:"created_at"`  // 创建时间
+}
+
+// AclAccessLevel 返回访问权限的级别，无效的权限返回0
+func AclAccessLevel(access string) int {
+	switch access {
+	case AclAccessRead:
+		return 1
+	case AclAccessWrite:
+		return 2
+	case AclAccessManage:
+		return 3
+	}
+	return 0
+}
+
+func (database *Database) InitAcl() error {
+	// 创建 Acl 表，用于存储目录的访问权限
+	_, err := database.db.Exec(`
+		CREATE TABLE IF NOT EXISTS Acl (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			path TEXT NOT NULL,
+			target_type TEXT NOT NULL,
+			target_id INTEGER NOT NULL,
+			access TEXT NOT NULL,
+			mount_name TEXT NOT NULL,
+			created_by INTEGER NOT NULL,
+			created_at TEXT NOT NULL
+		);
+	`)
+	if err != nil {
+		lib.Logger.Error("InitAcl", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) AddAcl(acl AclEntry) (int64, error) {
+	res, err := database.db.Exec(`
+		INSERT INTO Acl (path, target_type, target_id, access, mount_name, created_by, created_at)
+		VALUES (?,?,?,?,?,?,?);
+	`,
+		acl.Path,
+		acl.TargetType,
+		acl.TargetId,
+		acl.Access,
+		acl.MountName,
+		acl.CreatedBy,
+		time.Now().Format(time.DateTime))
+	if err != nil {
+		lib.Logger.Error("AddAcl", err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (database *Database) GetAcl(id int64) (AclEntry, error) {
+	acl := AclEntry{}
+	err := database.db.QueryRow(`
+		SELECT id, path, target_type, target_id, access, mount_name, created_by, created_at
+		FROM Acl
+		WHERE id =?;
+	`, id).Scan(
+		&acl.Id,
+		&acl.Path,
+		&acl.TargetType,
+		&acl.TargetId,
+		&acl.Access,
+		&acl.MountName,
+		&acl.CreatedBy,
+		&acl.CreatedAt)
+	if err != nil {
+		return acl, err
+	}
+	return acl, nil
+}
+
+func (database *Database) queryAcls(query string, args ...any) ([]AclEntry, error) {
+	acls := []AclEntry{}
+	rows, err := database.db.Query(query, args...)
+	if err != nil {
+		lib.Logger.Error("queryAcls", err)
+		return acls, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		acl := AclEntry{}
+		err := rows.Scan(
+			&acl.Id,
+			&acl.Path,
+			&acl.TargetType,
+			&acl.TargetId,
+			&acl.Access,
+			&acl.MountName,
+			&acl.CreatedBy,
+			&acl.CreatedAt)
+		if err != nil {
+			lib.Logger.Error("queryAcls", err)
+			return acls, err
+		}
+		acls = append(acls, acl)
+	}
+	return acls, nil
+}
+
+func (database *Database) GetAcls() ([]AclEntry, error) {
+	return database.queryAcls(`
+		SELECT id, path, target_type, target_id, access, mount_name, created_by, created_at
+		FROM Acl
+		ORDER BY id;
+	`)
+}
+
+func (database *Database) GetAclsByPath(path string) ([]AclEntry, error) {
+	return database.queryAcls(`
+		SELECT id, path, target_type, target_id, access, mount_name, created_by, created_at
+		FROM Acl
+		WHERE path =?
+		ORDER BY id;
+	`, path)
+}
+
+// GetUserAcls 获取授权给用户以及用户所在用户组的访问权限
+func (database *Database) GetUserAcls(userId int64) ([]AclEntry, error) {
+	return database.queryAcls(`
+		SELECT id, path, target_type, target_id, access, mount_name, created_by, created_at
+		FROM Acl
+		WHERE (target_type =? AND target_id =?)
+			OR (target_type =? AND target_id IN (SELECT group_id FROM GroupMember WHERE user_id =?))
+		ORDER BY id;
+	`, AclTargetUser, userId, AclTargetGroup, userId)
+}
+
+func (database *Database) DeleteAcl(id int64) error {
+	_, err := database.db.Exec(`
+		DELETE FROM Acl
+		WHERE id =?;
+	`, id)
+	if err != nil {
+		lib.Logger.Error("DeleteAcl", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) DeleteUserAcls(userId int64) error {
+	_, err := database.db.Exec(`
+		DELETE FROM Acl
+		WHERE target_type =? AND target_id =?;
+	`, AclTargetUser, userId)
+	if err != nil {
+		lib.Logger.Error("DeleteUserAcls", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) DeleteGroupAcls(groupId int64) error {
+	_, err := database.db.Exec(`
+		DELETE FROM Acl
+		WHERE target_type =? AND target_id =?;
+	`, AclTargetGroup, groupId)
+	if err != nil {
+		lib.Logger.Error("DeleteGroupAcls", err)
+		return err
+	}
+	return nil
+}
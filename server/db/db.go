@@ -42,7 +42,47 @@ func (database *Database) Open() error {
 		lib.Logger.Error("Init favorites failed!", err)
 		return err
 	}
-	return database.InitShared()
+	err = database.InitShared()
+	if err != nil {
+		lib.Logger.Error("Init shared failed!", err)
+		return err
+	}
+	err = database.InitSession()
+	if err != nil {
+		lib.Logger.Error("Init session failed!", err)
+		return err
+	}
+	err = database.InitTotp()
+	if err != nil {
+		lib.Logger.Error("Init totp failed!", err)
+		return err
+	}
+	err = database.InitApiToken()
+	if err != nil {
+		lib.Logger.Error("Init api token failed!", err)
+		return err
+	}
+	err = database.InitAcl()
+	if err != nil {
+		lib.Logger.Error("Init acl failed!", err)
+		return err
+	}
+	err = database.InitTrash()
+	if err != nil {
+		lib.Logger.Error("Init trash failed!", err)
+		return err
+	}
+	err = database.InitFileVersion()
+	if err != nil {
+		lib.Logger.Error("Init file version failed!", err)
+		return err
+	}
+	err = database.InitFileIndex()
+	if err != nil {
+		lib.Logger.Error("Init file index failed!", err)
+		return err
+	}
+	return database.InitPhoto()
 }
 
 func (database *Database) Close() {
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"database/sql"
+	"myfileserver/lib"
+	"strings"
+	"unicode/utf8"
+)
+
+type FileIndexEntry struct {
+	Path       string `json:"path"`   // 相对于服务根目录的路径
+	Parent     string `json:"parent"` // 所在目录相对于服务根目录的路径
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Mode       uint32 `json:"file_mode"`
+	IsDir      bool   `json:"is_dir"`
+	CreatedAt  string `json:"created_at"`
+	ModifiedAt string `json:"modified_at"`
+	MTime      int64  `json:"-"`    // 修改时间的纳秒数，用于判断文件是否变化
+	Hash       string `json:"hash"` // 文件内容的 sha256，目录和较大的文件为空
+}
+
+// FileIndexQuery 查询文件索引的条件，Prefix 为开始查询的目录相对于服务根目录的路径
+type FileIndexQuery struct {
+	Prefix         string
+	Name           string // 文件名中包含的字符串，不区分大小写
+	Glob           string // 文件名的通配符，不区分大小写
+	IsDir          *bool
+	Exts           []string
+	MinSize        int64 // 小于0时不限
+	MaxSize        int64 // 小于0时不限
+	ModifiedAfter  string
+	ModifiedBefore string
+	HideDotFiles   bool
+	OrderBy        string // 排序，为空时按路径排序
+	After          string // 按路径排序时只查询路径大于该值的文件，用于分页查询
+	Limit          int    // 小于等于0时不限
+}
+
+const fileIndexColumns = `path, parent, name, size, mode, is_dir, created_at, modified_at, mtime, hash`
+
+func (database *Database) InitFileIndex() error {
+	// 创建 FileIndex 表，用于保存服务根目录下所有文件的信息，加快搜索和统计
+	_, err := database.db.Exec(`
+		CREATE TABLE IF NOT EXISTS FileIndex (
+			path TEXT PRIMARY KEY,
+			parent TEXT NOT NULL,
+			name TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			mode INTEGER NOT NULL,
+			is_dir INTEGER NOT NULL,
+			created_at TEXT NOT NULL,
+			modified_at TEXT NOT NULL,
+			mtime INTEGER NOT NULL DEFAULT 0,
+			hash TEXT NOT NULL DEFAULT ''
+		);
+	`)
+	if err != nil {
+		lib.Logger.Error("InitFileIndex", err)
+		return err
+	}
+	for _, index := range []string{
+		`CREATE INDEX IF NOT EXISTS FileIndexParent ON FileIndex (parent);`,
+		`CREATE INDEX IF NOT EXISTS FileIndexSize ON FileIndex (size);`,
+		`CREATE INDEX IF NOT EXISTS FileIndexModified ON FileIndex (modified_at);`,
+	} {
+		_, err = database.db.Exec(index)
+		if err != nil {
+			lib.Logger.Error("InitFileIndex", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// fileIndexRange 返回目录下所有路径的范围，'0' 是 '/' 的下一个字符
+func fileIndexRange(prefix string) (string, string) {
+	if prefix == "/" {
+		return "/", "0"
+	}
+	return prefix + "/", prefix + "0"
+}
+
+func scanFileIndex(rows *sql.Rows) (FileIndexEntry, error) {
+	entry := FileIndexEntry{}
+	err := rows.Scan(
+		&entry.Path,
+		&entry.Parent,
+		&entry.Name,
+		&entry.Size,
+		&entry.Mode,
+		&entry.IsDir,
+		&entry.CreatedAt,
+		&entry.ModifiedAt,
+		&entry.MTime,
+		&entry.Hash)
+	return entry, err
+}
+
+func (database *Database) queryFileIndexes(query string, args ...any) ([]FileIndexEntry, error) {
+	entries := []FileIndexEntry{}
+	rows, err := database.db.Query(query, args...)
+	if err != nil {
+		lib.Logger.Error("queryFileIndexes", err)
+		return entries, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry, err := scanFileIndex(rows)
+		if err != nil {
+			lib.Logger.Error("queryFileIndexes", err)
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// GetFileIndexChildren 获取目录下一级的文件
+func (database *Database) GetFileIndexChildren(parent string) ([]FileIndexEntry, error) {
+	return database.queryFileIndexes(`
+		SELECT `+fileIndexColumns+`
+		FROM FileIndex
+		WHERE parent =?;
+	`, parent)
+}
+
+// UpdateFileIndexes 在一个事务中保存目录下新增和修改的文件，删除已经不存在的文件及其下的所有文件
+func (database *Database) UpdateFileIndexes(entries []FileIndexEntry, removed []string) error {
+	tx, err := database.db.Begin()
+	if err != nil {
+		lib.Logger.Error("UpdateFileIndexes", err)
+		return err
+	}
+	for _, entry := range entries {
+		_, err = tx.Exec(`
+			INSERT OR REPLACE INTO FileIndex (`+fileIndexColumns+`)
+			VALUES (?,?,?,?,?,?,?,?,?,?);
+		`,
+			entry.Path,
+			entry.Parent,
+			entry.Name,
+			entry.Size,
+			entry.Mode,
+			entry.IsDir,
+			entry.CreatedAt,
+			entry.ModifiedAt,
+			entry.MTime,
+			entry.Hash)
+		if err != nil {
+			tx.Rollback()
+			lib.Logger.Error("UpdateFileIndexes", err)
+			return err
+		}
+	}
+	for _, path := range removed {
+		lo, hi := fileIndexRange(path)
+		_, err = tx.Exec(`
+			DELETE FROM FileIndex
+			WHERE path =? OR (path >=? AND path <?);
+		`, path, lo, hi)
+		if err != nil {
+			tx.Rollback()
+			lib.Logger.Error("UpdateFileIndexes", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetFileIndexCount 获取索引中的文件数
+func (database *Database) GetFileIndexCount() (int64, error) {
+	count := int64(0)
+	err := database.db.QueryRow(`SELECT COUNT(*) FROM FileIndex;`).Scan(&count)
+	return count, err
+}
+
+// QueryFileIndexes 按条件查询目录下的所有文件，每查到一个文件调用一次 fn，fn 返回 false 时停止查询
+func (database *Database) QueryFileIndexes(query FileIndexQuery, fn func(FileIndexEntry) bool) error {
+	lo, hi := fileIndexRange(query.Prefix)
+	where := []string{"path >=?", "path <?"}
+	args := []any{lo, hi}
+	if query.Name != "" {
+		where = append(where, "instr(lower(name), ?) > 0")
+		args = append(args, strings.ToLower(query.Name))
+	}
+	if query.Glob != "" {
+		where = append(where, "lower(name) GLOB ?")
+		args = append(args, strings.ToLower(query.Glob))
+	}
+	if query.IsDir != nil {
+		where = append(where, "is_dir =?")
+		args = append(args, *query.IsDir)
+	}
+	if len(query.Exts) > 0 {
+		exts := []string{}
+		for _, ext := range query.Exts {
+			exts = append(exts, "lower(name) LIKE ? ESCAPE '\\'")
+			args = append(args, "%."+escapeLike(strings.ToLower(ext)))
+		}
+		where = append(where, "is_dir = 0 AND ("+strings.Join(exts, " OR ")+")")
+	}
+	if query.MinSize >= 0 {
+		where = append(where, "size >=?")
+		args = append(args, query.MinSize)
+	}
+	if query.MaxSize >= 0 {
+		where = append(where, "size <=?")
+		args = append(args, query.MaxSize)
+	}
+	if query.ModifiedAfter != "" {
+		where = append(where, "modified_at >=?")
+		args = append(args, query.ModifiedAfter)
+	}
+	if query.ModifiedBefore != "" {
+		where = append(where, "modified_at <?")
+		args = append(args, query.ModifiedBefore)
+	}
+	if query.After != "" {
+		where = append(where, "path >?")
+		args = append(args, query.After)
+	}
+	if query.HideDotFiles {
+		// 只判断开始查询的目录之后的部分，substr 按字符计算位置
+		where = append(where, "substr(path, ?) NOT LIKE '%/.%'")
+		args = append(args, utf8.RuneCountInString(lo))
+	}
+	orderBy := "path"
+	switch query.OrderBy {
+	case "size":
+		orderBy = "size DESC, path"
+	case "modified_at":
+		orderBy = "modified_at DESC, path"
+	}
+	sqlStr := `SELECT ` + fileIndexColumns + ` FROM FileIndex WHERE ` + strings.Join(where, " AND ") + ` ORDER BY ` + orderBy
+	if query.Limit > 0 {
+		sqlStr += ` LIMIT ?`
+		args = append(args, query.Limit)
+	}
+	rows, err := database.db.Query(sqlStr, args...)
+	if err != nil {
+		lib.Logger.Error("QueryFileIndexes", err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry, err := scanFileIndex(rows)
+		if err != nil {
+			lib.Logger.Error("QueryFileIndexes", err)
+			return err
+		}
+		if !fn(entry) {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+// GetFileIndexDirSize 统计目录下的目录数、文件数和文件的总大小
+func (database *Database) GetFileIndexDirSize(prefix string, hideDotFiles bool) (uint64, uint64, int64, error) {
+	lo, hi := fileIndexRange(prefix)
+	where := "path >=? AND path <?"
+	args := []any{lo, hi}
+	if hideDotFiles {
+		where += " AND substr(path, ?) NOT LIKE '%/.%'"
+		args = append(args, utf8.RuneCountInString(lo))
+	}
+	dirCount, fileCount, size := uint64(0), uint64(0), int64(0)
+	err := database.db.QueryRow(`
+		SELECT COALESCE(SUM(is_dir), 0), COALESCE(SUM(1 - is_dir), 0), COALESCE(SUM(CASE WHEN is_dir = 0 THEN size ELSE 0 END), 0)
+		FROM FileIndex
+		WHERE `+where+`;
+	`, args...).Scan(&dirCount, &fileCount, &size)
+	if err != nil {
+		lib.Logger.Error("GetFileIndexDirSize", err)
+	}
+	return dirCount, fileCount, size, err
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,50 @@
+package db
+
+import "testing"
+
+func TestFileIndexRange(t *testing.T) {
+	tests := []struct {
+		prefix string
+		lo, hi string
+	}{
+		{"/", "/", "0"},
+		{"/a", "/a/", "/a0"},
+		{"/a/b c", "/a/b c/", "/a/b c0"},
+	}
+	for _, tt := range tests {
+		lo, hi := fileIndexRange(tt.prefix)
+		if lo != tt.lo || hi != tt.hi {
+			t.Errorf("fileIndexRange(%q) = %q, %q, want %q, %q", tt.prefix, lo, hi, tt.lo, tt.hi)
+		}
+	}
+}
+
+// 范围内只能有目录下的路径，不能包括目录本身和名字以目录名开头的兄弟路径
+func TestFileIndexRangeContains(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		{"/a", "/a/b", true},
+		{"/a", "/a/b/c", true},
+		{"/a", "/a/0", true},
+		{"/a", "/a/\U0001F600", true},
+		{"/a", "/a", false},
+		{"/a", "/ab", false},
+		{"/a", "/a-b", false},
+		{"/a", "/a.b", false},
+		{"/a", "/a 1/b", false},
+		{"/a", "/a0", false},
+		{"/a", "/b", false},
+		{"/", "/a", true},
+		{"/", "/a/b", true},
+		{"/", "/\U0001F600", true},
+	}
+	for _, tt := range tests {
+		lo, hi := fileIndexRange(tt.prefix)
+		if got := tt.path >= lo && tt.path < hi; got != tt.want {
+			t.Errorf("%q in fileIndexRange(%q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package db
+
+import (
+	"database/sql"
+	"myfileserver/lib"
+	"time"
+)
+
+type PhotoEntry struct {
+	Id          int64   `json:"id"`
+	UserId      int64   `json:"user_id"`
+	Path        string  `json:"path"` // 用户看到的路径
+	Size        int64   `json:"size"`
+	MTime       int64   `json:"-"`        // 修改时间的纳秒数，用于判断文件是否变化
+	TakenAt     string  `json:"taken_at"` // 拍摄时间，没有 EXIF 时为文件的修改时间
+	Make        string  `json:"make"`
+	Model       string  `json:"model"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Orientation int     `json:"orientation"`
+	HasGPS      bool    `json:"has_gps"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+}
+
+// PhotoGroupEntry 时间线上按年、月或日分组的照片数
+type PhotoGroupEntry struct {
+	Key   string `json:"key"` // 2006、2006-01 或 2006-01-02
+	Count int64  `json:"count"`
+	Cover string `json:"cover"` // 该组中最新的一张照片的路径
+}
+
+type AlbumEntry struct {
+	Id        int64  `json:"id"`
+	UserId    int64  `json:"user_id"`
+	Name      string `json:"name"`
+	Count     int64  `json:"count"`
+	Cover     string `json:"cover"` // 最后加入的照片的路径
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+type AlbumPhotoEntry struct {
+	Path    string `json:"path"`
+	AddedAt string `json:"added_at"`
+}
+
+const photoColumns = `id, user_id, path, size, mtime, taken_at, make, model, width, height, orientation, has_gps, latitude, longitude`
+
+func (database *Database) InitPhoto() error {
+	// 创建 Photo 表，保存扫描用户的照片目录得到的 EXIF 信息
+	// 创建 Album 和 AlbumPhoto 表，相册只记录照片的路径，不复制文件
+	for _, sqlStr := range []string{`
+		CREATE TABLE IF NOT EXISTS Photo (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			path TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			mtime INTEGER NOT NULL,
+			taken_at TEXT NOT NULL,
+			make TEXT NOT NULL DEFAULT '',
+			model TEXT NOT NULL DEFAULT '',
+			width INTEGER NOT NULL DEFAULT 0,
+			height INTEGER NOT NULL DEFAULT 0,
+			orientation INTEGER NOT NULL DEFAULT 1,
+			has_gps INTEGER NOT NULL DEFAULT 0,
+			latitude REAL NOT NULL DEFAULT 0,
+			longitude REAL NOT NULL DEFAULT 0,
+			UNIQUE (user_id, path)
+		);`,
+		`CREATE INDEX IF NOT EXISTS PhotoTakenAt ON Photo (user_id, taken_at);`,
+		`CREATE TABLE IF NOT EXISTS Album (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS AlbumPhoto (
+			album_id INTEGER NOT NULL,
+			path TEXT NOT NULL,
+			added_at TEXT NOT NULL,
+			UNIQUE (album_id, path)
+		);`,
+	} {
+		_, err := database.db.Exec(sqlStr)
+		if err != nil {
+			lib.Logger.Error("InitPhoto", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func scanPhoto(rows *sql.Rows) (PhotoEntry, error) {
+	photo := PhotoEntry{}
+	err := rows.Scan(
+		&photo.Id,
+		&photo.UserId,
+		&photo.Path,
+		&photo.Size,
+		&photo.MTime,
+		&photo.TakenAt,
+		&photo.Make,
+		&photo.Model,
+		&photo.Width,
+		&photo.Height,
+		&photo.Orientation,
+		&photo.HasGPS,
+		&photo.Latitude,
+		&photo.Longitude)
+	return photo, err
+}
+
+func (database *Database) queryPhotos(query string, args ...any) ([]PhotoEntry, error) {
+	photos := []PhotoEntry{}
+	rows, err := database.db.Query(query, args...)
+	if err != nil {
+		lib.Logger.Error("queryPhotos", err)
+		return photos, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		photo, err := scanPhoto(rows)
+		if err != nil {
+			lib.Logger.Error("queryPhotos", err)
+			return photos, err
+		}
+		photos = append(photos, photo)
+	}
+	return photos, nil
+}
+
+// GetUserPhotos 获取用户所有照片的记录，扫描时用于判断文件是否变化
+func (database *Database) GetUserPhotos(userId int64) ([]PhotoEntry, error) {
+	return database.queryPhotos(`
+		SELECT `+photoColumns+`
+		FROM Photo
+		WHERE user_id =?;
+	`, userId)
+}
+
+// UpdatePhotos 在一个事务中保存新增和变化的照片，删除已经不存在的照片
+func (database *Database) UpdatePhotos(userId int64, photos []PhotoEntry, removed []string) error {
+	tx, err := database.db.Begin()
+	if err != nil {
+		lib.Logger.Error("UpdatePhotos", err)
+		return err
+	}
+	for _, photo := range photos {
+		_, err = tx.Exec(`
+			INSERT INTO Photo (user_id, path, size, mtime, taken_at, make, model, width, height, orientation, has_gps, latitude, longitude)
+			VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)
+			ON CONFLICT (user_id, path) DO UPDATE SET
+				size = excluded.size,
+				mtime = excluded.mtime,
+				taken_at = excluded.taken_at,
+				make = excluded.make,
+				model = excluded.model,
+				width = excluded.width,
+				height = excluded.height,
+				orientation = excluded.orientation,
+				has_gps = excluded.has_gps,
+				latitude = excluded.latitude,
+				longitude = excluded.longitude;
+		`,
+			userId,
+			photo.Path,
+			photo.Size,
+			photo.MTime,
+			photo.TakenAt,
+			photo.Make,
+			photo.Model,
+			photo.Width,
+			photo.Height,
+			photo.Orientation,
+			photo.HasGPS,
+			photo.Latitude,
+			photo.Longitude)
+		if err != nil {
+			tx.Rollback()
+			lib.Logger.Error("UpdatePhotos", err)
+			return err
+		}
+	}
+	for _, path := range removed {
+		_, err = tx.Exec(`DELETE FROM Photo WHERE user_id =? AND path =?;`, userId, path)
+		if err != nil {
+			tx.Rollback()
+			lib.Logger.Error("UpdatePhotos", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// photoGroupLength 按年、月、日分组时 taken_at 取的长度
+func photoGroupLength(group string) int {
+	switch group {
+	case "year":
+		return 4
+	case "month":
+		return 7
+	}
+	return 10
+}
+
+// GetPhotoGroups 按年、月或日分组统计拍摄时间以 prefix 开头的照片，从新到旧排序
+func (database *Database) GetPhotoGroups(userId int64, group string, prefix string, offset int64, limit int64) ([]PhotoGroupEntry, error) {
+	groups := []PhotoGroupEntry{}
+	length := photoGroupLength(group)
+	rows, err := database.db.Query(`
+		SELECT substr(taken_at, 1, ?) AS key, COUNT(*),
+			(SELECT p.path FROM Photo p WHERE p.user_id = Photo.user_id AND substr(p.taken_at, 1, ?) = substr(Photo.taken_at, 1, ?)
+			 ORDER BY p.taken_at DESC, p.path LIMIT 1)
+		FROM Photo
+		WHERE user_id =? AND substr(taken_at, 1, ?) =?
+		GROUP BY key
+		ORDER BY key DESC
+		LIMIT ? OFFSET ?;
+	`, length, length, length, userId, len(prefix), prefix, limit, offset)
+	if err != nil {
+		lib.Logger.Error("GetPhotoGroups", err)
+		return groups, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := PhotoGroupEntry{}
+		err = rows.Scan(&entry.Key, &entry.Count, &entry.Cover)
+		if err != nil {
+			lib.Logger.Error("GetPhotoGroups", err)
+			return groups, err
+		}
+		groups = append(groups, entry)
+	}
+	return groups, nil
+}
+
+// GetPhotos 获取拍摄时间以 prefix 开头的照片，prefix 为空时获取所有照片，从新到旧排序
+func (database *Database) GetPhotos(userId int64, prefix string, offset int64, limit int64) ([]PhotoEntry, error) {
+	return database.queryPhotos(`
+		SELECT `+photoColumns+`
+		FROM Photo
+		WHERE user_id =? AND substr(taken_at, 1, ?) =?
+		ORDER BY taken_at DESC, path
+		LIMIT ? OFFSET ?;
+	`, userId, len(prefix), prefix, limit, offset)
+}
+
+// GetPhotoByPath 获取用户的照片记录，不存在时返回 sql.ErrNoRows
+func (database *Database) GetPhotoByPath(userId int64, path string) (PhotoEntry, error) {
+	photos, err := database.queryPhotos(`
+		SELECT `+photoColumns+`
+		FROM Photo
+		WHERE user_id =? AND path =?;
+	`, userId, path)
+	if err != nil {
+		return PhotoEntry{}, err
+	}
+	if len(photos) == 0 {
+		return PhotoEntry{}, sql.ErrNoRows
+	}
+	return photos[0], nil
+}
+
+func (database *Database) AddAlbum(userId int64, name string) (int64, error) {
+	now := time.Now().Format(time.DateTime)
+	res, err := database.db.Exec(`
+		INSERT INTO Album (user_id, name, created_at, updated_at)
+		VALUES (?,?,?,?);
+	`, userId, name, now, now)
+	if err != nil {
+		lib.Logger.Error("AddAlbum", err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (database *Database) GetAlbum(userId int64, id int64) (AlbumEntry, error) {
+	album := AlbumEntry{}
+	err := database.db.QueryRow(`
+		SELECT id, user_id, name, created_at, updated_at,
+			(SELECT COUNT(*) FROM AlbumPhoto WHERE album_id = Album.id),
+			COALESCE((SELECT path FROM AlbumPhoto WHERE album_id = Album.id ORDER BY added_at DESC, rowid DESC LIMIT 1), '')
+		FROM Album
+		WHERE id =? AND user_id =?;
+	`, id, userId).Scan(&album.Id, &album.UserId, &album.Name, &album.CreatedAt, &album.UpdatedAt, &album.Count, &album.Cover)
+	return album, err
+}
+
+// GetAlbums 获取用户的相册，包含照片数和封面
+func (database *Database) GetAlbums(userId int64) ([]AlbumEntry, error) {
+	albums := []AlbumEntry{}
+	rows, err := database.db.Query(`
+		SELECT id, user_id, name, created_at, updated_at,
+			(SELECT COUNT(*) FROM AlbumPhoto WHERE album_id = Album.id),
+			COALESCE((SELECT path FROM AlbumPhoto WHERE album_id = Album.id ORDER BY added_at DESC, rowid DESC LIMIT 1), '')
+		FROM Album
+		WHERE user_id =?
+		ORDER BY updated_at DESC;
+	`, userId)
+	if err != nil {
+		lib.Logger.Error("GetAlbums", err)
+		return albums, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		album := AlbumEntry{}
+		err = rows.Scan(&album.Id, &album.UserId, &album.Name, &album.CreatedAt, &album.UpdatedAt, &album.Count, &album.Cover)
+		if err != nil {
+			lib.Logger.Error("GetAlbums", err)
+			return albums, err
+		}
+		albums = append(albums, album)
+	}
+	return albums, nil
+}
+
+func (database *Database) RenameAlbum(id int64, name string) error {
+	_, err := database.db.Exec(`
+		UPDATE Album SET name =?, updated_at =? WHERE id =?;
+	`, name, time.Now().Format(time.DateTime), id)
+	if err != nil {
+		lib.Logger.Error("RenameAlbum", err)
+	}
+	return err
+}
+
+func (database *Database) DeleteAlbum(id int64) error {
+	tx, err := database.db.Begin()
+	if err != nil {
+		lib.Logger.Error("DeleteAlbum", err)
+		return err
+	}
+	for _, sqlStr := range []string{
+		`DELETE FROM AlbumPhoto WHERE album_id =?;`,
+		`DELETE FROM Album WHERE id =?;`,
+	} {
+		_, err = tx.Exec(sqlStr, id)
+		if err != nil {
+			tx.Rollback()
+			lib.Logger.Error("DeleteAlbum", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddAlbumPhotos 向相册中加入照片，已经在相册中的照片忽略
+func (database *Database) AddAlbumPhotos(id int64, paths []string) error {
+	tx, err := database.db.Begin()
+	if err != nil {
+		lib.Logger.Error("AddAlbumPhotos", err)
+		return err
+	}
+	now := time.Now().Format(time.DateTime)
+	for _, path := range paths {
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO AlbumPhoto (album_id, path, added_at)
+			VALUES (?,?,?);
+		`, id, path, now)
+		if err != nil {
+			tx.Rollback()
+			lib.Logger.Error("AddAlbumPhotos", err)
+			return err
+		}
+	}
+	_, err = tx.Exec(`UPDATE Album SET updated_at =? WHERE id =?;`, now, id)
+	if err != nil {
+		tx.Rollback()
+		lib.Logger.Error("AddAlbumPhotos", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (database *Database) DeleteAlbumPhotos(id int64, paths []string) error {
+	tx, err := database.db.Begin()
+	if err != nil {
+		lib.Logger.Error("DeleteAlbumPhotos", err)
+		return err
+	}
+	for _, path := range paths {
+		_, err = tx.Exec(`DELETE FROM AlbumPhoto WHERE album_id =? AND path =?;`, id, path)
+		if err != nil {
+			tx.Rollback()
+			lib.Logger.Error("DeleteAlbumPhotos", err)
+			return err
+		}
+	}
+	_, err = tx.Exec(`UPDATE Album SET updated_at =? WHERE id =?;`, time.Now().Format(time.DateTime), id)
+	if err != nil {
+		tx.Rollback()
+		lib.Logger.Error("DeleteAlbumPhotos", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAlbumPhotos 获取相册中的照片，按加入的时间从新到旧排序
+func (database *Database) GetAlbumPhotos(id int64, offset int64, limit int64) ([]AlbumPhotoEntry, error) {
+	photos := []AlbumPhotoEntry{}
+	rows, err := database.db.Query(`
+		SELECT path, added_at
+		FROM AlbumPhoto
+		WHERE album_id =?
+		ORDER BY added_at DESC, rowid DESC
+		LIMIT ? OFFSET ?;
+	`, id, limit, offset)
+	if err != nil {
+		lib.Logger.Error("GetAlbumPhotos", err)
+		return photos, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		photo := AlbumPhotoEntry{}
+		err = rows.Scan(&photo.Path, &photo.AddedAt)
+		if err != nil {
+			lib.Logger.Error("GetAlbumPhotos", err)
+			return photos, err
+		}
+		photos = append(photos, photo)
+	}
+	return photos, nil
+}
+
+// DeleteUserPhotos 删除用户时删除照片记录和相册
+func (database *Database) DeleteUserPhotos(userId int64) error {
+	for _, sqlStr := range []string{
+		`DELETE FROM AlbumPhoto WHERE album_id IN (SELECT id FROM Album WHERE user_id =?);`,
+		`DELETE FROM Album WHERE user_id =?;`,
+		`DELETE FROM Photo WHERE user_id =?;`,
+	} {
+		_, err := database.db.Exec(sqlStr, userId)
+		if err != nil {
+			lib.Logger.Error("DeleteUserPhotos", err)
+			return err
+		}
+	}
+	return nil
+}
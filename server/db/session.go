@@ -0,0 +1,185 @@
+package db
+
+import (
+	"myfileserver/lib"
+	"time"
+)
+
+type SessionEntry struct {
+	SessionId    string `json:"session_id"`     // 会话ID
+	UserId       int64  `json:"user_id"`        // 用户ID
+	UserName     string `json:"user_name"`      // 用户名
+	UserToken    string `json:"-"`              // 用户令牌，每次刷新登录时更换
+	Ip           string `json:"ip"`             // 登录的 IP
+	UserAgent    string `json:"user_agent"`     // 客户端信息
+	LoginAt      string `json:"login_at"`       // 最近一次登录（刷新）时间
+	FirstLoginAt string `json:"first_login_at"` // 第一次登录时间
+}
+
+func (database *Database) InitSession() error {
+	// 创建 Session 表，用于存储用户的登录会话，服务重启后会话仍然有效
+	_, err := database.db.Exec(`
+		CREATE TABLE IF NOT EXISTS Session (
+			session_id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			user_name TEXT NOT NULL,
+			user_token TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			login_at TEXT NOT NULL,
+			first_login_at TEXT NOT NULL
+		);
+	`)
+	if err != nil {
+		lib.Logger.Error("InitSession", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) AddSession(session SessionEntry) error {
+	_, err := database.db.Exec(`
+		INSERT INTO Session (session_id, user_id, user_name, user_token, ip, user_agent, login_at, first_login_at)
+		VALUES (?,?,?,?,?,?,?,?);
+	`,
+		session.SessionId,
+		session.UserId,
+		session.UserName,
+		session.UserToken,
+		session.Ip,
+		session.UserAgent,
+		session.LoginAt,
+		session.FirstLoginAt)
+	if err != nil {
+		lib.Logger.Error("AddSession", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) GetSession(sessionId string) (SessionEntry, error) {
+	session := SessionEntry{}
+	err := database.db.QueryRow(`
+		SELECT session_id, user_id, user_name, user_token, ip, user_agent, login_at, first_login_at
+		FROM Session
+		WHERE session_id =?;
+	`, sessionId).Scan(
+		&session.SessionId,
+		&session.UserId,
+		&session.UserName,
+		&session.UserToken,
+		&session.Ip,
+		&session.UserAgent,
+		&session.LoginAt,
+		&session.FirstLoginAt)
+	if err != nil {
+		return session, err
+	}
+	return session, nil
+}
+
+func (database *Database) IsExistSession(sessionId string) bool {
+	count := 0
+	err := database.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM Session
+		WHERE session_id =?;
+	`, sessionId).Scan(&count)
+	if err != nil {
+		lib.Logger.Error("IsExistSession", err)
+		return false
+	}
+	return count > 0
+}
+
+// RefreshSession 刷新会话的令牌和登录时间
+func (database *Database) RefreshSession(session SessionEntry) error {
+	_, err := database.db.Exec(`
+		UPDATE Session
+		SET user_token=?, ip=?, user_agent=?, login_at=?
+		WHERE session_id=?;
+	`,
+		session.UserToken,
+		session.Ip,
+		session.UserAgent,
+		session.LoginAt,
+		session.SessionId)
+	if err != nil {
+		lib.Logger.Error("RefreshSession", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) DeleteSession(sessionId string) error {
+	_, err := database.db.Exec(`
+		DELETE FROM Session
+		WHERE session_id =?;
+	`, sessionId)
+	if err != nil {
+		lib.Logger.Error("DeleteSession", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) DeleteUserSessions(userId int64) error {
+	_, err := database.db.Exec(`
+		DELETE FROM Session
+		WHERE user_id =?;
+	`, userId)
+	if err != nil {
+		lib.Logger.Error("DeleteUserSessions", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteExpiredSessions 删除过期的会话
+// 最近一次登录时间早于 loginBefore，或者第一次登录时间早于 firstLoginBefore 的会话都认为已过期
+func (database *Database) DeleteExpiredSessions(loginBefore time.Time, firstLoginBefore time.Time) (int64, error) {
+	res, err := database.db.Exec(`
+		DELETE FROM Session
+		WHERE login_at <? OR first_login_at <?;
+	`,
+		loginBefore.Format(time.DateTime),
+		firstLoginBefore.Format(time.DateTime))
+	if err != nil {
+		lib.Logger.Error("DeleteExpiredSessions", err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (database *Database) GetUserSessions(userId int64) ([]SessionEntry, error) {
+	sessions := []SessionEntry{}
+	rows, err := database.db.Query(`
+		SELECT session_id, user_id, user_name, user_token, ip, user_agent, login_at, first_login_at
+		FROM Session
+		WHERE user_id =?
+		ORDER BY login_at DESC;
+	`, userId)
+	if err != nil {
+		lib.Logger.Error("GetUserSessions", err)
+		return sessions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		session := SessionEntry{}
+		err := rows.Scan(
+			&session.SessionId,
+			&session.UserId,
+			&session.UserName,
+			&session.UserToken,
+			&session.Ip,
+			&session.UserAgent,
+			&session.LoginAt,
+			&session.FirstLoginAt)
+		if err != nil {
+			lib.Logger.Error("GetUserSessions", err)
+			return sessions, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
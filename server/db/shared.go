@@ -2,6 +2,7 @@ package db
 
 import (
 	"myfileserver/lib"
+	"path"
 	"time"
 )
 
@@ -10,7 +11,7 @@ type SharedEntry struct {
 	UserId            int64  `json:"user_id"`             // 用户ID
 	Sid               string `json:"sid"`                 // 分享码ID
 	Code              string `json:"code"`                // 分享码
-	Path              string `json:"path"`                // 目录或文件的路径
+	Path              string `json:"path"`                // 目录或文件的路径，相对于服务的根目录
 	CanDownload       bool   `json:"can_download"`        // 是否允许下载
 	CanUpload         bool   `json:"can_upload"`          // 是否允许上传
 	MaxCount          int    `json:"max_count"`           // 限制最大下载次数
@@ -19,6 +20,7 @@ type SharedEntry struct {
 	CurrentCount      int    `json:"current_count"`       // 当前下载次数
 	CurrentUploadSize int64  `json:"current_upload_size"` // 当前大小，单位：字节
 	CreatedAt         string `json:"created_at"`          // 创建时间
+	GroupId           int64  `json:"group_id"`            // 限制只有该用户组的成员登录后才能访问，0 表示不限制
 }
 
 type SharedHistoryEntry struct {
@@ -54,6 +56,39 @@ func (database *Database) InitShared() error {
 		return err
 	}
 
+	ret := 0
+	err = database.db.QueryRow(`SELECT 1 FROM sqlite_master WHERE type='table' AND name=? AND sql LIKE ?;`,
+		"Shared", "%group_id%").Scan(&ret)
+	if err != nil {
+		lib.Logger.Info("group_id not in Shared, add it")
+		_, err = database.db.Exec(`
+			ALTER TABLE Shared ADD COLUMN group_id INTEGER NOT NULL DEFAULT 0;
+		`)
+		if err != nil {
+			lib.Logger.Error("InitShared", err)
+			return err
+		}
+	}
+
+	// 分享的路径改为相对于服务根目录的路径，server_path 为 0 的是旧版本保存的相对于创建者根目录的路径
+	err = database.db.QueryRow(`SELECT 1 FROM sqlite_master WHERE type='table' AND name=? AND sql LIKE ?;`,
+		"Shared", "%server_path%").Scan(&ret)
+	if err != nil {
+		lib.Logger.Info("server_path not in Shared, add it")
+		_, err = database.db.Exec(`
+			ALTER TABLE Shared ADD COLUMN server_path INTEGER NOT NULL DEFAULT 0;
+		`)
+		if err != nil {
+			lib.Logger.Error("InitShared", err)
+			return err
+		}
+	}
+	err = database.convertSharedPath()
+	if err != nil {
+		lib.Logger.Error("InitShared", err)
+		return err
+	}
+
 	// 创建 SharedHistory 表，用于记录共享文件的历史操作
 	_, err = database.db.Exec(`
 		CREATE TABLE IF NOT EXISTS SharedHistory (
@@ -72,10 +107,40 @@ func (database *Database) InitShared() error {
 	return nil
 }
 
+// convertSharedPath 把旧版本的分享路径加上创建者的根目录，转换为相对于服务根目录的路径
+func (database *Database) convertSharedPath() error {
+	rows, err := database.db.Query(`
+		SELECT Shared.sid, Shared.path, IFNULL(User.root_dir, '/')
+		FROM Shared LEFT JOIN User ON Shared.user_id = User.id
+		WHERE Shared.server_path = 0;
+	`)
+	if err != nil {
+		return err
+	}
+	paths := map[string]string{}
+	for rows.Next() {
+		var sid, sharedPath, rootDir string
+		err = rows.Scan(&sid, &sharedPath, &rootDir)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		paths[sid] = path.Join("/", rootDir, sharedPath)
+	}
+	rows.Close()
+	for sid, serverPath := range paths {
+		_, err = database.db.Exec(`UPDATE Shared SET path=?, server_path=1 WHERE sid=?`, serverPath, sid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (database *Database) CreateShared(shared SharedEntry) error {
 	_, err := database.db.Exec(`
-		INSERT INTO Shared (sid, user_id, name, code, path, can_download, can_upload, current_count, max_count, current_upload_size, max_upload_size, time_limit, created_at)
-		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?);
+		INSERT INTO Shared (sid, user_id, name, code, path, can_download, can_upload, current_count, max_count, current_upload_size, max_upload_size, time_limit, created_at, group_id, server_path)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,1);
 	`,
 		shared.Sid,
 		shared.UserId,
@@ -89,7 +154,8 @@ func (database *Database) CreateShared(shared SharedEntry) error {
 		shared.CurrentUploadSize,
 		shared.MaxUploadSize,
 		shared.TimeLimied,
-		time.Now().Format(time.DateTime))
+		time.Now().Format(time.DateTime),
+		shared.GroupId)
 	if err != nil {
 		lib.Logger.Error("InsertShared", err)
 		return err
@@ -100,7 +166,7 @@ func (database *Database) CreateShared(shared SharedEntry) error {
 func (database *Database) GetSharedList(user_id int64) ([]SharedEntry, error) {
 	shareds := []SharedEntry{}
 	rows, err := database.db.Query(`
-		SELECT sid, user_id, name, code, path, can_download, can_upload, current_count, max_count, current_upload_size, max_upload_size, time_limit, created_at
+		SELECT sid, user_id, name, code, path, can_download, can_upload, current_count, max_count, current_upload_size, max_upload_size, time_limit, created_at, group_id
 		FROM Shared
 		WHERE user_id =?;
 	`, user_id)
@@ -124,7 +190,8 @@ func (database *Database) GetSharedList(user_id int64) ([]SharedEntry, error) {
 			&shared.CurrentUploadSize,
 			&shared.MaxUploadSize,
 			&shared.TimeLimied,
-			&shared.CreatedAt)
+			&shared.CreatedAt,
+			&shared.GroupId)
 		if err != nil {
 			lib.Logger.Error("GetSharedList", err)
 			return shareds, err
@@ -137,7 +204,7 @@ func (database *Database) GetSharedList(user_id int64) ([]SharedEntry, error) {
 func (database *Database) GetShared(sid string) (SharedEntry, error) {
 	shared := SharedEntry{}
 	err := database.db.QueryRow(`
-		SELECT sid, user_id, name, code, path, can_download, can_upload, current_count, max_count, current_upload_size, max_upload_size, time_limit, created_at
+		SELECT sid, user_id, name, code, path, can_download, can_upload, current_count, max_count, current_upload_size, max_upload_size, time_limit, created_at, group_id
 		FROM Shared
 		WHERE sid =?;
 	`, sid).Scan(
@@ -153,7 +220,8 @@ func (database *Database) GetShared(sid string) (SharedEntry, error) {
 		&shared.CurrentUploadSize,
 		&shared.MaxUploadSize,
 		&shared.TimeLimied,
-		&shared.CreatedAt)
+		&shared.CreatedAt,
+		&shared.GroupId)
 	if err != nil {
 		lib.Logger.Error("GetShared sid =", sid, err)
 		return shared, err
@@ -174,7 +242,7 @@ func (database *Database) DeleteShared(sid string) error {
 }
 
 func (database *Database) UpdateShared(shared SharedEntry) error {
-	_, err := database.db.Exec(`UPDATE Shared SET code=?, name=?, can_download=?, can_upload=?, current_count=?, max_count=?, current_upload_size=?, max_upload_size=?, time_limit=? WHERE sid=?`,
+	_, err := database.db.Exec(`UPDATE Shared SET code=?, name=?, can_download=?, can_upload=?, current_count=?, max_count=?, current_upload_size=?, max_upload_size=?, time_limit=?, group_id=? WHERE sid=?`,
 		shared.Code,
 		shared.Name,
 		shared.CanDownload,
@@ -184,6 +252,7 @@ func (database *Database) UpdateShared(shared SharedEntry) error {
 		shared.CurrentUploadSize,
 		shared.MaxUploadSize,
 		shared.TimeLimied,
+		shared.GroupId,
 		shared.Sid)
 	if err != nil {
 		lib.Logger.Error("UpdateShared", err)
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"myfileserver/lib"
+	"time"
+)
+
+type ApiTokenEntry struct {
+	Id         int64  `json:"id"`
+	UserId     int64  `json:"user_id"`      // 用户ID
+	Name       string `json:"name"`         // 令牌名称，便于区分用途
+	TokenHash  string `json:"-"`            // 令牌的哈希，不保存令牌明文
+	Prefix     string `json:"prefix"`       // 令牌的前缀，用于展示
+	Scopes     string `json:"scopes"`       // 权限范围，多个使用逗号分隔，为空时表示普通用户权限
+	ExpiresAt  string `json:"expires_at"`   // 过期时间，为空时表示永不过期
+	LastUsedAt string `json:"last_used_at"` // 最后一次使用的时间
+	CreatedAt  string `json:"created_at"`   // 创建时间
+}
+
+func (database *Database) InitApiToken() error {
+	// 创建 ApiToken 表，用于存储用户的个人访问令牌
+	_, err := database.db.Exec(`
+		CREATE TABLE IF NOT EXISTS ApiToken (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			prefix TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			last_used_at TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);
+	`)
+	if err != nil {
+		lib.Logger.Error("InitApiToken", err)
+		return err
+	}
+	return nil
+}
+
+func HashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (database *Database) AddApiToken(token ApiTokenEntry) (int64, error) {
+	res, err := database.db.Exec(`
+		INSERT INTO ApiToken (user_id, name, token_hash, prefix, scopes, expires_at, last_used_at, created_at)
+		VALUES (?,?,?,?,?,?,?,?);
+	`,
+		token.UserId,
+		token.Name,
+		token.TokenHash,
+		token.Prefix,
+		token.Scopes,
+		token.ExpiresAt,
+		"",
+		time.Now().Format(time.DateTime))
+	if err != nil {
+		lib.Logger.Error("AddApiToken", err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (database *Database) GetApiTokenByHash(tokenHash string) (ApiTokenEntry, error) {
+	token := ApiTokenEntry{}
+	err := database.db.QueryRow(`
+		SELECT id, user_id, name, token_hash, prefix, scopes, expires_at, last_used_at, created_at
+		FROM ApiToken
+		WHERE token_hash =?;
+	`, tokenHash).Scan(
+		&token.Id,
+		&token.UserId,
+		&token.Name,
+		&token.TokenHash,
+		&token.Prefix,
+		&token.Scopes,
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.CreatedAt)
+	if err != nil {
+		return token, err
+	}
+	return token, nil
+}
+
+func (database *Database) GetApiTokens(userId int64) ([]ApiTokenEntry, error) {
+	tokens := []ApiTokenEntry{}
+	rows, err := database.db.Query(`
+		SELECT id, user_id, name, token_hash, prefix, scopes, expires_at, last_used_at, created_at
+		FROM ApiToken
+		WHERE user_id =?
+		ORDER BY id DESC;
+	`, userId)
+	if err != nil {
+		lib.Logger.Error("GetApiTokens", err)
+		return tokens, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		token := ApiTokenEntry{}
+		err := rows.Scan(
+			&token.Id,
+			&token.UserId,
+			&token.Name,
+			&token.TokenHash,
+			&token.Prefix,
+			&token.Scopes,
+			&token.ExpiresAt,
+			&token.LastUsedAt,
+			&token.CreatedAt)
+		if err != nil {
+			lib.Logger.Error("GetApiTokens", err)
+			return tokens, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (database *Database) UpdateApiTokenLastUsedAt(id int64, lastUsedAt string) error {
+	_, err := database.db.Exec(`
+		UPDATE ApiToken
+		SET last_used_at=?
+		WHERE id=?;
+	`, lastUsedAt, id)
+	if err != nil {
+		lib.Logger.Error("UpdateApiTokenLastUsedAt", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) DeleteApiToken(userId int64, id int64) (int64, error) {
+	res, err := database.db.Exec(`
+		DELETE FROM ApiToken
+		WHERE user_id =? AND id =?;
+	`, userId, id)
+	if err != nil {
+		lib.Logger.Error("DeleteApiToken", err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (database *Database) DeleteUserApiTokens(userId int64) error {
+	_, err := database.db.Exec(`
+		DELETE FROM ApiToken
+		WHERE user_id =?;
+	`, userId)
+	if err != nil {
+		lib.Logger.Error("DeleteUserApiTokens", err)
+		return err
+	}
+	return nil
+}
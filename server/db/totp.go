@@ -0,0 +1,192 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"myfileserver/lib"
+	"strings"
+	"time"
+)
+
+type UserTotpEntry struct {
+	UserId      int64  `json:"user_id"`    // 用户ID
+	Secret      string `json:"-"`          // TOTP 密钥
+	Enabled     bool   `json:"enabled"`    // 是否已经完成验证并启用
+	LastCounter int64  `json:"-"`          // 上一次验证成功的时间步，用于防止验证码重放
+	CreatedAt   string `json:"created_at"` // 创建时间
+	EnabledAt   string `json:"enabled_at"` // 启用时间
+}
+
+func (database *Database) InitTotp() error {
+	// 创建 UserTotp 表，用于存储用户的两步验证密钥
+	_, err := database.db.Exec(`
+		CREATE TABLE IF NOT EXISTS UserTotp (
+			user_id INTEGER PRIMARY KEY,
+			secret TEXT NOT NULL,
+			enabled INTEGER NOT NULL,
+			last_counter INTEGER NOT NULL,
+			created_at TEXT NOT NULL,
+			enabled_at TEXT NOT NULL
+		);
+	`)
+	if err != nil {
+		lib.Logger.Error("InitTotp", err)
+		return err
+	}
+
+	// 创建 UserRecoveryCode 表，用于存储一次性恢复码的哈希
+	_, err = database.db.Exec(`
+		CREATE TABLE IF NOT EXISTS UserRecoveryCode (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);
+	`)
+	if err != nil {
+		lib.Logger.Error("InitTotp", err)
+		return err
+	}
+	return nil
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+func (database *Database) GetUserTotp(userId int64) (UserTotpEntry, error) {
+	entry := UserTotpEntry{}
+	err := database.db.QueryRow(`
+		SELECT user_id, secret, enabled, last_counter, created_at, enabled_at
+		FROM UserTotp
+		WHERE user_id =?;
+	`, userId).Scan(
+		&entry.UserId,
+		&entry.Secret,
+		&entry.Enabled,
+		&entry.LastCounter,
+		&entry.CreatedAt,
+		&entry.EnabledAt)
+	if err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// IsUserTotpEnabled 判断用户是否启用了两步验证
+func (database *Database) IsUserTotpEnabled(userId int64) bool {
+	entry, err := database.GetUserTotp(userId)
+	if err != nil {
+		return false
+	}
+	return entry.Enabled
+}
+
+// SetUserTotpSecret 保存一个待验证的密钥，原有的两步验证配置和恢复码都会被清除
+func (database *Database) SetUserTotpSecret(userId int64, secret string) error {
+	err := database.DeleteUserTotp(userId)
+	if err != nil {
+		return err
+	}
+	_, err = database.db.Exec(`
+		INSERT INTO UserTotp (user_id, secret, enabled, last_counter, created_at, enabled_at)
+		VALUES (?,?,?,?,?,?);
+	`, userId, secret, false, 0, time.Now().Format(time.DateTime), "")
+	if err != nil {
+		lib.Logger.Error("SetUserTotpSecret", err)
+		return err
+	}
+	return nil
+}
+
+// EnableUserTotp 启用两步验证并保存恢复码
+func (database *Database) EnableUserTotp(userId int64, counter int64, recoveryCodes []string) error {
+	tx, err := database.db.Begin()
+	if err != nil {
+		lib.Logger.Error("EnableUserTotp", err)
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		UPDATE UserTotp
+		SET enabled=?, last_counter=?, enabled_at=?
+		WHERE user_id=?;
+	`, true, counter, time.Now().Format(time.DateTime), userId)
+	if err != nil {
+		lib.Logger.Error("EnableUserTotp", err)
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM UserRecoveryCode WHERE user_id =?;`, userId)
+	if err != nil {
+		lib.Logger.Error("EnableUserTotp", err)
+		return err
+	}
+	for _, code := range recoveryCodes {
+		_, err = tx.Exec(`
+			INSERT INTO UserRecoveryCode (user_id, code_hash, created_at)
+			VALUES (?,?,?);
+		`, userId, hashRecoveryCode(code), time.Now().Format(time.DateTime))
+		if err != nil {
+			lib.Logger.Error("EnableUserTotp", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (database *Database) UpdateUserTotpCounter(userId int64, counter int64) error {
+	_, err := database.db.Exec(`
+		UPDATE UserTotp
+		SET last_counter=?
+		WHERE user_id=?;
+	`, counter, userId)
+	if err != nil {
+		lib.Logger.Error("UpdateUserTotpCounter", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteUserTotp 关闭两步验证，同时删除恢复码
+func (database *Database) DeleteUserTotp(userId int64) error {
+	_, err := database.db.Exec(`DELETE FROM UserTotp WHERE user_id =?;`, userId)
+	if err != nil {
+		lib.Logger.Error("DeleteUserTotp", err)
+		return err
+	}
+	_, err = database.db.Exec(`DELETE FROM UserRecoveryCode WHERE user_id =?;`, userId)
+	if err != nil {
+		lib.Logger.Error("DeleteUserTotp", err)
+		return err
+	}
+	return nil
+}
+
+// UseRecoveryCode 使用一次恢复码，恢复码使用后立即失效
+func (database *Database) UseRecoveryCode(userId int64, code string) bool {
+	res, err := database.db.Exec(`
+		DELETE FROM UserRecoveryCode
+		WHERE user_id =? AND code_hash =?;
+	`, userId, hashRecoveryCode(code))
+	if err != nil {
+		lib.Logger.Error("UseRecoveryCode", err)
+		return false
+	}
+	count, err := res.RowsAffected()
+	return err == nil && count > 0
+}
+
+func (database *Database) GetRecoveryCodeCount(userId int64) int {
+	count := 0
+	err := database.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM UserRecoveryCode
+		WHERE user_id =?;
+	`, userId).Scan(&count)
+	if err != nil {
+		lib.Logger.Error("GetRecoveryCodeCount", err)
+		return 0
+	}
+	return count
+}
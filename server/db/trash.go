@@ -0,0 +1,169 @@
+package db
+
+import (
+	"myfileserver/lib"
+	"time"
+)
+
+type TrashEntry struct {
+	Id         int64  `json:"id"`
+	UserId     int64  `json:"user_id"`     // 删除文件的用户ID
+	Name       string `json:"name"`        // 文件名
+	Path       string `json:"path"`        // 删除前用户看到的路径
+	ServerPath string `json:"server_path"` // 删除前相对于服务根目录的路径，用于还原
+	TrashName  string `json:"-"`           // 在回收站目录中保存的名称
+	Size       int64  `json:"size"`        // 文件或目录的大小
+	IsDir      bool   `json:"is_dir"`      // 是否是目录
+	DeletedAt  string `json:"deleted_at"`  // 删除时间
+}
+
+func (database *Database) InitTrash() error {
+	// 创建 Trash 表，用于记录回收站中的文件
+	_, err := database.db.Exec(`
+		CREATE TABLE IF NOT EXISTS Trash (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			path TEXT NOT NULL,
+			server_path TEXT NOT NULL,
+			trash_name TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			is_dir INTEGER NOT NULL,
+			deleted_at TEXT NOT NULL
+		);
+	`)
+	if err != nil {
+		lib.Logger.Error("InitTrash", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) AddTrash(trash TrashEntry) (int64, error) {
+	res, err := database.db.Exec(`
+		INSERT INTO Trash (user_id, name, path, server_path, trash_name, size, is_dir, deleted_at)
+		VALUES (?,?,?,?,?,?,?,?);
+	`,
+		trash.UserId,
+		trash.Name,
+		trash.Path,
+		trash.ServerPath,
+		trash.TrashName,
+		trash.Size,
+		trash.IsDir,
+		time.Now().Format(time.DateTime))
+	if err != nil {
+		lib.Logger.Error("AddTrash", err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (database *Database) GetTrash(id int64) (TrashEntry, error) {
+	trash := TrashEntry{}
+	err := database.db.QueryRow(`
+		SELECT id, user_id, name, path, server_path, trash_name, size, is_dir, deleted_at
+		FROM Trash
+		WHERE id =?;
+	`, id).Scan(
+		&trash.Id,
+		&trash.UserId,
+		&trash.Name,
+		&trash.Path,
+		&trash.ServerPath,
+		&trash.TrashName,
+		&trash.Size,
+		&trash.IsDir,
+		&trash.DeletedAt)
+	if err != nil {
+		return trash, err
+	}
+	return trash, nil
+}
+
+func (database *Database) queryTrashes(query string, args ...any) ([]TrashEntry, error) {
+	trashes := []TrashEntry{}
+	rows, err := database.db.Query(query, args...)
+	if err != nil {
+		lib.Logger.Error("queryTrashes", err)
+		return trashes, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		trash := TrashEntry{}
+		err := rows.Scan(
+			&trash.Id,
+			&trash.UserId,
+			&trash.Name,
+			&trash.Path,
+			&trash.ServerPath,
+			&trash.TrashName,
+			&trash.Size,
+			&trash.IsDir,
+			&trash.DeletedAt)
+		if err != nil {
+			lib.Logger.Error("queryTrashes", err)
+			return trashes, err
+		}
+		trashes = append(trashes, trash)
+	}
+	return trashes, nil
+}
+
+func (database *Database) GetUserTrashes(userId int64) ([]TrashEntry, error) {
+	return database.queryTrashes(`
+		SELECT id, user_id, name, path, server_path, trash_name, size, is_dir, deleted_at
+		FROM Trash
+		WHERE user_id =?
+		ORDER BY id DESC;
+	`, userId)
+}
+
+// GetExpiredTrashes 获取用户在 before 之前删除的文件
+func (database *Database) GetExpiredTrashes(userId int64, before time.Time) ([]TrashEntry, error) {
+	return database.queryTrashes(`
+		SELECT id, user_id, name, path, server_path, trash_name, size, is_dir, deleted_at
+		FROM Trash
+		WHERE user_id =? AND deleted_at <?
+		ORDER BY id;
+	`, userId, before.Format(time.DateTime))
+}
+
+// GetUserTrashSize 获取用户回收站中文件的总大小
+func (database *Database) GetUserTrashSize(userId int64) (int64, error) {
+	size := int64(0)
+	err := database.db.QueryRow(`
+		SELECT IFNULL(SUM(size), 0)
+		FROM Trash
+		WHERE user_id =?;
+	`, userId).Scan(&size)
+	if err != nil {
+		lib.Logger.Error("GetUserTrashSize", err)
+		return 0, err
+	}
+	return size, nil
+}
+
+func (database *Database) DeleteTrash(id int64) error {
+	_, err := database.db.Exec(`
+		DELETE FROM Trash
+		WHERE id =?;
+	`, id)
+	if err != nil {
+		lib.Logger.Error("DeleteTrash", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) DeleteUserTrashes(userId int64) error {
+	_, err := database.db.Exec(`
+		DELETE FROM Trash
+		WHERE user_id =?;
+	`, userId)
+	if err != nil {
+		lib.Logger.Error("DeleteUserTrashes", err)
+		return err
+	}
+	return nil
+}
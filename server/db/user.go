@@ -1,9 +1,9 @@
 package db
 
 import (
-	"errors"
 	"log"
 	"myfileserver/lib"
+	"strings"
 	"time"
 )
 
@@ -19,6 +19,47 @@ type UserEntry struct {
 	RootDir      string `json:"root_dir"`       // 用户的根目录
 	IsAdmin      bool   `json:"is_admin"`       // 是否是管理员
 	ShowDotFiles bool   `json:"show_dot_files"` // 是否显示隐藏文件
+	Permissions  string `json:"permissions"`    // 权限限制，多个使用逗号分隔，如 read_only,no_xterm
+	Quota        int64  `json:"quota"`          // 空间配额，单位：字节，0表示不限制
+	UsedSize     int64  `json:"used_size"`      // 已使用的空间，单位：字节，定时按实际大小校正
+}
+
+// 用户的权限限制，对管理员无效
+const (
+	PermissionReadOnly   = "read_only"   // 只读，不能上传、修改、删除文件，不能使用终端
+	PermissionNoDelete   = "no_delete"   // 不能删除文件
+	PermissionNoXterm    = "no_xterm"    // 不能使用终端
+	PermissionNoShare    = "no_share"    // 不能创建和修改分享
+	PermissionUploadOnly = "upload_only" // 只能上传文件和新建目录，不能修改、删除已有的文件
+)
+
+var AllPermissions = []string{
+	PermissionReadOnly,
+	PermissionNoDelete,
+	PermissionNoXterm,
+	PermissionNoShare,
+	PermissionUploadOnly,
+}
+
+// HasPermission 判断用户是否设置了指定的权限限制
+func (user UserEntry) HasPermission(permission string) bool {
+	for _, v := range strings.Split(user.Permissions, ",") {
+		if strings.TrimSpace(v) == permission {
+			return true
+		}
+	}
+	return false
+}
+
+type GroupEntry struct {
+	Id           int64   `json:"id"`
+	Name         string  `json:"name"`          // 用户组名称
+	RootTemplate string  `json:"root_template"` // 新用户根目录的模板，{name} 会被替换为用户名
+	Permissions  string  `json:"permissions"`   // 新用户默认的权限限制
+	Quota        int64   `json:"quota"`         // 新用户默认的空间配额，单位：字节，0 表示不限制
+	Members      []int64 `json:"members"`       // 成员的用户ID
+	CreatedAt    string  `json:"created_at"`    // 创建时间
+	UpdatedAt    string  `json:"updated_at"`    // 更新时间
 }
 
 type UserHistoryEntry struct {
@@ -90,6 +131,76 @@ func (database *Database) InitUser() error {
 		}
 	}
 
+	err = database.db.QueryRow(`SELECT 1 FROM sqlite_master WHERE type='table' AND name=? AND sql LIKE ?;`,
+		"User", "%permissions%").Scan(&ret)
+	if err != nil {
+		lib.Logger.Info("permissions not in User, add it")
+		_, err = database.db.Exec(`
+			ALTER TABLE User ADD COLUMN permissions TEXT NOT NULL DEFAULT '';
+		`)
+		if err != nil {
+			lib.Logger.Error(err)
+			return err
+		}
+	}
+
+	err = database.db.QueryRow(`SELECT 1 FROM sqlite_master WHERE type='table' AND name=? AND sql LIKE ?;`,
+		"User", "%quota%").Scan(&ret)
+	if err != nil {
+		lib.Logger.Info("quota not in User, add it")
+		_, err = database.db.Exec(`
+			ALTER TABLE User ADD COLUMN quota INTEGER NOT NULL DEFAULT 0;
+		`)
+		if err != nil {
+			lib.Logger.Error(err)
+			return err
+		}
+	}
+
+	err = database.db.QueryRow(`SELECT 1 FROM sqlite_master WHERE type='table' AND name=? AND sql LIKE ?;`,
+		"User", "%used_size%").Scan(&ret)
+	if err != nil {
+		lib.Logger.Info("used_size not in User, add it")
+		_, err = database.db.Exec(`
+			ALTER TABLE User ADD COLUMN used_size INTEGER NOT NULL DEFAULT 0;
+		`)
+		if err != nil {
+			lib.Logger.Error(err)
+			return err
+		}
+	}
+
+	// 创建 Group 表，用于存储用户组的信息
+	_, err = database.db.Exec(`
+		CREATE TABLE IF NOT EXISTS "Group" (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			root_template TEXT NOT NULL,
+			permissions TEXT NOT NULL,
+			quota INTEGER NOT NULL,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		);
+	`)
+	if err != nil {
+		lib.Logger.Error(err)
+		return err
+	}
+
+	// 创建 GroupMember 表，用于存储用户组的成员
+	_, err = database.db.Exec(`
+		CREATE TABLE IF NOT EXISTS GroupMember (
+			group_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			created_at TEXT NOT NULL,
+			PRIMARY KEY (group_id, user_id)
+		);
+	`)
+	if err != nil {
+		lib.Logger.Error(err)
+		return err
+	}
+
 	// 创建 UserSetting 表，用于记录用户的配置信息
 	_, err = database.db.Exec(`
 		CREATE TABLE IF NOT EXISTS UserSetting (
@@ -109,7 +220,7 @@ func (database *Database) InitUser() error {
 func (database *Database) GetUser(name string) (UserEntry, error) {
 	user := UserEntry{}
 	err := database.db.QueryRow(`
-		SELECT id, name, password, email, enabled, created_at, updated_at, last_login_at, root_dir, is_admin, show_dot_files
+		SELECT id, name, password, email, enabled, created_at, updated_at, last_login_at, root_dir, is_admin, show_dot_files, permissions, quota, used_size
 		FROM User
 		WHERE name =?;
 	`, name).Scan(
@@ -123,7 +234,10 @@ func (database *Database) GetUser(name string) (UserEntry, error) {
 		&user.LastLoginAt,
 		&user.RootDir,
 		&user.IsAdmin,
-		&user.ShowDotFiles)
+		&user.ShowDotFiles,
+		&user.Permissions,
+		&user.Quota,
+		&user.UsedSize)
 	if err != nil {
 		lib.Logger.Error("GetUser failed!", err)
 		return UserEntry{}, err
@@ -134,7 +248,7 @@ func (database *Database) GetUser(name string) (UserEntry, error) {
 func (database *Database) GetUserById(id int64) (UserEntry, error) {
 	user := UserEntry{}
 	err := database.db.QueryRow(`
-		SELECT id, name, password, email, enabled, created_at, updated_at, last_login_at, root_dir, is_admin, show_dot_files
+		SELECT id, name, password, email, enabled, created_at, updated_at, last_login_at, root_dir, is_admin, show_dot_files, permissions, quota, used_size
 		FROM User
 		WHERE id =?;
 	`, id).Scan(
@@ -148,7 +262,10 @@ func (database *Database) GetUserById(id int64) (UserEntry, error) {
 		&user.LastLoginAt,
 		&user.RootDir,
 		&user.IsAdmin,
-		&user.ShowDotFiles)
+		&user.ShowDotFiles,
+		&user.Permissions,
+		&user.Quota,
+		&user.UsedSize)
 	if err != nil {
 		lib.Logger.Error("GetUserById id =", id, err)
 		return user, err
@@ -160,7 +277,7 @@ func (database *Database) GetUserById(id int64) (UserEntry, error) {
 func (database *Database) GetUsers() ([]UserEntry, error) {
 	users := []UserEntry{}
 	rows, err := database.db.Query(`
-		SELECT id, name, password, email, enabled, created_at, updated_at, last_login_at, root_dir, is_admin, show_dot_files
+		SELECT id, name, password, email, enabled, created_at, updated_at, last_login_at, root_dir, is_admin, show_dot_files, permissions, quota, used_size
 		FROM User;
 	`)
 	if err != nil {
@@ -181,7 +298,10 @@ func (database *Database) GetUsers() ([]UserEntry, error) {
 			&user.LastLoginAt,
 			&user.RootDir,
 			&user.IsAdmin,
-			&user.ShowDotFiles)
+			&user.ShowDotFiles,
+			&user.Permissions,
+			&user.Quota,
+			&user.UsedSize)
 		if err != nil {
 			lib.Logger.Error("GetUsers", err)
 			return users, err
@@ -192,9 +312,16 @@ func (database *Database) GetUsers() ([]UserEntry, error) {
 }
 
 func (database *Database) AddUser(user UserEntry) error {
-	_, err := database.db.Exec(`
-		INSERT INTO User (name, password, email, enabled, created_at, updated_at, last_login_at, root_dir, is_admin, show_dot_files)
-		VALUES (?,?,?,?,?,?,?,?,?,?);
+	// 密码以哈希形式保存，不保存明文，传入的总是明文密码
+	hashed, err := lib.HashPassword(user.Password)
+	if err != nil {
+		lib.Logger.Error("AddUser: hash password failed!", err)
+		return err
+	}
+	user.Password = hashed
+	_, err = database.db.Exec(`
+		INSERT INTO User (name, password, email, enabled, created_at, updated_at, last_login_at, root_dir, is_admin, show_dot_files, permissions, quota)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?);
 	`,
 		user.Name,
 		user.Password,
@@ -205,7 +332,9 @@ func (database *Database) AddUser(user UserEntry) error {
 		user.LastLoginAt,
 		user.RootDir,
 		user.IsAdmin,
-		user.ShowDotFiles)
+		user.ShowDotFiles,
+		user.Permissions,
+		user.Quota)
 	if err != nil {
 		lib.Logger.Error("AddUser", err)
 		return err
@@ -228,22 +357,42 @@ func (database *Database) UpdateUserLastLoginAt(user UserEntry) error {
 	return nil
 }
 
-func (database *Database) UpdateUser(user UserEntry) error {
-	if user.Password == "" {
-		return errors.New("password is empty")
+// UpdateUserPassword 更新用户的密码，password 为明文密码
+func (database *Database) UpdateUserPassword(id int64, password string) error {
+	hashed, err := lib.HashPassword(password)
+	if err != nil {
+		lib.Logger.Error("UpdateUserPassword: hash password failed!", err)
+		return err
 	}
+	_, err = database.db.Exec(`
+		UPDATE User
+		SET password=?
+		WHERE id=?;
+	`,
+		hashed,
+		id)
+	if err != nil {
+		lib.Logger.Error("UpdateUserPassword", err)
+		return err
+	}
+	return nil
+}
+
+// UpdateUser 更新用户的信息，不修改密码，修改密码使用 UpdateUserPassword
+func (database *Database) UpdateUser(user UserEntry) error {
 	_, err := database.db.Exec(`
 		UPDATE User
-		SET name=?, email=?, enabled=?, password=?, root_dir=?, is_admin=?, show_dot_files=?, updated_at=?
+		SET name=?, email=?, enabled=?, root_dir=?, is_admin=?, show_dot_files=?, permissions=?, quota=?, updated_at=?
 		WHERE id=?;
 	`,
 		user.Name,
 		user.Email,
 		user.Enabled,
-		user.Password,
 		user.RootDir,
 		user.IsAdmin,
 		user.ShowDotFiles,
+		user.Permissions,
+		user.Quota,
 		time.Now().Format(time.DateTime),
 		user.Id)
 	if err != nil {
@@ -253,6 +402,38 @@ func (database *Database) UpdateUser(user UserEntry) error {
 	return nil
 }
 
+// UpdateUserUsedSize 保存按实际大小统计的已使用空间
+func (database *Database) UpdateUserUsedSize(id int64, usedSize int64) error {
+	_, err := database.db.Exec(`
+		UPDATE User
+		SET used_size=?
+		WHERE id=?;
+	`,
+		usedSize,
+		id)
+	if err != nil {
+		lib.Logger.Error("UpdateUserUsedSize", err)
+		return err
+	}
+	return nil
+}
+
+// AddUserUsedSize 写入或删除文件后增减已使用的空间
+func (database *Database) AddUserUsedSize(id int64, delta int64) error {
+	_, err := database.db.Exec(`
+		UPDATE User
+		SET used_size=MAX(used_size+?, 0)
+		WHERE id=?;
+	`,
+		delta,
+		id)
+	if err != nil {
+		lib.Logger.Error("AddUserUsedSize", err)
+		return err
+	}
+	return nil
+}
+
 func (database *Database) DeleteUser(id int64) error {
 	_, err := database.db.Exec(`
 		DELETE FROM User
@@ -414,3 +595,232 @@ func (database *Database) GetUserSettings(userId int64) ([]UserSettingEntry, err
 	}
 	return settings, nil
 }
+
+// GetRootDir 根据模板生成用户的根目录
+func (group GroupEntry) GetRootDir(username string) string {
+	return strings.ReplaceAll(group.RootTemplate, "{name}", username)
+}
+
+func (database *Database) GetGroup(id int64) (GroupEntry, error) {
+	group := GroupEntry{}
+	err := database.db.QueryRow(`
+		SELECT id, name, root_template, permissions, quota, created_at, updated_at
+		FROM "Group"
+		WHERE id =?;
+	`, id).Scan(
+		&group.Id,
+		&group.Name,
+		&group.RootTemplate,
+		&group.Permissions,
+		&group.Quota,
+		&group.CreatedAt,
+		&group.UpdatedAt)
+	if err != nil {
+		lib.Logger.Error("GetGroup id =", id, err)
+		return group, err
+	}
+	group.Members, err = database.GetGroupMembers(id)
+	if err != nil {
+		return group, err
+	}
+	return group, nil
+}
+
+func (database *Database) GetGroups() ([]GroupEntry, error) {
+	groups := []GroupEntry{}
+	rows, err := database.db.Query(`
+		SELECT id, name, root_template, permissions, quota, created_at, updated_at
+		FROM "Group"
+		ORDER BY id;
+	`)
+	if err != nil {
+		lib.Logger.Error("GetGroups", err)
+		return groups, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var group GroupEntry
+		err := rows.Scan(
+			&group.Id,
+			&group.Name,
+			&group.RootTemplate,
+			&group.Permissions,
+			&group.Quota,
+			&group.CreatedAt,
+			&group.UpdatedAt)
+		if err != nil {
+			lib.Logger.Error("GetGroups", err)
+			return groups, err
+		}
+		groups = append(groups, group)
+	}
+	rows.Close()
+	for i := range groups {
+		groups[i].Members, err = database.GetGroupMembers(groups[i].Id)
+		if err != nil {
+			return groups, err
+		}
+	}
+	return groups, nil
+}
+
+// GetUserGroups 获取用户所属的用户组，按加入的先后顺序排列
+func (database *Database) GetUserGroups(userId int64) ([]GroupEntry, error) {
+	groups := []GroupEntry{}
+	rows, err := database.db.Query(`
+		SELECT g.id, g.name, g.root_template, g.permissions, g.quota, g.created_at, g.updated_at
+		FROM "Group" g JOIN GroupMember m ON g.id = m.group_id
+		WHERE m.user_id =?
+		ORDER BY m.created_at, g.id;
+	`, userId)
+	if err != nil {
+		lib.Logger.Error("GetUserGroups", err)
+		return groups, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var group GroupEntry
+		err := rows.Scan(
+			&group.Id,
+			&group.Name,
+			&group.RootTemplate,
+			&group.Permissions,
+			&group.Quota,
+			&group.CreatedAt,
+			&group.UpdatedAt)
+		if err != nil {
+			lib.Logger.Error("GetUserGroups", err)
+			return groups, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (database *Database) AddGroup(group GroupEntry) (int64, error) {
+	res, err := database.db.Exec(`
+		INSERT INTO "Group" (name, root_template, permissions, quota, created_at, updated_at)
+		VALUES (?,?,?,?,?,?);
+	`,
+		group.Name,
+		group.RootTemplate,
+		group.Permissions,
+		group.Quota,
+		time.Now().Format(time.DateTime),
+		time.Now().Format(time.DateTime))
+	if err != nil {
+		lib.Logger.Error("AddGroup", err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (database *Database) UpdateGroup(group GroupEntry) error {
+	_, err := database.db.Exec(`
+		UPDATE "Group"
+		SET name=?, root_template=?, permissions=?, quota=?, updated_at=?
+		WHERE id=?;
+	`,
+		group.Name,
+		group.RootTemplate,
+		group.Permissions,
+		group.Quota,
+		time.Now().Format(time.DateTime),
+		group.Id)
+	if err != nil {
+		lib.Logger.Error("UpdateGroup", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteGroup 删除用户组，同时删除成员关系
+func (database *Database) DeleteGroup(id int64) error {
+	_, err := database.db.Exec(`DELETE FROM "Group" WHERE id =?;`, id)
+	if err != nil {
+		lib.Logger.Error("DeleteGroup", err)
+		return err
+	}
+	_, err = database.db.Exec(`DELETE FROM GroupMember WHERE group_id =?;`, id)
+	if err != nil {
+		lib.Logger.Error("DeleteGroup", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) GetGroupMembers(groupId int64) ([]int64, error) {
+	members := []int64{}
+	rows, err := database.db.Query(`
+		SELECT user_id
+		FROM GroupMember
+		WHERE group_id =?
+		ORDER BY user_id;
+	`, groupId)
+	if err != nil {
+		lib.Logger.Error("GetGroupMembers", err)
+		return members, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userId int64
+		err := rows.Scan(&userId)
+		if err != nil {
+			lib.Logger.Error("GetGroupMembers", err)
+			return members, err
+		}
+		members = append(members, userId)
+	}
+	return members, nil
+}
+
+func (database *Database) IsGroupMember(groupId int64, userId int64) bool {
+	count := 0
+	err := database.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM GroupMember
+		WHERE group_id =? AND user_id =?;
+	`, groupId, userId).Scan(&count)
+	if err != nil {
+		lib.Logger.Error("IsGroupMember", err)
+		return false
+	}
+	return count > 0
+}
+
+func (database *Database) AddGroupMember(groupId int64, userId int64) error {
+	_, err := database.db.Exec(`
+		INSERT OR IGNORE INTO GroupMember (group_id, user_id, created_at)
+		VALUES (?,?,?);
+	`, groupId, userId, time.Now().Format(time.DateTime))
+	if err != nil {
+		lib.Logger.Error("AddGroupMember", err)
+		return err
+	}
+	return nil
+}
+
+func (database *Database) DeleteGroupMember(groupId int64, userId int64) error {
+	_, err := database.db.Exec(`
+		DELETE FROM GroupMember
+		WHERE group_id =? AND user_id =?;
+	`, groupId, userId)
+	if err != nil {
+		lib.Logger.Error("DeleteGroupMember", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteUserGroups 把用户从所有的用户组中移除
+func (database *Database) DeleteUserGroups(userId int64) error {
+	_, err := database.db.Exec(`
+		DELETE FROM GroupMember
+		WHERE user_id =?;
+	`, userId)
+	if err != nil {
+		lib.Logger.Error("DeleteUserGroups", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"myfileserver/lib"
+	"time"
+)
+
+type FileVersionEntry struct {
+	Id          int64  `json:"id"`
+	ServerPath  string `json:"server_path"` // 文件相对于服务根目录的路径
+	Version     int64  `json:"version"`     // 版本号，同一个文件从1开始递增
+	Size        int64  `json:"size"`        // 文件大小
+	ModifiedAt  string `json:"modified_at"` // 该版本的文件修改时间
+	StorageName string `json:"-"`           // 在版本目录中保存的名称
+	UserId      int64  `json:"user_id"`     // 文件所属的用户ID，版本计入该用户的已使用空间
+	CreatedAt   string `json:"created_at"`  // 保存版本的时间
+}
+
+func (database *Database) InitFileVersion() error {
+	// 创建 FileVersion 表，用于记录文件被覆盖前的历史版本
+	_, err := database.db.Exec(`
+		CREATE TABLE IF NOT EXISTS FileVersion (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			server_path TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			size INTEGER NOT NULL,
+			modified_at TEXT NOT NULL,
+			storage_name TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			created_at TEXT NOT NULL
+		);
+	`)
+	if err != nil {
+		lib.Logger.Error("InitFileVersion", err)
+		return err
+	}
+	_, err = database.db.Exec(`
+		CREATE INDEX IF NOT EXISTS FileVersionPath ON FileVersion (server_path, version);
+	`)
+	if err != nil {
+		lib.Logger.Error("InitFileVersion", err)
+		return err
+	}
+	return nil
+}
+
+// AddFileVersion 保存文件的历史版本，版本号为该文件当前最大的版本号加1
+func (database *Database) AddFileVersion(version FileVersionEntry) (int64, error) {
+	res, err := database.db.Exec(`
+		INSERT INTO FileVersion (server_path, version, size, modified_at, storage_name, user_id, created_at)
+		VALUES (?,(SELECT COALESCE(MAX(version), 0) + 1 FROM FileVersion WHERE server_path =?),?,?,?,?,?);
+	`,
+		version.ServerPath,
+		version.ServerPath,
+		version.Size,
+		version.ModifiedAt,
+		version.StorageName,
+		version.UserId,
+		time.Now().Format(time.DateTime))
+	if err != nil {
+		lib.Logger.Error("AddFileVersion", err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (database *Database) GetFileVersion(serverPath string, version int64) (FileVersionEntry, error) {
+	entry := FileVersionEntry{}
+	err := database.db.QueryRow(`
+		SELECT id, server_path, version, size, modified_at, storage_name, user_id, created_at
+		FROM FileVersion
+		WHERE server_path =? AND version =?;
+	`, serverPath, version).Scan(
+		&entry.Id,
+		&entry.ServerPath,
+		&entry.Version,
+		&entry.Size,
+		&entry.ModifiedAt,
+		&entry.StorageName,
+		&entry.UserId,
+		&entry.CreatedAt)
+	if err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+func (database *Database) queryFileVersions(query string, args ...any) ([]FileVersionEntry, error) {
+	versions := []FileVersionEntry{}
+	rows, err := database.db.Query(query, args...)
+	if err != nil {
+		lib.Logger.Error("queryFileVersions", err)
+		return versions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := FileVersionEntry{}
+		err := rows.Scan(
+			&entry.Id,
+			&entry.ServerPath,
+			&entry.Version,
+			&entry.Size,
+			&entry.ModifiedAt,
+			&entry.StorageName,
+			&entry.UserId,
+			&entry.CreatedAt)
+		if err != nil {
+			lib.Logger.Error("queryFileVersions", err)
+			return versions, err
+		}
+		versions = append(versions, entry)
+	}
+	return versions, nil
+}
+
+// GetFileVersions 获取文件的历史版本，新的版本在前
+func (database *Database) GetFileVersions(serverPath string) ([]FileVersionEntry, error) {
+	return database.queryFileVersions(`
+		SELECT id, server_path, version, size, modified_at, storage_name, user_id, created_at
+		FROM FileVersion
+		WHERE server_path =?
+		ORDER BY version DESC;
+	`, serverPath)
+}
+
+// GetExpiredFileVersions 获取用户在 before 之前保存的历史版本
+func (database *Database) GetExpiredFileVersions(userId int64, before time.Time) ([]FileVersionEntry, error) {
+	return database.queryFileVersions(`
+		SELECT id, server_path, version, size, modified_at, storage_name, user_id, created_at
+		FROM FileVersion
+		WHERE user_id =? AND created_at <?
+		ORDER BY id;
+	`, userId, before.Format(time.DateTime))
+}
+
+// GetUserFileVersionSize 获取用户覆盖文件时保存的历史版本的总大小
+func (database *Database) GetUserFileVersionSize(userId int64) (int64, error) {
+	size := int64(0)
+	err := database.db.QueryRow(`
+		SELECT IFNULL(SUM(size), 0)
+		FROM FileVersion
+		WHERE user_id =?;
+	`, userId).Scan(&size)
+	if err != nil {
+		lib.Logger.Error("GetUserFileVersionSize", err)
+		return 0, err
+	}
+	return size, nil
+}
+
+func (database *Database) DeleteFileVersion(id int64) error {
+	_, err := database.db.Exec(`
+		DELETE FROM FileVersion
+		WHERE id =?;
+	`, id)
+	if err != nil {
+		lib.Logger.Error("DeleteFileVersion", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// 文本文件的编码识别和转换
+// 依次按 BOM、UTF-8、GB18030（兼容 GBK 和 GB2312）识别，包含空字符或都不符合时认为不是文本文件
+
+var (
+	ErrNotText        = errors.New("file is not text")
+	ErrCharsetInvalid = errors.New("charset is invalid")
+)
+
+// DetectCharset 识别文本的编码，返回 WHATWG 编码标准中的名称，不是文本时返回 false
+func DetectCharset(data []byte) (string, bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8", true
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return "utf-16le", true
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return "utf-16be", true
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", false
+	}
+	if utf8.Valid(data) {
+		return "utf-8", true
+	}
+	// 解码失败的字节会被替换为 U+FFFD
+	decoded, err := simplifiedchinese.GB18030.NewDecoder().Bytes(data)
+	if err == nil && !bytes.ContainsRune(decoded, utf8.RuneError) {
+		return "gb18030", true
+	}
+	return "", false
+}
+
+// DecodeText 把 charset 编码的文本转换为 UTF-8，去掉开头的 BOM，无法解码的字节替换为 U+FFFD
+func DecodeText(data []byte, charset string) (string, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return "", ErrCharsetInvalid
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(string(decoded), "\uFEFF"), nil
+}
@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var ErrCopyCanceled = errors.New("copy canceled")
+
+// CopyProgress 后台复制任务的进度
+// 复制时在后台更新，查询和取消时在其他协程读写，计数和状态使用原子操作
+// FinishTime 和 ProgressError 在 Finished 设置为 true 之前写入，之后才能读取
+type CopyProgress struct {
+	StartTime       time.Time
+	FinishTime      time.Time
+	FinishFileCount atomic.Uint64
+	TotalFileCount  atomic.Uint64
+	FinishSize      atomic.Uint64
+	TotalSize       atomic.Uint64
+	SkipSymlink     bool // 为 true 时跳过符号链接，否则按原来的目标重新创建链接
+	Canceled        atomic.Bool
+	ProgressError   error
+	Finished        atomic.Bool
+}
+
+func (cp *CopyProgress) UpdateFileInfo(dirCount uint64, fileCount uint64, fileSize int64) {
+	cp.TotalSize.Add(uint64(fileSize))
+	cp.TotalFileCount.Add(fileCount)
+}
+
+func (cp *CopyProgress) Write(data []byte) (int, error) {
+	if cp.Canceled.Load() {
+		return 0, ErrCopyCanceled
+	}
+	cp.FinishSize.Add(uint64(len(data)))
+	return len(data), nil
+}
+
+// Finish 复制结束后记录结束时间和错误
+func (cp *CopyProgress) Finish(err error) {
+	cp.ProgressError = err
+	cp.FinishTime = time.Now()
+	cp.Finished.Store(true)
+}
+
+// CopyPath 复制文件或目录，保留文件权限、修改时间和符号链接
+func CopyPath(src, dst string) error {
+	return copyPath(src, dst, nil)
+}
+
+// CopyPathWithProgress 复制文件或目录，复制过程中更新 progress，设置 progress.Canceled 为 true 后停止复制
+func CopyPathWithProgress(src, dst string, progress *CopyProgress) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		CalcDir(src, false, progress)
+	} else {
+		progress.UpdateFileInfo(0, 1, info.Size())
+	}
+	return copyPath(src, dst, progress)
+}
+
+func copyPath(src, dst string, progress *CopyProgress) error {
+	if progress != nil && progress.Canceled.Load() {
+		return ErrCopyCanceled
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		if progress != nil {
+			progress.FinishFileCount.Add(1)
+			progress.FinishSize.Add(uint64(info.Size()))
+			if progress.SkipSymlink {
+				return nil
+			}
+		}
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+	case info.IsDir():
+		err = os.Mkdir(dst, info.Mode().Perm()|0700)
+		if err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = copyPath(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), progress)
+			if err != nil {
+				return err
+			}
+		}
+		// 目录的修改时间在复制完其中的文件后再设置
+		os.Chmod(dst, info.Mode().Perm())
+	default:
+		err = copyRegularFile(src, dst, info, progress)
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress.FinishFileCount.Add(1)
+		}
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func copyRegularFile(src, dst string, info os.FileInfo, progress *CopyProgress) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	var writer io.Writer = dstFile
+	if progress != nil {
+		writer = io.MultiWriter(dstFile, progress)
+	}
+	_, err = io.Copy(writer, srcFile)
+	if err != nil {
+		dstFile.Close()
+		os.Remove(dst)
+		return err
+	}
+	return dstFile.Close()
+}
+
+// MovePath 移动文件或目录，源和目标不在同一个文件系统时，先复制再删除源文件
+func MovePath(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	err = CopyPath(src, dst)
+	if err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCopyTestFiles(t *testing.T, dir string, count int, size int) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("a"), size)
+	for i := 0; i < count; i++ {
+		if err := os.WriteFile(filepath.Join(dir, string(rune('a'+i))), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 复制时在其他协程中查询进度，用 go test -race 检查数据竞争
+func TestCopyPathWithProgress(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeCopyTestFiles(t, src, 8, 64*1024)
+	progress := &CopyProgress{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for !progress.Finished.Load() {
+			if progress.FinishSize.Load() > progress.TotalSize.Load() && progress.TotalSize.Load() != 0 {
+				t.Error("finish size is larger than total size")
+			}
+		}
+	}()
+	progress.Finish(CopyPathWithProgress(src, dst, progress))
+	<-done
+	if progress.ProgressError != nil {
+		t.Fatal(progress.ProgressError)
+	}
+	if got := progress.FinishFileCount.Load(); got != 8 || progress.TotalFileCount.Load() != 8 {
+		t.Errorf("file count = %d/%d, want 8/8", got, progress.TotalFileCount.Load())
+	}
+	if got := progress.FinishSize.Load(); got != 8*64*1024 || progress.TotalSize.Load() != got {
+		t.Errorf("size = %d/%d, want %d", got, progress.TotalSize.Load(), 8*64*1024)
+	}
+}
+
+func TestCopyPathWithProgressCanceled(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeCopyTestFiles(t, src, 4, 1024)
+	progress := &CopyProgress{}
+	progress.Canceled.Store(true)
+	if err := CopyPathWithProgress(src, dst, progress); err != ErrCopyCanceled {
+		t.Errorf("err = %v, want %v", err, ErrCopyCanceled)
+	}
+	if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+		t.Errorf("dst exists after canceled, err = %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// 读取 JPEG 文件 APP1 段中的 EXIF 信息，只解析需要用到的标签
+
+var ErrNoExif = errors.New("exif not found")
+
+const (
+	exifTagMake             = 0x010F
+	exifTagModel            = 0x0110
+	exifTagOrientation      = 0x0112
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagDateTimeOriginal = 0x9003
+	gpsTagLatitudeRef       = 0x0001
+	gpsTagLatitude          = 0x0002
+	gpsTagLongitudeRef      = 0x0003
+	gpsTagLongitude         = 0x0004
+)
+
+type ExifInfo struct {
+	Orientation int       // 1-8，没有记录时为1
+	TakenAt     time.Time // 拍摄时间，没有记录时为零值
+	Make        string    // 相机厂商
+	Model       string    // 相机型号
+	HasGPS      bool
+	Latitude    float64 // 纬度，南纬为负
+	Longitude   float64 // 经度，西经为负
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // 值所在的4个字节，超过4个字节时为偏移
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// ifd 读取偏移处的目录，返回标签和下一个目录的偏移
+func (t *tiffReader) ifd(offset uint32) (map[uint16]tiffEntry, uint32) {
+	entries := make(map[uint16]tiffEntry)
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return entries, 0
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	pos := int(offset) + 2
+	for i := 0; i < count && pos+12 <= len(t.data); i++ {
+		entries[t.order.Uint16(t.data[pos:])] = tiffEntry{
+			typ:   t.order.Uint16(t.data[pos+2:]),
+			count: t.order.Uint32(t.data[pos+4:]),
+			value: t.data[pos+8 : pos+12],
+		}
+		pos += 12
+	}
+	next := uint32(0)
+	if pos+4 <= len(t.data) {
+		next = t.order.Uint32(t.data[pos:])
+	}
+	return entries, next
+}
+
+// uint 读取 SHORT 或 LONG 类型的值
+func (t *tiffReader) uint(entry tiffEntry) (uint32, bool) {
+	switch entry.typ {
+	case 3:
+		return uint32(t.order.Uint16(entry.value)), true
+	case 4:
+		return t.order.Uint32(entry.value), true
+	}
+	return 0, false
+}
+
+// bytes 返回值的内容，超过4个字节时按偏移读取
+func (t *tiffReader) bytes(entry tiffEntry, size int) []byte {
+	n := uint64(entry.count) * uint64(size)
+	if n <= 4 {
+		return entry.value[:n]
+	}
+	offset := uint64(t.order.Uint32(entry.value))
+	if offset+n > uint64(len(t.data)) {
+		return nil
+	}
+	return t.data[offset : offset+n]
+}
+
+// ascii 读取 ASCII 类型的值，去掉结尾的空字符和空格
+func (t *tiffReader) ascii(entry tiffEntry) string {
+	if entry.typ != 2 {
+		return ""
+	}
+	return strings.TrimRight(string(t.bytes(entry, 1)), "\x00 ")
+}
+
+// degrees 读取 GPS 的度、分、秒，转换为度
+func (t *tiffReader) degrees(entry tiffEntry) (float64, bool) {
+	if entry.typ != 5 || entry.count != 3 {
+		return 0, false
+	}
+	b := t.bytes(entry, 8)
+	if b == nil {
+		return 0, false
+	}
+	value := 0.0
+	for i, unit := range []float64{1, 60, 3600} {
+		num := t.order.Uint32(b[i*8:])
+		den := t.order.Uint32(b[i*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		value += float64(num) / float64(den) / unit
+	}
+	return value, true
+}
+
+func parseTiff(data []byte) (ExifInfo, error) {
+	info := ExifInfo{Orientation: 1}
+	if len(data) < 8 {
+		return info, ErrNoExif
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return info, ErrNoExif
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return info, ErrNoExif
+	}
+	ifd0, _ := t.ifd(t.order.Uint32(data[4:]))
+	if entry, exist := ifd0[exifTagOrientation]; exist {
+		if v, ok := t.uint(entry); ok && v >= 1 && v <= 8 {
+			info.Orientation = int(v)
+		}
+	}
+	info.Make = t.ascii(ifd0[exifTagMake])
+	info.Model = t.ascii(ifd0[exifTagModel])
+	// 优先使用拍摄时间，没有时使用修改时间，EXIF 的时间没有时区，按本地时间处理
+	dateTime := t.ascii(ifd0[exifTagDateTime])
+	if entry, exist := ifd0[exifTagExifIFD]; exist {
+		if offset, ok := t.uint(entry); ok {
+			exifIFD, _ := t.ifd(offset)
+			if v := t.ascii(exifIFD[exifTagDateTimeOriginal]); v != "" {
+				dateTime = v
+			}
+		}
+	}
+	if taken, err := time.ParseInLocation("2006:01:02 15:04:05", dateTime, time.Local); err == nil {
+		info.TakenAt = taken
+	}
+	if entry, exist := ifd0[exifTagGPSIFD]; exist {
+		if offset, ok := t.uint(entry); ok {
+			gps, _ := t.ifd(offset)
+			lat, latOk := t.degrees(gps[gpsTagLatitude])
+			lon, lonOk := t.degrees(gps[gpsTagLongitude])
+			if latOk && lonOk {
+				if t.ascii(gps[gpsTagLatitudeRef]) == "S" {
+					lat = -lat
+				}
+				if t.ascii(gps[gpsTagLongitudeRef]) == "W" {
+					lon = -lon
+				}
+				info.HasGPS = true
+				info.Latitude, info.Longitude = lat, lon
+			}
+		}
+	}
+	return info, nil
+}
+
+// ReadExif 从 JPEG 文件的开头读取 EXIF 信息，不是 JPEG 或没有 EXIF 时返回 ErrNoExif
+func ReadExif(r io.Reader) (ExifInfo, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil || header[0] != 0xFF || header[1] != 0xD8 {
+		return ExifInfo{Orientation: 1}, ErrNoExif
+	}
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			break
+		}
+		if b != 0xFF {
+			continue
+		}
+		marker, err := br.ReadByte()
+		for err == nil && marker == 0xFF {
+			marker, err = br.ReadByte()
+		}
+		// 图像数据开始或文件结束，后面不会再有 EXIF
+		if err != nil || marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		if marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 {
+			continue
+		}
+		if _, err := io.ReadFull(br, header); err != nil {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(header)) - 2
+		if length < 0 {
+			break
+		}
+		if marker != 0xE1 {
+			if _, err := br.Discard(length); err != nil {
+				break
+			}
+			continue
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(br, data); err != nil {
+			break
+		}
+		if bytes.HasPrefix(data, []byte("Exif\x00\x00")) {
+			return parseTiff(data[6:])
+		}
+	}
+	return ExifInfo{Orientation: 1}, ErrNoExif
+}
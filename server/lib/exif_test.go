@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+type testTiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // 不超过4个字节时直接写在目录中，否则写到目录后面并记录偏移
+}
+
+// buildIFD 生成从 start 开始的目录，超过4个字节的值写到目录后面
+func buildIFD(start int, entries []testTiffEntry) []byte {
+	order := binary.BigEndian
+	dataStart := start + 2 + len(entries)*12 + 4
+	dir := order.AppendUint16(nil, uint16(len(entries)))
+	data := []byte{}
+	for _, e := range entries {
+		dir = order.AppendUint16(dir, e.tag)
+		dir = order.AppendUint16(dir, e.typ)
+		dir = order.AppendUint32(dir, e.count)
+		if len(e.value) <= 4 {
+			dir = append(dir, e.value...)
+			dir = append(dir, make([]byte, 4-len(e.value))...)
+			continue
+		}
+		dir = order.AppendUint32(dir, uint32(dataStart+len(data)))
+		data = append(data, e.value...)
+	}
+	dir = order.AppendUint32(dir, 0)
+	return append(dir, data...)
+}
+
+// buildTiff 生成大端序的 TIFF 数据，subIFDs 中的子目录写在 ifd0 后面，对应标签的值为子目录的偏移
+func buildTiff(ifd0 []testTiffEntry, subIFDs map[uint16][]testTiffEntry) []byte {
+	entries := make([]testTiffEntry, len(ifd0))
+	copy(entries, ifd0)
+	// 目录的长度和值无关，先按占位的值计算子目录的偏移
+	offset := 8 + len(buildIFD(8, entries))
+	subData := []byte{}
+	for i, e := range entries {
+		sub, exist := subIFDs[e.tag]
+		if !exist {
+			continue
+		}
+		entries[i].value = binary.BigEndian.AppendUint32(nil, uint32(offset+len(subData)))
+		subData = append(subData, buildIFD(offset+len(subData), sub)...)
+	}
+	data := []byte("MM\x00\x2A\x00\x00\x00\x08")
+	data = append(data, buildIFD(8, entries)...)
+	return append(data, subData...)
+}
+
+func shortValue(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func rationalValue(values ...uint32) []byte {
+	b := []byte{}
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func asciiValue(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func testExifTiff() []byte {
+	return buildTiff([]testTiffEntry{
+		{exifTagMake, 2, 6, asciiValue("Canon")},
+		{exifTagModel, 2, 4, asciiValue("EOS")},
+		{exifTagOrientation, 3, 1, shortValue(6)},
+		{exifTagDateTime, 2, 20, asciiValue("2020:01:02 03:04:05")},
+		{exifTagExifIFD, 4, 1, nil},
+		{exifTagGPSIFD, 4, 1, nil},
+	}, map[uint16][]testTiffEntry{
+		exifTagExifIFD: {
+			{exifTagDateTimeOriginal, 2, 20, asciiValue("2019:05:06 07:08:09")},
+		},
+		exifTagGPSIFD: {
+			{gpsTagLatitudeRef, 2, 2, asciiValue("S")},
+			{gpsTagLatitude, 5, 3, rationalValue(30, 1, 15, 1, 0, 1)},
+			{gpsTagLongitudeRef, 2, 2, asciiValue("W")},
+			{gpsTagLongitude, 5, 3, rationalValue(120, 1, 30, 1, 36, 1)},
+		},
+	})
+}
+
+// jpegWithSegments 生成只有 SOI 和给定段的 JPEG 数据
+func jpegWithSegments(segments ...[]byte) []byte {
+	data := []byte{0xFF, 0xD8}
+	for _, s := range segments {
+		data = append(data, s...)
+	}
+	return append(data, 0xFF, 0xD9)
+}
+
+func app1(payload []byte) []byte {
+	seg := []byte{0xFF, 0xE1}
+	seg = binary.BigEndian.AppendUint16(seg, uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+func TestParseTiff(t *testing.T) {
+	info, err := parseTiff(testExifTiff())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Make != "Canon" || info.Model != "EOS" {
+		t.Errorf("make, model = %q, %q", info.Make, info.Model)
+	}
+	if info.Orientation != 6 {
+		t.Errorf("orientation = %d, want 6", info.Orientation)
+	}
+	if want := time.Date(2019, 5, 6, 7, 8, 9, 0, time.Local); !info.TakenAt.Equal(want) {
+		t.Errorf("taken at = %v, want %v", info.TakenAt, want)
+	}
+	if !info.HasGPS || info.Latitude != -30.25 || info.Longitude != -120.51 {
+		t.Errorf("gps = %v, %v, %v", info.HasGPS, info.Latitude, info.Longitude)
+	}
+}
+
+func TestParseTiffMalformed(t *testing.T) {
+	valid := testExifTiff()
+	badOffset := bytes.Clone(valid)
+	binary.BigEndian.PutUint32(badOffset[4:], 0xFFFFFFF0)
+	hugeCount := bytes.Clone(valid)
+	binary.BigEndian.PutUint16(hugeCount[8:], 0xFFFF)
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		partial bool // 只要求不 panic，可以读到部分信息
+	}{
+		{"empty", nil, true, false},
+		{"short header", []byte("MM\x00"), true, false},
+		{"bad byte order", append([]byte("XX"), valid[2:]...), true, false},
+		{"bad magic", append([]byte("MM\x00\x2B"), valid[4:]...), true, false},
+		{"ifd offset out of range", badOffset, false, false},
+		{"huge entry count", hugeCount, false, true},
+		{"value offset out of range", buildTiff([]testTiffEntry{
+			{exifTagMake, 2, 0xFFFFFFFF, []byte{0xFF, 0xFF, 0xFF, 0xF0}},
+		}, nil), false, false},
+		{"zero denominator", buildTiff([]testTiffEntry{
+			{exifTagGPSIFD, 4, 1, nil},
+		}, map[uint16][]testTiffEntry{
+			exifTagGPSIFD: {
+				{gpsTagLatitude, 5, 3, rationalValue(30, 0, 15, 1, 0, 1)},
+				{gpsTagLongitude, 5, 3, rationalValue(120, 1, 30, 1, 36, 1)},
+			},
+		}), false, false},
+		{"wrong orientation", buildTiff([]testTiffEntry{
+			{exifTagOrientation, 3, 1, shortValue(9)},
+		}, nil), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parseTiff(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTiff err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.partial && (info.Orientation != 1 || info.HasGPS || info.Make != "") {
+				t.Errorf("parseTiff = %+v, want empty info", info)
+			}
+		})
+	}
+}
+
+// 截断到任意长度都不能 panic
+func TestParseTiffTruncated(t *testing.T) {
+	valid := testExifTiff()
+	for i := range valid {
+		parseTiff(valid[:i])
+	}
+}
+
+func TestReadExif(t *testing.T) {
+	tiff := testExifTiff()
+	exif := append([]byte("Exif\x00\x00"), tiff...)
+	other := []byte{0xFF, 0xE0, 0x00, 0x04, 'J', 'F'}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"app1 exif", jpegWithSegments(app1(exif)), false},
+		{"after other segment", jpegWithSegments(other, app1(exif)), false},
+		{"fill bytes before marker", jpegWithSegments([]byte{0xFF, 0xFF}, app1(exif)), false},
+		{"empty", nil, true},
+		{"not jpeg", []byte("GIF89a"), true},
+		{"no exif", jpegWithSegments(other), true},
+		{"app1 without exif header", jpegWithSegments(app1(tiff)), true},
+		{"exif after scan data", jpegWithSegments([]byte{0xFF, 0xDA, 0x00, 0x02}, app1(exif)), true},
+		{"segment length too small", jpegWithSegments([]byte{0xFF, 0xE1, 0x00, 0x01}, app1(exif)), true},
+		{"segment longer than data", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 'E', 'x', 'i', 'f'}, true},
+		{"truncated marker", []byte{0xFF, 0xD8, 0xFF}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ReadExif(bytes.NewReader(tt.data))
+			if tt.wantErr {
+				if !errors.Is(err, ErrNoExif) {
+					t.Fatalf("ReadExif err = %v, want ErrNoExif", err)
+				}
+				if info.Orientation != 1 {
+					t.Errorf("orientation = %d, want 1", info.Orientation)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Orientation != 6 || info.Make != "Canon" {
+				t.Errorf("ReadExif = %+v", info)
+			}
+		})
+	}
+}
+
+// 截断到任意长度都不能 panic
+func TestReadExifTruncated(t *testing.T) {
+	data := jpegWithSegments(app1(append([]byte("Exif\x00\x00"), testExifTiff()...)))
+	for i := range data {
+		ReadExif(bytes.NewReader(data[:i]))
+	}
+}
@@ -28,6 +28,23 @@ type ProgressReaderWriter struct {
 	ProgressError   error
 	Finished        bool
 	DownloadCount   int
+	AllowSymlink    func(path string) bool // 打包目录时是否包含符号链接指向的文件，为空时跳过所有符号链接
+}
+
+// resolveSymlink 打包目录时处理符号链接，返回链接指向的文件的信息，不包含时返回 nil
+// 不跟随指向目录的链接，避免出现循环
+func (pw *ProgressReaderWriter) resolveSymlink(path string, info os.FileInfo) os.FileInfo {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return info
+	}
+	if pw.AllowSymlink == nil || !pw.AllowSymlink(path) {
+		return nil
+	}
+	target, err := os.Stat(path)
+	if err != nil || !target.Mode().IsRegular() {
+		return nil
+	}
+	return target
 }
 
 func (pw *ProgressReaderWriter) UpdateFileInfo(dirCount uint64, fileCount uint64, fileSize int64) {
@@ -148,6 +165,10 @@ func CreateTarGzForDir(srcDir, destFilename string, processRW *ProgressReaderWri
 			log.Println("CreateTarGzForDir: Walk failed!", err)
 			return err
 		}
+		info = processRW.resolveSymlink(path, info)
+		if info == nil {
+			return nil
+		}
 
 		header, err := tar.FileInfoHeader(info, info.Name())
 		if err != nil {
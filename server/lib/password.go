@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword 使用 bcrypt 生成带盐的密码哈希
+func HashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// IsPasswordHashed 判断数据库中保存的密码是否已经是 bcrypt 哈希
+func IsPasswordHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// CheckPassword 校验密码是否正确
+// 返回值 needRehash 为 true 时表示保存的是旧的明文密码或强度不足的哈希，需要重新生成哈希
+func CheckPassword(stored string, password string) (match bool, needRehash bool) {
+	if !IsPasswordHashed(stored) {
+		// 兼容旧版本保存的明文密码
+		match = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return match, match
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err != nil || cost < bcrypt.DefaultCost
+}
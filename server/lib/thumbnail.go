@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+// 缩略图
+// 用纯 Go 的解码器读取 JPEG、PNG、GIF（第一帧）、BMP 和 WebP，按比例缩小后编码成 JPEG
+
+var ErrImageTooLarge = errors.New("image is too large")
+
+// orientImage 按 EXIF 的方向旋转或翻转图片，使图片按正确的方向显示
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x, y
+			switch orientation {
+			case 2:
+				dx = w - 1 - x
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dy = h - 1 - y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// CreateThumbnail 生成长边不超过 maxSize 的 JPEG 缩略图写入 w，小图不放大
+// maxPixels 为允许解码的最大像素数，避免过大的图片占用太多内存
+func CreateThumbnail(srcPath string, w io.Writer, maxSize int, maxPixels int64, quality int) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	config, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > maxPixels {
+		return ErrImageTooLarge
+	}
+	orientation := 1
+	if format == "jpeg" {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if exif, err := ReadExif(f); err == nil {
+			orientation = exif.Orientation
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	dw, dh := bounds.Dx(), bounds.Dy()
+	if dw > maxSize || dh > maxSize {
+		if dw >= dh {
+			dw, dh = maxSize, max(1, dh*maxSize/dw)
+		} else {
+			dw, dh = max(1, dw*maxSize/dh), maxSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	// JPEG 不支持透明，透明的部分用白色填充
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return jpeg.Encode(w, orientImage(dst, orientation), &jpeg.Options{Quality: quality})
+}
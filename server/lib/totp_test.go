@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录 B 的测试密钥 "12345678901234567890" 的 base32 编码
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 附录 B 中 SHA1 的测试向量，验证码取 8 位结果的后 6 位
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestHotpRFC6238(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range rfc6238Vectors {
+		if code := hotp(key, uint64(v.unix/TotpPeriod)); code != v.code {
+			t.Errorf("hotp at %d = %s, want %s", v.unix, code, v.code)
+		}
+	}
+}
+
+func TestValidateTotp(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		now := time.Unix(v.unix, 0)
+		counter, ok := ValidateTotp(rfc6238Secret, v.code, 0, now)
+		if !ok || counter != v.unix/TotpPeriod {
+			t.Errorf("ValidateTotp at %d = %d, %v, want %d, true", v.unix, counter, ok, v.unix/TotpPeriod)
+		}
+	}
+}
+
+func TestValidateTotpSkew(t *testing.T) {
+	// 1111111111 所在的时间步为 37037037，验证码 050471
+	const unix, code, counter = 1111111111, "050471", 37037037
+	tests := []struct {
+		name  string
+		steps int64 // 服务器时间相对生成验证码时偏移的时间步
+		ok    bool
+	}{
+		{"same step", 0, true},
+		{"one step later", 1, true},
+		{"one step earlier", -1, true},
+		{"two steps later", 2, false},
+		{"two steps earlier", -2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(unix+tt.steps*TotpPeriod, 0)
+			got, ok := ValidateTotp(rfc6238Secret, code, 0, now)
+			if ok != tt.ok {
+				t.Fatalf("ValidateTotp ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && got != counter {
+				t.Errorf("ValidateTotp counter = %d, want %d", got, counter)
+			}
+		})
+	}
+}
+
+func TestValidateTotpReplay(t *testing.T) {
+	const unix, code, counter = 1111111111, "050471", 37037037
+	now := time.Unix(unix, 0)
+	tests := []struct {
+		name        string
+		lastCounter int64
+		ok          bool
+	}{
+		{"never used", 0, true},
+		{"used earlier step", counter - 1, true},
+		{"used same step", counter, false},
+		{"used later step", counter + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := ValidateTotp(rfc6238Secret, code, tt.lastCounter, now); ok != tt.ok {
+				t.Errorf("ValidateTotp ok = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidateTotpInput(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		ok     bool
+	}{
+		{"lower case secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "050471", true},
+		{"surrounding spaces", rfc6238Secret, " 050471 ", true},
+		{"wrong code", rfc6238Secret, "050472", false},
+		{"too short", rfc6238Secret, "05047", false},
+		{"too long", rfc6238Secret, "0504710", false},
+		{"empty", rfc6238Secret, "", false},
+		{"bad secret", "not base32!", "050471", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := ValidateTotp(tt.secret, tt.code, 0, now); ok != tt.ok {
+				t.Errorf("ValidateTotp ok = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
@@ -36,10 +36,13 @@ type ConfigBind struct {
 }
 
 type ServerConfig struct {
-	RootDir      string `json:"root_dir"`
-	TempDir      string `json:"temp_dir"`
-	DisableWebUI bool   `json:"disable_webui"`
-	DatabaseFile string `json:"database_file"`
+	RootDir       string `json:"root_dir"`
+	TempDir       string `json:"temp_dir"`
+	DisableWebUI  bool   `json:"disable_webui"`
+	DatabaseFile  string `json:"database_file"`
+	SymlinkPolicy string `json:"symlink_policy"` // 符号链接的策略：deny、within_root、allow，默认为 within_root
+	// 反向代理的 IP 或网段，只有来自这些地址的请求才使用 X-Forwarded-For 中的客户端 IP，默认不信任任何代理
+	TrustedProxies []string `json:"trusted_proxies"`
 }
 
 type VersionConfig struct {
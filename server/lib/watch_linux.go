@@ -0,0 +1,150 @@
+//go:build linux
+// +build linux
+
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Watcher 用 inotify 监视目录的变化，Events 中是内容发生变化的目录
+// 内核的事件队列溢出时发送空字符串，需要重新扫描所有目录
+type Watcher struct {
+	Events chan string
+	file   *os.File
+	fd     int
+	lock   sync.Mutex
+	wds    map[int]string
+	paths  map[string]int
+	done   chan struct{}
+}
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF |
+	syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+func NewWatcher() (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		Events: make(chan string, 4096),
+		// 非阻塞的描述符交给 runtime 的轮询器，Close 时可以结束读取
+		file:  os.NewFile(uintptr(fd), "inotify"),
+		fd:    fd,
+		wds:   make(map[int]string),
+		paths: make(map[string]int),
+		done:  make(chan struct{}),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Add 监视目录，超过系统的监视数量限制时返回 ENOSPC
+func (w *Watcher) Add(dir string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return err
+	}
+	if old, exist := w.paths[dir]; exist && old != wd {
+		delete(w.wds, old)
+	}
+	if oldPath, exist := w.wds[wd]; exist && oldPath != dir {
+		delete(w.paths, oldPath)
+	}
+	w.wds[wd] = dir
+	w.paths[dir] = wd
+	return nil
+}
+
+// RemoveAll 取消监视目录和它下面的所有目录，目录被删除或移走时调用
+func (w *Watcher) RemoveAll(dir string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	prefix := dir + string(filepath.Separator)
+	for path, wd := range w.paths {
+		if path == dir || strings.HasPrefix(path, prefix) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.paths, path)
+			delete(w.wds, wd)
+		}
+	}
+}
+
+// Count 正在监视的目录数
+func (w *Watcher) Count() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.paths)
+}
+
+func (w *Watcher) Close() error {
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+	close(w.done)
+	return w.file.Close()
+}
+
+func (w *Watcher) send(path string) bool {
+	select {
+	case w.Events <- path:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *Watcher) readEvents() {
+	defer close(w.Events)
+	buf := make([]byte, syscall.SizeofInotifyEvent*4096)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				Logger.Error("Watcher: read inotify events failed!", err)
+			}
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				if !w.send("") {
+					return
+				}
+				continue
+			}
+			w.lock.Lock()
+			path, exist := w.wds[int(event.Wd)]
+			if event.Mask&syscall.IN_IGNORED != 0 && exist {
+				delete(w.wds, int(event.Wd))
+				if w.paths[path] == int(event.Wd) {
+					delete(w.paths, path)
+				}
+			}
+			w.lock.Unlock()
+			if !exist || event.Mask&syscall.IN_IGNORED != 0 {
+				continue
+			}
+			// 目录自身被删除时，由上级目录扫描
+			if event.Mask&syscall.IN_DELETE_SELF != 0 {
+				path = filepath.Dir(path)
+			}
+			if !w.send(path) {
+				return
+			}
+		}
+	}
+}
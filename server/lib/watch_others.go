@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+import (
+	"errors"
+)
+
+// Watcher 目前只支持 Linux，其他系统只依靠定时扫描更新文件索引
+type Watcher struct {
+	Events chan string
+}
+
+func NewWatcher() (*Watcher, error) {
+	return nil, errors.New("watcher is not supported on this system")
+}
+
+func (w *Watcher) Add(dir string) error {
+	return errors.New("watcher is not supported on this system")
+}
+
+func (w *Watcher) RemoveAll(dir string) {
+}
+
+func (w *Watcher) Count() int {
+	return 0
+}
+
+func (w *Watcher) Close() error {
+	return nil
+}
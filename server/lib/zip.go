@@ -82,6 +82,10 @@ func CreateZipForDir(srcDir, destFilename string, processRW *ProgressReaderWrite
 			log.Println("CreateZipForDir: Walk failed!", err)
 			return err
 		}
+		info = processRW.resolveSymlink(path, info)
+		if info == nil {
+			return nil
+		}
 
 		parentPath := filepath.Dir(srcDir)
 		if !strings.HasSuffix(parentPath, string(os.PathSeparator)) {
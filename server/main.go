@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -22,7 +23,7 @@ import (
 //go:embed front/*
 var efs embed.FS
 
-func autoCleanTemp() {
+func autoCleanTemp(ws *webserver.WebServer) {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 	for range ticker.C {
@@ -81,6 +82,54 @@ func autoCleanTemp() {
 			delete(webserver.GetInstance().UploadTask, keys[k])
 		}
 		webserver.GetInstance().Lock.Unlock()
+
+		// 清理过期的登录失败记录
+		webserver.CleanLoginAttempts()
+		// 清理已经结束的复制任务和批量操作
+		webserver.CleanCopyTasks()
+		webserver.CleanBatchTasks()
+		webserver.CleanPhotoScans()
+		// 清理缩略图缓存
+		ws.AutoCleanThumbnails()
+		// 清理回收站中超过保留天数的文件和文件的历史版本
+		if webserver.GetInstance().Database != nil {
+			ws.AutoPurgeTrash()
+			ws.AutoPurgeVersions()
+		}
+	}
+}
+
+func autoCleanSession() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		database := webserver.GetInstance().Database
+		if database == nil {
+			continue
+		}
+		now := time.Now()
+		count, err := database.DeleteExpiredSessions(
+			now.Add(-webserver.SessionIdleTimeout),
+			now.Add(-webserver.SessionMaxLifetime))
+		if err != nil {
+			lib.Logger.Error("autoCleanSession: delete expired sessions failed!", err)
+			continue
+		}
+		if count > 0 {
+			lib.Logger.Info("autoCleanSession: remove expired sessions ", count)
+		}
+	}
+}
+
+// autoReconcileUsedSize 定时按实际大小校正用户已使用的空间，写入和删除时记录的大小可能有偏差
+func autoReconcileUsedSize(ws *webserver.WebServer) {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for {
+		if webserver.GetInstance().Database != nil {
+			ws.ReconcileUsedSize()
+		}
+		<-ticker.C
 	}
 }
 
@@ -160,12 +209,18 @@ func main() {
 
 	// 启动服务
 	r := gin.Default()
+	// 客户端 IP 用于登录限制和历史记录，不信任任意客户端发送的 X-Forwarded-For
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		lib.Logger.Error("invalid trusted_proxies: ", err)
+		return
+	}
 	r.Use(ginzap.Ginzap(lib.Logger.Desugar(), "2006-01-02 15:04:05.000", false))
 	r.Use(ginzap.RecoveryWithZap(lib.Logger.Desugar(), true))
 	r.Use(Cors())
 	ws := webserver.WebServer{}
 	ws.RootDir = cfg.Server.RootDir
 	ws.TempDir = cfg.Server.TempDir
+	ws.SymlinkPolicy = cfg.Server.SymlinkPolicy
 	if cfg.Version.AppTime != "" {
 		lib.AppTime = cfg.Version.AppTime
 	}
@@ -180,9 +235,13 @@ func main() {
 	}
 
 	webserver.GetInstance().Lock = sync.Mutex{}
-	webserver.GetInstance().Tokens = make(map[string]webserver.UserInfo)
 	webserver.GetInstance().PackageDownloads = make(map[string]*lib.ProgressReaderWriter)
 	webserver.GetInstance().UploadTask = make(map[string]*webserver.UploadFileEntry)
+	webserver.GetInstance().LoginAttempts = make(map[string]*webserver.LoginAttempt)
+	webserver.GetInstance().CopyTasks = make(map[string]*webserver.CopyTaskEntry)
+	webserver.GetInstance().BatchTasks = make(map[string]*webserver.BatchTaskEntry)
+	webserver.GetInstance().PhotoScans = make(map[int64]*webserver.PhotoScanEntry)
+	ws.Notifier = webserver.NewEventHub()
 	if cfg.Server.RootDir == "" {
 		lib.Logger.Info("RootDir is empty, enter install mode!")
 		ws.InstallMode = true
@@ -202,13 +261,27 @@ func main() {
 			return
 		}
 		webserver.GetInstance().Database = &ws.Database
+		// 在后台建立文件索引
+		ws.StartIndexer()
+		// 定时扫描用户的照片目录
+		go ws.AutoScanPhotos()
+	}
+	// 清理临时文件夹，保留回收站、文件的历史版本和缩略图缓存
+	entries, _ := os.ReadDir(ws.TempDir)
+	for _, entry := range entries {
+		if entry.Name() != webserver.TrashDirName && entry.Name() != webserver.VersionDirName &&
+			entry.Name() != webserver.ThumbnailDirName {
+			os.RemoveAll(filepath.Join(ws.TempDir, entry.Name()))
+		}
 	}
-	// 清理临时文件夹
-	os.RemoveAll(ws.TempDir)
 	os.MkdirAll(ws.TempDir, 0777)
 
 	// 定时清理临时文件夹
-	go autoCleanTemp()
+	go autoCleanTemp(&ws)
+	// 定时清理过期的登录会话
+	go autoCleanSession()
+	// 定时校正用户已使用的空间
+	go autoReconcileUsedSize(&ws)
 	go ws.MontiorCpuInformation()
 	go ws.MontiorNetInformation()
 	go ws.MontiorDiskInformation()
@@ -245,25 +318,89 @@ func main() {
 	r.GET("/api/user/setting", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetUserSetting())
 	r.POST("/api/user/setting", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqSetUserSetting())
 
+	r.GET("/api/user", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetUser())
 	r.PUT("/api/user", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqUpdateUser())
 
+	r.GET("/api/user/totp", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetTotp())
+	r.POST("/api/user/totp", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqCreateTotp())
+	r.PUT("/api/user/totp", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqEnableTotp())
+	r.DELETE("/api/user/totp", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteTotp())
+
 	r.POST("/api/user", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqCreateUser())
 	r.DELETE("/api/user", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqDeleteUser())
 	r.GET("/api/users", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqGetUserList())
+	r.GET("/api/groups", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqGetGroupList())
+	r.POST("/api/group", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqCreateGroup())
+	r.PUT("/api/group", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqUpdateGroup())
+	r.DELETE("/api/group", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqDeleteGroup())
+	r.POST("/api/group/member", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqAddGroupMember())
+	r.DELETE("/api/group/member", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqDeleteGroupMember())
 	r.GET("/api/user/history", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqGetUserHistory())
+	r.GET("/api/user/lockouts", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqGetLockouts())
+	r.DELETE("/api/user/lockouts", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqDeleteLockouts())
+	r.GET("/api/user/sessions", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqGetSessionList())
+	r.DELETE("/api/user/session", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqDeleteSession())
+	r.DELETE("/api/user/sessions", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqDeleteSessions())
+
+	r.GET("/api/tokens", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetApiTokenList())
+	r.POST("/api/token", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqCreateApiToken())
+	r.DELETE("/api/token", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteApiToken())
+
+	r.GET("/api/sessions", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetSessionList())
+	r.DELETE("/api/session", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteSession())
+	r.DELETE("/api/sessions", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteSessions())
 
 	r.GET("/api/file", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetFile())
 	r.DELETE("/api/file", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteFile())
 	r.POST("/api/file", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqUploadFile())
 	r.GET("/api/file/content", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetFileContent())
+	r.GET("/api/file/thumbnail", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetThumbnail())
 	r.GET("/api/file/data", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqReadFileData())
 	r.PUT("/api/file/data", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqWriteFileData())
 	r.POST("/api/file/upload", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqCreateFileChunk())
 	r.PUT("/api/file/upload", webserver.MiddlewareInstall(&ws), ws.ReqUploadFileChunk())
+	r.GET("/api/file/copy", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqQueryCopyTask())     // 查询复制进度
+	r.DELETE("/api/file/copy", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteCopyTask()) // 取消复制
+	r.GET("/api/file/versions", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetFileVersions())
+	r.GET("/api/file/version", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDownloadFileVersion())
+	r.PUT("/api/file/version", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqRestoreFileVersion())
+	r.GET("/api/trashes", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetTrashList())
+	r.PUT("/api/trash", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqRestoreTrash())
+	r.DELETE("/api/trash", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteTrash())
+	r.DELETE("/api/trashes", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteTrashes())
 	r.PUT("/api/file", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqChangeFile())
 
+	r.POST("/api/file/batch", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqCreateBatchTask())   // 开始批量操作
+	r.GET("/api/file/batch", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqQueryBatchTask())     // 查询批量操作的结果
+	r.DELETE("/api/file/batch", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteBatchTask()) // 取消批量操作
+
+	r.GET("/api/mounts", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetMounts())
+	r.GET("/api/acls", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetAclList())
+	r.POST("/api/acl", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqCreateAcl())
+	r.DELETE("/api/acl", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteAcl())
+
 	r.GET("/api/attribute", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetAttribute())
 
+	r.GET("/api/search", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqSearchFiles())
+	r.GET("/api/files/recent", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetRecentFiles())
+	r.GET("/api/files/largest", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetLargestFiles())
+	r.GET("/api/index", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqGetIndexStatus())
+	r.PUT("/api/index", webserver.MiddlewareInstall(&ws), webserver.AuthAdminMiddleware(), ws.ReqRescanIndex())
+
+	r.GET("/api/photo/folders", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetPhotoFolders())
+	r.PUT("/api/photo/folders", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqSetPhotoFolders())
+	r.POST("/api/photo/scan", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqScanPhotos())    // 开始扫描照片目录
+	r.GET("/api/photo/scan", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqQueryPhotoScan()) // 查询扫描进度
+	r.GET("/api/photo/timeline", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetPhotoTimeline())
+	r.GET("/api/photos", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetPhotos())
+	r.GET("/api/albums", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetAlbumList())
+	r.POST("/api/album", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqCreateAlbum())
+	r.PUT("/api/album", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqUpdateAlbum())
+	r.DELETE("/api/album", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteAlbum())
+	r.GET("/api/album/photos", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqGetAlbumPhotos())
+	r.POST("/api/album/photos", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqAddAlbumPhotos())
+	r.DELETE("/api/album/photos", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteAlbumPhotos())
+
 	r.POST("/api/folder", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqCreateFolder())
 
 	r.POST("/api/pkg", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqCreatePackage())   // 开始压缩
@@ -293,6 +430,7 @@ func main() {
 	r.DELETE("/api/favorites", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqDeleteFavorites())
 
 	r.GET("/api/xterm", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqCreateXtermWebSocket())
+	r.GET("/api/events", webserver.MiddlewareInstall(&ws), webserver.AuthMiddleware(), ws.ReqSubscribeEvents())
 
 	if !cfg.Server.DisableWebUI {
 		r.NoRoute(gin.WrapH(http.FileServer(http.FS(efs))))
@@ -318,6 +456,8 @@ func Cors() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, UPDATE")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "*")
+		// 允许跨域的页面读取断点续传和缓存校验用到的响应头
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Accept-Ranges, Content-Range, Content-Disposition")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(200)
@@ -0,0 +1,392 @@
+package webserver
+
+import (
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 目录的访问权限
+// 用户对自己的根目录拥有所有权限，其他目录需要通过 Acl 授权，授权的目录挂载到用户的根目录下显示
+// 挂载的名称和根目录下的文件重名时，优先访问挂载的目录
+
+type AclRequest struct {
+	Path       string `json:"path"`        // 授权的目录，为登录用户看到的路径
+	TargetType string `json:"target_type"` // 授权对象的类型
+	TargetId   int64  `json:"target_id"`   // 授权对象的ID
+	Access     string `json:"access"`      // 访问权限
+	MountName  string `json:"mount_name"`  // 挂载的名称，为空时使用目录名
+}
+
+type MountInfo struct {
+	Name   string `json:"name"`   // 挂载的名称
+	Access string `json:"access"` // 访问权限
+	Exist  bool   `json:"exist"`  // 目录是否存在
+}
+
+// isSubPath 判断 target 是否是 base 或者 base 下的路径
+func isSubPath(base string, target string) bool {
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// getUserAcls 获取授权给用户的访问权限
+func (ws *WebServer) getUserAcls(userEntry db.UserEntry) []db.AclEntry {
+	acls, err := ws.Database.GetUserAcls(userEntry.Id)
+	if err != nil {
+		return []db.AclEntry{}
+	}
+	return acls
+}
+
+// getUserMounts 获取挂载到用户根目录下的目录，名称相同时使用先创建的授权
+func (ws *WebServer) getUserMounts(userEntry db.UserEntry) []db.AclEntry {
+	mounts := []db.AclEntry{}
+	names := make(map[string]bool)
+	for _, acl := range ws.getUserAcls(userEntry) {
+		if names[acl.MountName] {
+			continue
+		}
+		names[acl.MountName] = true
+		mounts = append(mounts, acl)
+	}
+	return mounts
+}
+
+// getPathAccess 获取用户对服务器上的路径的访问权限，多个授权同时生效时取最高的权限
+func (ws *WebServer) getPathAccess(userEntry db.UserEntry, realPath string) int {
+	if userEntry.IsAdmin || isSubPath(filepath.Join(ws.RootDir, userEntry.RootDir), realPath) {
+		return db.AclAccessLevel(db.AclAccessManage)
+	}
+	level := 0
+	for _, acl := range ws.getUserAcls(userEntry) {
+		if !isSubPath(filepath.Join(ws.RootDir, acl.Path), realPath) {
+			continue
+		}
+		if db.AclAccessLevel(acl.Access) > level {
+			level = db.AclAccessLevel(acl.Access)
+		}
+	}
+	return level
+}
+
+// splitMountPath 拆分用户看到的路径，返回第一级的名称和剩余的路径
+func splitMountPath(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+	name, rest, _ := strings.Cut(path, "/")
+	return name, rest
+}
+
+// resolveUserPath 返回用户看到的路径所在的根目录（用户的根目录或挂载的目录）和相对于该目录的路径
+// path 为 getPath 整理后的路径，符号链接由 resolveSafePath 处理
+func (ws *WebServer) resolveUserPath(userEntry db.UserEntry, path string) (string, string) {
+	name, rest := splitMountPath(path)
+	if name != "" {
+		for _, mount := range ws.getUserMounts(userEntry) {
+			if mount.MountName == name {
+				return filepath.Join(ws.RootDir, mount.Path), rest
+			}
+		}
+	}
+	return filepath.Join(ws.RootDir, userEntry.RootDir), path
+}
+
+// isMountPoint 判断路径是否是挂载点，挂载点本身不允许删除、重命名和移动
+func (ws *WebServer) isMountPoint(userEntry db.UserEntry, path string) bool {
+	name, rest := splitMountPath(path)
+	if name == "" || rest != "" {
+		return false
+	}
+	for _, mount := range ws.getUserMounts(userEntry) {
+		if mount.MountName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// appendMountEntries 在根目录的文件列表中加入挂载的目录
+func (ws *WebServer) appendMountEntries(userEntry db.UserEntry, files lib.FileEntrySlice) lib.FileEntrySlice {
+	mounts := ws.getUserMounts(userEntry)
+	if len(mounts) == 0 {
+		return files
+	}
+	names := make(map[string]bool)
+	entries := lib.FileEntrySlice{}
+	for _, mount := range mounts {
+		info, err := os.Stat(filepath.Join(ws.RootDir, mount.Path))
+		if err != nil {
+			continue
+		}
+		names[mount.MountName] = true
+		entries = append(entries, lib.FileEntry{
+			Host:       runtime.GOOS,
+			Name:       mount.MountName,
+			Size:       info.Size(),
+			FileMode:   uint32(info.Mode()),
+			IsDir:      info.IsDir(),
+			CreatedAt:  lib.GetFileCreateTime(info).Format(time.DateTime),
+			ModifiedAt: info.ModTime().Format(time.DateTime),
+		})
+	}
+	for _, file := range files {
+		if !names[file.Name] {
+			entries = append(entries, file)
+		}
+	}
+	return entries
+}
+
+// toServerPath 把服务器上的路径转换为相对于服务根目录的路径，保存到数据库中
+func (ws *WebServer) toServerPath(realPath string) string {
+	rel, err := filepath.Rel(ws.RootDir, realPath)
+	if err != nil || rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+func (ws *WebServer) ReqGetMounts() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		mounts := []MountInfo{}
+		for _, mount := range ws.getUserMounts(loginUserInfo.UserEntry) {
+			realPath := filepath.Join(ws.RootDir, mount.Path)
+			level := ws.getPathAccess(loginUserInfo.UserEntry, realPath)
+			access := db.AclAccessRead
+			for _, v := range []string{db.AclAccessWrite, db.AclAccessManage} {
+				if level >= db.AclAccessLevel(v) {
+					access = v
+				}
+			}
+			mounts = append(mounts, MountInfo{
+				Name:   mount.MountName,
+				Access: access,
+				Exist:  lib.IsExist(realPath),
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    mounts,
+		})
+	}
+}
+
+// ReqGetAclList 获取目录的授权列表，需要拥有该目录的管理权限，管理员不指定 path 时返回所有的授权
+func (ws *WebServer) ReqGetAclList() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		var acls []db.AclEntry
+		var err error
+		if c.Query("path") == "" && loginUserInfo.UserEntry.IsAdmin {
+			acls, err = ws.Database.GetAcls()
+		} else {
+			path, succeed := getPath(c)
+			if !succeed {
+				return
+			}
+			realPath, succeed := ws.resolvePath(c, path, db.AclAccessManage)
+			if !succeed {
+				return
+			}
+			acls, err = ws.Database.GetAclsByPath(ws.toServerPath(realPath))
+		}
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    acls,
+		})
+	}
+}
+
+// ReqCreateAcl 授权其他用户访问目录，需要拥有该目录的管理权限
+func (ws *WebServer) ReqCreateAcl() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 授权其他用户访问目录和分享一样受权限限制
+		if !checkUserPermission(c, actionShare) {
+			return
+		}
+		req := AclRequest{}
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		path, succeed := cleanPath(req.Path)
+		if !succeed {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 1000, "message": "Invalid path"})
+			return
+		}
+		realPath, succeed := ws.resolvePath(c, path, db.AclAccessManage)
+		if !succeed {
+			return
+		}
+		// 符号链接指向服务根目录以外的目录时不能授权
+		if !isSubPath(ws.RootDir, realPath) {
+			c.JSON(http.StatusOK, gin.H{"code": 1009, "message": "permission denied"})
+			return
+		}
+		info, err := os.Stat(realPath)
+		if err != nil || !info.IsDir() {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "path is not a directory",
+			})
+			return
+		}
+		if db.AclAccessLevel(req.Access) == 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "access is invalid",
+			})
+			return
+		}
+		// 授予写入和管理权限时，自己也要有修改文件的权限
+		if req.Access != db.AclAccessRead && !checkUserPermission(c, actionModify) {
+			return
+		}
+		switch req.TargetType {
+		case db.AclTargetUser:
+			_, err = ws.Database.GetUserById(req.TargetId)
+		case db.AclTargetGroup:
+			_, err = ws.Database.GetGroup(req.TargetId)
+		default:
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "target_type is invalid",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "target not found",
+			})
+			return
+		}
+		if req.MountName == "" {
+			req.MountName = filepath.Base(realPath)
+		}
+		if strings.ContainsAny(req.MountName, `/\`) || req.MountName == "." || req.MountName == ".." {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "mount_name is invalid",
+			})
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		acl := db.AclEntry{
+			Path:       ws.toServerPath(realPath),
+			TargetType: req.TargetType,
+			TargetId:   req.TargetId,
+			Access:     req.Access,
+			MountName:  req.MountName,
+			CreatedBy:  loginUserInfo.UserEntry.Id,
+		}
+		acl.Id, err = ws.Database.AddAcl(acl)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "create_acl",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"acl_id":      strconv.FormatInt(acl.Id, 10),
+				"path":        acl.Path,
+				"target_type": acl.TargetType,
+				"target_id":   strconv.FormatInt(acl.TargetId, 10),
+				"access":      acl.Access,
+				"mount_name":  acl.MountName,
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "create acl succeed",
+			"data":    acl,
+		})
+	}
+}
+
+// ReqDeleteAcl 取消授权，参数 id 为授权ID，需要拥有该目录的管理权限
+func (ws *WebServer) ReqDeleteAcl() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Query("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		acl, err := ws.Database.GetAcl(id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "acl not found",
+			})
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		if ws.getPathAccess(loginUserInfo.UserEntry, filepath.Join(ws.RootDir, acl.Path)) < db.AclAccessLevel(db.AclAccessManage) {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1009,
+				"message": "permission denied",
+			})
+			return
+		}
+		err = ws.Database.DeleteAcl(id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "delete_acl",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"acl_id":      strconv.FormatInt(acl.Id, 10),
+				"path":        acl.Path,
+				"target_type": acl.TargetType,
+				"target_id":   strconv.FormatInt(acl.TargetId, 10),
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "delete acl succeed",
+		})
+	}
+}
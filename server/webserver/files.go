@@ -2,7 +2,9 @@ package webserver
 
 import (
 	"encoding/base64"
+	"fmt"
 	"io"
+	"myfileserver/db"
 	"myfileserver/lib"
 	"net/http"
 	"os"
@@ -16,32 +18,37 @@ import (
 )
 
 func getLoginUser(c *gin.Context) UserInfo {
-
-	userSessionId := c.GetHeader("session-id")
-	if userSessionId == "" {
-		userSessionId, _ = c.Cookie("session-id")
-	}
-	if userSessionId == "" {
-		userSessionId = c.Query("session-id")
+	// 登录用户的信息由 AuthMiddleware 校验后保存
+	value, exist := c.Get(loginUserKey)
+	if !exist {
+		return UserInfo{}
 	}
-
-	GetInstance().Lock.Lock()
-	userInfo := GetInstance().Tokens[userSessionId]
-	GetInstance().Lock.Unlock()
-	return userInfo
+	return value.(UserInfo)
 }
 
 func getPath(c *gin.Context) (string, bool) {
-	path := c.Query("path")
-	if strings.Contains(path, "..") {
+	path, succeed := cleanPath(c.Query("path"))
+	if !succeed {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 1000, "message": "Invalid path"})
 		return "", false
 	}
+	return path, true
+}
+
+// cleanPath 整理用户传入的路径，返回以 / 开头的路径，根目录返回空字符串
+// 路径中不允许出现 .. 和空字符，符号链接由 resolvePath 处理
+func cleanPath(path string) (string, bool) {
+	if strings.ContainsRune(path, 0) {
+		return "", false
+	}
 	ret := ""
-	for _, v := range strings.Split(path, "/") {
-		if v == "" {
+	for _, v := range strings.Split(filepath.ToSlash(path), "/") {
+		if v == "" || v == "." {
 			continue
 		}
+		if v == ".." {
+			return "", false
+		}
 		ret += "/" + v
 	}
 	if ret == "/" {
@@ -56,15 +63,10 @@ func (ws *WebServer) ReqDeleteFile() gin.HandlerFunc {
 		if !succeed {
 			return
 		}
+		// 删除的文件移到回收站，可以还原
 		loginUserInfo := getLoginUser(c)
-		filePath := filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path)
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"code": 10006, "message": "File or directory not found"})
-			return
-		}
-		err := os.RemoveAll(filePath)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"code": 10006, "message": "delete failed!"})
+		if err := ws.deleteEntry(loginUserInfo.UserEntry, path); err != nil {
+			writeFileOpError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{
@@ -74,22 +76,51 @@ func (ws *WebServer) ReqDeleteFile() gin.HandlerFunc {
 	}
 }
 
-func CopyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
+// 目标位置已存在文件时的处理方式
+const (
+	conflictFail      = "fail"      // 返回错误
+	conflictOverwrite = "overwrite" // 把已存在的文件移到回收站后继续
+	conflictRename    = "rename"    // 改为 name (1).ext
+	conflictSkip      = "skip"      // 不做任何操作
+)
+
+// getConflict 获取参数 conflict 指定的处理方式，没有指定时使用 defaultConflict
+func getConflict(c *gin.Context, defaultConflict string) (string, bool) {
+	conflict := c.DefaultQuery("conflict", defaultConflict)
+	switch conflict {
+	case conflictFail, conflictOverwrite, conflictRename, conflictSkip:
+		return conflict, true
 	}
-	defer srcFile.Close()
-	dstFile, err := os.Create(dst)
+	c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "conflict is invalid"})
+	return "", false
+}
+
+// resolveConflict 目标位置已存在文件时按 conflict 处理，path 为用户看到的路径，realPath 为服务器上的路径
+// 返回处理后的路径，返回 false 时已经写入了响应，不需要继续操作
+func (ws *WebServer) resolveConflict(c *gin.Context, conflict string, path string, realPath string) (string, string, bool) {
+	loginUserInfo := getLoginUser(c)
+	path, realPath, err := ws.applyConflict(loginUserInfo.UserEntry, conflict, path, realPath)
 	if err != nil {
-		return err
+		writeFileOpError(c, err)
+		return path, realPath, false
 	}
-	defer dstFile.Close()
-	_, err = io.Copy(dstFile, srcFile)
-	if err != nil {
-		return err
+	return path, realPath, true
+}
+
+// getAvailablePath 路径已存在时，在文件名后加上序号，如 name (1).ext
+func getAvailablePath(path string) string {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path
+	}
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		newPath := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		if _, err := os.Lstat(newPath); os.IsNotExist(err) {
+			return newPath
+		}
 	}
-	return nil
 }
 
 func (ws *WebServer) ReqChangeFile() gin.HandlerFunc {
@@ -98,68 +129,50 @@ func (ws *WebServer) ReqChangeFile() gin.HandlerFunc {
 		if !succeed {
 			return
 		}
-		loginUserInfo := getLoginUser(c)
-		filePath := filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path)
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "File or directory not found"})
+		action := c.Query("action")
+		// 目标位置已存在文件时的处理方式，默认返回错误
+		conflict, succeed := getConflict(c, conflictFail)
+		if !succeed {
 			return
 		}
+		loginUserInfo := getLoginUser(c)
 
-		action := c.Query("action")
 		switch action {
 		case "rename":
-			newName := c.Query("name")
-			if newName == "" {
-				c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "newName is empty"})
-				return
-			}
-			newPath := filepath.Join(filepath.Dir(filePath), newName)
-			err := os.Rename(filePath, newPath)
+			newPath, err := ws.renameEntry(loginUserInfo.UserEntry, path, c.Query("name"), conflict)
 			if err != nil {
-				lib.Logger.Error("Rename failed!", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to rename file"})
+				writeFileOpError(c, err)
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"code": 0, "message": "Rename successful"})
+			c.JSON(http.StatusOK, gin.H{"code": 0, "message": "Rename successful", "data": gin.H{"path": newPath}})
 		case "move":
-			dstPath := c.Query("dest")
-			if dstPath == "" {
-				c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "dstPath is empty"})
-				return
-			}
-			dstPath = filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, dstPath)
-			if _, err := os.Stat(dstPath); os.IsExist(err) {
-				c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "dstPath is exist"})
-				return
-			}
-			err := os.Rename(filePath, dstPath)
+			destPath, err := ws.moveEntry(loginUserInfo.UserEntry, path, c.Query("dest"), conflict)
 			if err != nil {
-				lib.Logger.Error("Rename failed!", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to move file"})
+				writeFileOpError(c, err)
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"code": 0, "message": "Move successful"})
+			c.JSON(http.StatusOK, gin.H{"code": 0, "message": "Move successful", "data": gin.H{"path": destPath}})
 		case "copy":
-			dstPath := c.Query("dest")
-			if dstPath == "" {
-				c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "dstPath is empty"})
+			plan, err := ws.prepareCopy(loginUserInfo.UserEntry, path, c.Query("dest"), conflict)
+			if err != nil {
+				writeFileOpError(c, err)
 				return
 			}
-			dstPath = filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, dstPath)
-			if _, err := os.Stat(dstPath); os.IsExist(err) {
-				c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "dstPath is exist"})
+			// 目录和大文件在后台复制，返回任务ID用于查询进度和取消
+			if plan.IsDir || plan.Size >= copyTaskMinSize {
+				tid := ws.startCopyTask(loginUserInfo.UserEntry, plan)
+				c.JSON(http.StatusOK, gin.H{"code": 0, "message": "copy started", "tid": tid, "data": gin.H{"path": plan.DestPath}})
 				return
 			}
-			err := CopyFile(filePath, dstPath)
+			err = ws.runCopy(plan, nil)
 			if err != nil {
-				lib.Logger.Error("CopyFile failed!", err)
+				lib.Logger.Error("CopyPath failed!", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to copy file"})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"code": 0, "message": "Move successful"})
+			c.JSON(http.StatusOK, gin.H{"code": 0, "message": "Copy successful", "data": gin.H{"path": plan.DestPath}})
 		case "create": // 创建文件
-			if _, err := os.Stat(filePath); os.IsExist(err) {
-				c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "file is exist"})
+			if !checkUserPermission(c, actionUpload) {
 				return
 			}
 			name := c.Query("name")
@@ -167,19 +180,37 @@ func (ws *WebServer) ReqChangeFile() gin.HandlerFunc {
 				c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "name is empty"})
 				return
 			}
-			filePath := filepath.Join(filePath, name)
-			_, err := os.Create(filePath)
+			newPath, succeed := joinPath(path, name)
+			if !succeed {
+				c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "name is invalid"})
+				return
+			}
+			filePath, succeed := ws.resolvePath(c, newPath, db.AclAccessWrite)
+			if !succeed {
+				return
+			}
+			if _, err := os.Stat(filepath.Dir(filePath)); os.IsNotExist(err) {
+				c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "File or directory not found"})
+				return
+			}
+			if _, err := os.Lstat(filePath); err == nil {
+				c.JSON(http.StatusOK, gin.H{"code": 1001, "message": "file is exist"})
+				return
+			}
+			f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 			if err != nil {
 				lib.Logger.Error("Create failed!", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to create file"})
 				return
 			}
+			f.Close()
 			// 修改文件权限
 			if err := os.Chmod(filePath, 0644); err != nil {
 				lib.Logger.Error("Chmod error:", err)
 				c.JSON(http.StatusBadRequest, gin.H{"code": 1003, "message": "change file permission failed"})
 				return
 			}
+			ws.notify(fileEventCreate, filePath, "", false)
 			c.JSON(http.StatusOK, gin.H{"code": 0, "message": "Create successful"})
 		default:
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "Invalid action"})
@@ -195,7 +226,10 @@ func (ws *WebServer) ReqGetFile() gin.HandlerFunc {
 			return
 		}
 		loginUserInfo := getLoginUser(c)
-		filePath := filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path)
+		filePath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+		if !succeed {
+			return
+		}
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "File or directory not found"})
 			return
@@ -212,6 +246,9 @@ func (ws *WebServer) ReqGetFile() gin.HandlerFunc {
 				c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to open directory"})
 				return
 			}
+			if path == "" {
+				files = ws.appendMountEntries(loginUserInfo.UserEntry, files)
+			}
 			c.JSON(http.StatusOK, gin.H{
 				"code":    0,
 				"message": "ok",
@@ -220,7 +257,7 @@ func (ws *WebServer) ReqGetFile() gin.HandlerFunc {
 			return
 		} else {
 			c.Header("File-IsDir", "false")
-			c.FileAttachment(filePath, filepath.Base(path))
+			serveFile(c, filePath, filepath.Base(path), info)
 		}
 	}
 }
@@ -232,7 +269,10 @@ func (ws *WebServer) ReqGetFileContent() gin.HandlerFunc {
 			return
 		}
 		loginUserInfo := getLoginUser(c)
-		filePath := filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path)
+		filePath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+		if !succeed {
+			return
+		}
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "File or directory not found"})
 			return
@@ -244,6 +284,9 @@ func (ws *WebServer) ReqGetFileContent() gin.HandlerFunc {
 				c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to open directory"})
 				return
 			}
+			if path == "" {
+				files = ws.appendMountEntries(loginUserInfo.UserEntry, files)
+			}
 			c.JSON(http.StatusOK, gin.H{
 				"code":    0,
 				"message": "ok",
@@ -251,22 +294,101 @@ func (ws *WebServer) ReqGetFileContent() gin.HandlerFunc {
 			})
 			return
 		} else {
-			content, err := os.ReadFile(filePath)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to read file"})
-				return
-			}
-			encodeString := base64.StdEncoding.EncodeToString(content)
-			c.JSON(http.StatusOK, gin.H{
-				"code":    0,
-				"message": "ok",
-				"content": encodeString,
-			})
+			writeFileContent(c, filePath, filepath.Base(path), info)
 			return
 		}
 	}
 }
 
+// 以 JSON 返回文件内容时允许的最大文件大小，更大的文件用 mode=raw 读取
+const fileContentMaxSize = 10 * 1024 * 1024
+
+func errFileTooLarge(size int64, maxSize int64) *FileOpError {
+	return &FileOpError{
+		Status:  http.StatusOK,
+		Code:    1006,
+		Message: "file is too large",
+		Data:    gin.H{"size": size, "max_size": maxSize},
+	}
+}
+
+func errNotText() *FileOpError {
+	return newFileOpError(http.StatusOK, 1007, "file is not text")
+}
+
+// writeFileContent 按参数 mode 返回文件的内容：base64（默认）在 JSON 中返回 base64 编码的内容；
+// text 识别文本的编码并转换为 UTF-8 返回，可以用参数 charset 指定编码（如 gbk、big5）；
+// raw 直接返回文件的内容，不限制大小，支持 Range
+// base64 和 text 只读取不超过 max_size（默认和上限为 10MB）的文件，超过时返回错误码 1006
+func writeFileContent(c *gin.Context, realPath string, name string, info os.FileInfo) {
+	mode := c.DefaultQuery("mode", "base64")
+	switch mode {
+	case "raw":
+		serveContent(c, realPath, name, info, "inline")
+		return
+	case "base64", "text":
+	default:
+		c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "mode is invalid"})
+		return
+	}
+	maxSize, succeed := getQueryInt64Default(c, "max_size", fileContentMaxSize)
+	if !succeed {
+		return
+	}
+	if maxSize < 1 || maxSize > fileContentMaxSize {
+		c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "max_size is invalid"})
+		return
+	}
+	if info.Size() > maxSize {
+		writeFileOpError(c, errFileTooLarge(info.Size(), maxSize))
+		return
+	}
+	f, err := os.Open(realPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to read file"})
+		return
+	}
+	defer f.Close()
+	// 文件可能在读取时变大，最多读取 maxSize+1 个字节
+	content, err := io.ReadAll(io.LimitReader(f, maxSize+1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to read file"})
+		return
+	}
+	if int64(len(content)) > maxSize {
+		writeFileOpError(c, errFileTooLarge(int64(len(content)), maxSize))
+		return
+	}
+	if mode == "base64" {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "ok",
+			"content": base64.StdEncoding.EncodeToString(content),
+		})
+		return
+	}
+	charset := c.Query("charset")
+	if charset == "" {
+		detected, ok := lib.DetectCharset(content)
+		if !ok {
+			writeFileOpError(c, errNotText())
+			return
+		}
+		charset = detected
+	}
+	text, err := lib.DecodeText(content, charset)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "charset is invalid"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    0,
+		"message": "ok",
+		"content": text,
+		"charset": charset,
+	})
+}
+
 func (ws *WebServer) ReqGetAttribute() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		path, succeed := getPath(c)
@@ -274,7 +396,10 @@ func (ws *WebServer) ReqGetAttribute() gin.HandlerFunc {
 			return
 		}
 		loginUserInfo := getLoginUser(c)
-		filePath := filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path)
+		filePath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+		if !succeed {
+			return
+		}
 
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "File or directory not found"})
@@ -298,7 +423,12 @@ func (ws *WebServer) ReqGetAttribute() gin.HandlerFunc {
 			DirCount:  0,
 		}
 		if dataRecursion == "1" && info.IsDir() {
-			fileEntry.DirCount, fileEntry.FileCount, fileEntry.BaseInfo.Size = lib.CalcDir(filePath, !loginUserInfo.UserEntry.ShowDotFiles, nil)
+			// 优先从文件索引中统计，索引还没有建立时遍历目录
+			dirCount, fileCount, size, ok := ws.Indexer.dirSize(filePath, !loginUserInfo.UserEntry.ShowDotFiles)
+			if !ok {
+				dirCount, fileCount, size = lib.CalcDir(filePath, !loginUserInfo.UserEntry.ShowDotFiles, nil)
+			}
+			fileEntry.DirCount, fileEntry.FileCount, fileEntry.BaseInfo.Size = dirCount, fileCount, size
 		}
 		if info.IsDir() {
 			fileEntry.DirCount++
@@ -323,12 +453,22 @@ func (ws *WebServer) ReqCreateFolder() gin.HandlerFunc {
 		if !succeed {
 			return
 		}
-		loginUserInfo := getLoginUser(c)
-		err := os.MkdirAll(filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path), 0777)
+		if !checkUserPermission(c, actionUpload) {
+			return
+		}
+		filePath, succeed := ws.resolvePath(c, path, db.AclAccessWrite)
+		if !succeed {
+			return
+		}
+		existed := lib.IsExist(filePath)
+		err := os.MkdirAll(filePath, 0777)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"code": 2009, "message": "create folder failed"})
 			return
 		}
+		if !existed {
+			ws.notify(fileEventCreate, filePath, "", true)
+		}
 
 		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "create folder succeed"})
 	}
@@ -340,8 +480,10 @@ func (ws *WebServer) ReqReadFileData() gin.HandlerFunc {
 		if !succeed {
 			return
 		}
-		loginUserInfo := getLoginUser(c)
-		filePath := filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path)
+		filePath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+		if !succeed {
+			return
+		}
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "File or directory not found"})
 			return
@@ -355,17 +497,18 @@ func (ws *WebServer) ReqReadFileData() gin.HandlerFunc {
 			return
 		}
 		offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
-		if err != nil {
+		if err != nil || offset < 0 || offset > info.Size() {
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "offset is bad"})
 			return
 		}
-		len, err := strconv.ParseInt(c.Query("len"), 10, 64)
+		length, err := strconv.ParseInt(c.Query("len"), 10, 64)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "len is bad"})
 			return
 		}
-		if len <= 0 {
-			len = info.Size()
+		// len 小于等于 0 或超过文件末尾时读取到文件末尾
+		if length <= 0 || length > info.Size()-offset {
+			length = info.Size() - offset
 		}
 		f, err := os.Open(filePath)
 		if err != nil {
@@ -373,28 +516,25 @@ func (ws *WebServer) ReqReadFileData() gin.HandlerFunc {
 			return
 		}
 		defer f.Close()
-		content := make([]byte, len)
-		size, err := f.ReadAt(content, offset)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to read file"})
-			return
-		}
-		if int64(size) < len {
-			content = content[:size]
-		}
-		c.Header("Content-Length", strconv.Itoa(size))
-		c.Data(http.StatusOK, "application/octet-stream", content)
+		// 按固定大小的缓冲区分段发送，不按 len 分配内存
+		c.DataFromReader(http.StatusOK, length, "application/octet-stream", io.NewSectionReader(f, offset, length), nil)
 	}
 }
 
+// ReqWriteFileData 写入文件的内容，参数 mode 为写入的方式，默认 replace
 func (ws *WebServer) ReqWriteFileData() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		path, succeed := getPath(c)
 		if !succeed {
 			return
 		}
-		loginUserInfo := getLoginUser(c)
-		filePath := filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path)
+		if !checkUserPermission(c, actionModify) {
+			return
+		}
+		filePath, succeed := ws.resolvePath(c, path, db.AclAccessWrite)
+		if !succeed {
+			return
+		}
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "File or directory not found"})
 			return
@@ -407,24 +547,66 @@ func (ws *WebServer) ReqWriteFileData() gin.HandlerFunc {
 			})
 			return
 		}
-		offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
-		if err != nil {
+		// 没有指定方式时，指定了 offset 的按位置写入，兼容按位置分段写入的客户端，否则替换整个文件
+		mode := c.Query("mode")
+		if mode == "" {
+			mode = writeModeReplace
+			if _, ok := c.GetQuery("offset"); ok {
+				mode = writeModeWrite
+			}
+		}
+		if mode != writeModeReplace && mode != writeModeWrite && mode != writeModeAppend && mode != writeModeTruncate {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "mode is bad"})
+			return
+		}
+		offset := int64(0)
+		if c.Query("offset") != "" {
+			var err error
+			offset, err = strconv.ParseInt(c.Query("offset"), 10, 64)
+			if err != nil || offset < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "offset is bad"})
+				return
+			}
+		}
+		// 替换整个文件时不能指定位置，避免按位置分段写入的客户端用一段内容替换了整个文件
+		if mode == writeModeReplace && offset != 0 {
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "offset is bad"})
 			return
 		}
-		f, err := os.OpenFile(filePath, os.O_WRONLY, 0644)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to open file for write"})
+		length := int64(-1)
+		if mode == writeModeTruncate {
+			var err error
+			length, err = strconv.ParseInt(c.Query("length"), 10, 64)
+			if err != nil || length < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "length is bad"})
+				return
+			}
+		}
+		// 文件已经被其他客户端修改时拒绝写入
+		precondition, succeed := getFilePrecondition(c)
+		if !succeed {
+			return
+		}
+		if err := precondition.check(filePath); err != nil {
+			writeFileOpError(c, err)
 			return
 		}
-		defer f.Close()
 		defer c.Request.Body.Close()
-		content, _ := io.ReadAll(c.Request.Body)
-		size, err := f.WriteAt(content, offset)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to write file"})
+		loginUserInfo := getLoginUser(c)
+		var size int64
+		if mode == writeModeReplace {
+			size, succeed = ws.replaceFileData(c, loginUserInfo.UserEntry, filePath, info)
+		} else {
+			size, succeed = ws.writeFileData(c, loginUserInfo.UserEntry, filePath, info, mode, offset, length)
+		}
+		if !succeed {
 			return
 		}
+		ws.notify(fileEventModify, filePath, "", false)
+		// 返回写入后的 ETag，下次写入时作为 If-Match
+		if info, err := os.Stat(filePath); err == nil {
+			c.Header("ETag", fileETag(info))
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"code":    0,
 			"message": "ok",
@@ -432,3 +614,173 @@ func (ws *WebServer) ReqWriteFileData() gin.HandlerFunc {
 		})
 	}
 }
+
+// 写入文件的方式
+const (
+	writeModeReplace  = "replace"  // 用请求的内容替换整个文件，先写到临时文件再改名，写入中断时不会损坏原来的文件
+	writeModeWrite    = "write"    // 从 offset 开始写入，不改变文件的其他部分
+	writeModeAppend   = "append"   // 写到文件的末尾
+	writeModeTruncate = "truncate" // 从 offset 开始写入后把文件的长度设置为 length
+)
+
+// syncDir 把目录的修改同步到磁盘，改名后调用，断电后改名不会丢失
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// bodyLimiter 请求的大小未知时限制读取的大小，最多读取 limit 字节，limit 小于 0 时不限制
+type bodyLimiter struct {
+	body  io.Reader
+	limit int64
+}
+
+func newBodyLimiter(c *gin.Context, limit int64) *bodyLimiter {
+	l := &bodyLimiter{body: c.Request.Body, limit: -1}
+	if c.Request.ContentLength < 0 && limit >= 0 {
+		l.limit = limit
+		l.body = io.LimitReader(c.Request.Body, limit)
+	}
+	return l
+}
+
+func (l *bodyLimiter) Read(p []byte) (int, error) {
+	return l.body.Read(p)
+}
+
+// exceeded 判断已经读取 n 字节后请求是否还有超出限制的数据
+func (l *bodyLimiter) exceeded(c *gin.Context, n int64) bool {
+	if l.limit < 0 || n < l.limit {
+		return false
+	}
+	var buf [1]byte
+	m, _ := io.ReadFull(c.Request.Body, buf[:])
+	return m > 0
+}
+
+// replaceFileData 把请求的内容写到同一目录下的临时文件，同步到磁盘后改名替换原来的文件，返回写入的大小
+func (ws *WebServer) replaceFileData(c *gin.Context, userEntry db.UserEntry, realPath string, info os.FileInfo) (int64, bool) {
+	// 请求的大小已知时先检查配额，未知时最多读取剩余空间加上原来文件的大小
+	if c.Request.ContentLength >= 0 && !ws.checkQuota(c, realPath, c.Request.ContentLength-info.Size()) {
+		return 0, false
+	}
+	available := ws.getPathAvailableSize(realPath)
+	limit := available
+	if available >= 0 {
+		limit = available + info.Size()
+	}
+	body := newBodyLimiter(c, limit)
+	suffix, _ := lib.GenerateRandomString(8)
+	tempPath := realPath + "." + suffix
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to open file for write"})
+		return 0, false
+	}
+	size, err := io.Copy(f, body)
+	if err == nil {
+		err = f.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		lib.Logger.Error("replaceFileData: write temp file failed!", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to write file"})
+		return 0, false
+	}
+	if body.exceeded(c, size) {
+		os.Remove(tempPath)
+		writeFileOpError(c, ws.exceededQuotaError(realPath, available))
+		return 0, false
+	}
+	// 替换前保存原来的内容
+	if _, err := ws.saveVersion(userEntry, realPath, false); err != nil {
+		os.Remove(tempPath)
+		lib.Logger.Error("save file version failed!", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to save file version"})
+		return 0, false
+	}
+	if err := os.Rename(tempPath, realPath); err != nil {
+		os.Remove(tempPath)
+		lib.Logger.Error("replaceFileData: rename failed!", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to write file"})
+		return 0, false
+	}
+	syncDir(filepath.Dir(realPath))
+	ws.addUsedSize(realPath, size-info.Size())
+	return size, true
+}
+
+// writeFileData 按 mode 在原来的文件上写入，返回写入的大小
+// 请求的内容边读边写，读取请求失败或超过配额时返回错误，已经写入的部分保留在文件中，原来的内容保存在历史版本中
+func (ws *WebServer) writeFileData(c *gin.Context, userEntry db.UserEntry, realPath string, info os.FileInfo, mode string, offset int64, length int64) (int64, bool) {
+	// 写入 n 个字节后文件大小的变化，只有截断时文件会变小
+	growth := func(n int64) int64 {
+		switch mode {
+		case writeModeAppend:
+			return n
+		case writeModeTruncate:
+			return length - info.Size()
+		}
+		return max(offset+n, info.Size()) - info.Size()
+	}
+	// 请求的大小未知时按 0 检查，写入时最多写到剩余空间用完
+	if !ws.checkQuota(c, realPath, growth(max(c.Request.ContentLength, 0))) {
+		return 0, false
+	}
+	available := ws.getPathAvailableSize(realPath)
+	limit := available
+	if available >= 0 && mode != writeModeAppend {
+		limit = max(max(info.Size(), length)+available-offset, 0)
+	}
+	body := newBodyLimiter(c, limit)
+	// 写入前保存原来的内容，追加不会改变原来的内容，不需要保存
+	if mode != writeModeAppend {
+		if _, err := ws.saveVersion(userEntry, realPath, false); err != nil {
+			lib.Logger.Error("save file version failed!", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to save file version"})
+			return 0, false
+		}
+	}
+	flag := os.O_WRONLY
+	if mode == writeModeAppend {
+		flag |= os.O_APPEND
+	}
+	f, err := os.OpenFile(realPath, flag, 0644)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to open file for write"})
+		return 0, false
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if mode != writeModeAppend {
+		w = io.NewOffsetWriter(f, offset)
+	}
+	size, err := io.Copy(w, body)
+	if err == nil && mode == writeModeTruncate {
+		err = f.Truncate(length)
+	}
+	// 按文件实际的大小计入已使用空间，写入失败时也计入已经写入的部分
+	if stat, statErr := f.Stat(); statErr == nil {
+		ws.addUsedSize(realPath, stat.Size()-info.Size())
+	}
+	if err != nil {
+		lib.Logger.Error("writeFileData: write file failed!", err, realPath)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to write file"})
+		return 0, false
+	}
+	if body.exceeded(c, size) {
+		writeFileOpError(c, ws.exceededQuotaError(realPath, available))
+		return 0, false
+	}
+	return size, true
+}
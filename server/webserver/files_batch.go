@@ -0,0 +1,307 @@
+package webserver
+
+import (
+	"errors"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 批量操作
+// 一次提交多个删除、移动、复制和重命名操作，在后台按顺序执行，通过 bid 查询每一项的结果
+// 某一项失败时记录错误并继续执行后面的操作
+
+// 一次批量操作最多包含的操作数
+const batchMaxOperations = 1000
+
+// 批量操作中每一项的状态
+const (
+	batchStatusPending  = "pending"
+	batchStatusSucceed  = "succeed"
+	batchStatusFailed   = "failed"
+	batchStatusSkipped  = "skipped"
+	batchStatusCanceled = "canceled"
+)
+
+type BatchOperation struct {
+	Action string `json:"action"` // delete、move、copy、rename
+	Path   string `json:"path"`
+	Dest   string `json:"dest"` // 移动和复制的目标路径
+	Name   string `json:"name"` // 重命名的新名称
+}
+
+type BatchResult struct {
+	BatchOperation
+	Status  string `json:"status"`
+	Code    int    `json:"code"`    // 失败时的错误码
+	Message string `json:"message"` // 失败时的错误信息
+	Result  string `json:"result"`  // 移动、复制和重命名后的路径
+}
+
+type BatchTaskEntry struct {
+	Bid         string
+	UserEntry   db.UserEntry // 创建任务的用户，按该用户的权限执行，只有该用户可以查询和取消
+	Conflict    string
+	StartTime   time.Time
+	FinishTime  time.Time
+	FinishCount int
+	Canceled    bool
+	Finished    bool
+	Results     []BatchResult
+	copying     *lib.CopyProgress // 正在复制的进度，取消时停止复制
+	lock        sync.Mutex
+}
+
+type BatchTaskProgressEntry struct {
+	StartTime   string        `json:"start_time"`
+	Conflict    string        `json:"conflict"`
+	FinishCount int           `json:"finish_count"`
+	TotalCount  int           `json:"total_count"`
+	Finished    bool          `json:"finished"`
+	Canceled    bool          `json:"canceled"`
+	Results     []BatchResult `json:"results"`
+}
+
+// runOperation 执行批量操作中的一项，返回操作后的路径
+func (ws *WebServer) runOperation(task *BatchTaskEntry, op BatchOperation) (string, error) {
+	switch op.Action {
+	case "delete":
+		return "", ws.deleteEntry(task.UserEntry, op.Path)
+	case "rename":
+		return ws.renameEntry(task.UserEntry, op.Path, op.Name, task.Conflict)
+	case "move":
+		return ws.moveEntry(task.UserEntry, op.Path, op.Dest, task.Conflict)
+	case "copy":
+		plan, err := ws.prepareCopy(task.UserEntry, op.Path, op.Dest, task.Conflict)
+		if err != nil {
+			return "", err
+		}
+		progress := &lib.CopyProgress{
+			StartTime:   time.Now(),
+			SkipSymlink: ws.getSymlinkPolicy() == SymlinkPolicyDeny,
+		}
+		task.lock.Lock()
+		task.copying = progress
+		progress.Canceled.Store(task.Canceled)
+		task.lock.Unlock()
+		err = ws.runCopy(plan, progress)
+		task.lock.Lock()
+		task.copying = nil
+		task.lock.Unlock()
+		if err != nil {
+			if !errors.Is(err, lib.ErrCopyCanceled) {
+				lib.Logger.Error("batch copy failed!", err)
+			}
+			return "", newFileOpError(http.StatusInternalServerError, 1001, "Failed to copy file")
+		}
+		return plan.DestPath, nil
+	}
+	return "", newFileOpError(http.StatusBadRequest, 1001, "Invalid action")
+}
+
+// runBatchTask 按顺序执行批量操作，取消后剩下的操作不再执行
+func (ws *WebServer) runBatchTask(task *BatchTaskEntry) {
+	for i := range task.Results {
+		task.lock.Lock()
+		canceled := task.Canceled
+		op := task.Results[i].BatchOperation
+		task.lock.Unlock()
+
+		result := BatchResult{BatchOperation: op, Status: batchStatusCanceled}
+		if !canceled {
+			path, err := ws.runOperation(task, op)
+			var opErr *FileOpError
+			switch {
+			case err == nil:
+				result.Status = batchStatusSucceed
+				result.Result = path
+			case errors.Is(err, errConflictSkipped):
+				result.Status = batchStatusSkipped
+				result.Message = err.Error()
+			case errors.As(err, &opErr):
+				result.Status = batchStatusFailed
+				result.Code = opErr.Code
+				result.Message = opErr.Message
+			default:
+				result.Status = batchStatusFailed
+				result.Code = 1000
+				result.Message = err.Error()
+			}
+			// 执行过程中取消的复制记为已取消
+			task.lock.Lock()
+			if task.Canceled && result.Status == batchStatusFailed && op.Action == "copy" {
+				result.Status = batchStatusCanceled
+			}
+			task.lock.Unlock()
+		}
+
+		task.lock.Lock()
+		task.Results[i] = result
+		task.FinishCount++
+		task.lock.Unlock()
+	}
+	task.lock.Lock()
+	task.FinishTime = time.Now()
+	task.Finished = true
+	task.lock.Unlock()
+}
+
+// CleanBatchTasks 清理已经结束的批量操作，由后台定时调用
+func CleanBatchTasks() {
+	GetInstance().Lock.Lock()
+	defer GetInstance().Lock.Unlock()
+	for bid, task := range GetInstance().BatchTasks {
+		task.lock.Lock()
+		expired := task.Finished && time.Since(task.FinishTime) > copyTaskKeepTime
+		task.lock.Unlock()
+		if expired {
+			delete(GetInstance().BatchTasks, bid)
+		}
+	}
+}
+
+// ReqCreateBatchTask 创建批量操作，参数 conflict 为目标位置已存在文件时的处理方式，对所有操作生效
+func (ws *WebServer) ReqCreateBatchTask() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		conflict, succeed := getConflict(c, conflictFail)
+		if !succeed {
+			return
+		}
+		req := struct {
+			Operations []BatchOperation `json:"operations"`
+		}{}
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		if len(req.Operations) == 0 || len(req.Operations) > batchMaxOperations {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "operations is invalid",
+			})
+			return
+		}
+		results := make([]BatchResult, len(req.Operations))
+		for i, op := range req.Operations {
+			switch op.Action {
+			case "delete", "move", "copy", "rename":
+			default:
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1000,
+					"message": "action is invalid: " + op.Action,
+				})
+				return
+			}
+			results[i] = BatchResult{BatchOperation: op, Status: batchStatusPending}
+		}
+
+		loginUserInfo := getLoginUser(c)
+		bid, _ := lib.GenerateRandomString(16)
+		task := &BatchTaskEntry{
+			Bid:       bid,
+			UserEntry: loginUserInfo.UserEntry,
+			Conflict:  conflict,
+			StartTime: time.Now(),
+			Results:   results,
+		}
+		GetInstance().Lock.Lock()
+		GetInstance().BatchTasks[bid] = task
+		GetInstance().Lock.Unlock()
+		go ws.runBatchTask(task)
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "create_batch_task",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"batch_id": bid,
+				"count":    strconv.Itoa(len(results)),
+				"conflict": conflict,
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "create batch task succeed",
+			"data": gin.H{
+				"bid": bid,
+			},
+		})
+	}
+}
+
+// getBatchTask 获取参数 bid 指定的批量操作，只能获取自己创建的任务
+func getBatchTask(c *gin.Context) (*BatchTaskEntry, bool) {
+	bid := c.Query("bid")
+	if bid == "" {
+		c.JSON(http.StatusOK, gin.H{"code": 2009, "message": "bid invalid"})
+		return nil, false
+	}
+	GetInstance().Lock.Lock()
+	task, exist := GetInstance().BatchTasks[bid]
+	GetInstance().Lock.Unlock()
+	loginUserInfo := getLoginUser(c)
+	if !exist || task.UserEntry.Id != loginUserInfo.UserEntry.Id {
+		c.JSON(http.StatusOK, gin.H{"code": 2009, "message": "bid not found"})
+		return nil, false
+	}
+	return task, true
+}
+
+// ReqQueryBatchTask 查询批量操作的进度和每一项的结果
+func (ws *WebServer) ReqQueryBatchTask() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		task, succeed := getBatchTask(c)
+		if !succeed {
+			return
+		}
+		task.lock.Lock()
+		entry := BatchTaskProgressEntry{
+			StartTime:   task.StartTime.Format(time.DateTime),
+			Conflict:    task.Conflict,
+			FinishCount: task.FinishCount,
+			TotalCount:  len(task.Results),
+			Finished:    task.Finished,
+			Canceled:    task.Canceled,
+			Results:     append([]BatchResult{}, task.Results...),
+		}
+		task.lock.Unlock()
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "query progress succeed", "data": entry})
+	}
+}
+
+// ReqDeleteBatchTask 取消正在进行的批量操作，已完成的操作不会撤销，已结束的任务直接删除记录
+func (ws *WebServer) ReqDeleteBatchTask() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		task, succeed := getBatchTask(c)
+		if !succeed {
+			return
+		}
+		task.lock.Lock()
+		finished := task.Finished
+		if !finished {
+			task.Canceled = true
+			if task.copying != nil {
+				task.copying.Canceled.Store(true)
+			}
+		}
+		task.lock.Unlock()
+		if !finished {
+			c.JSON(http.StatusOK, gin.H{"code": 0, "message": "cancel succeed"})
+			return
+		}
+		GetInstance().Lock.Lock()
+		delete(GetInstance().BatchTasks, task.Bid)
+		GetInstance().Lock.Unlock()
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "delete succeed"})
+	}
+}
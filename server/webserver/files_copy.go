@@ -0,0 +1,143 @@
+package webserver
+
+import (
+	"errors"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 复制目录或大于该大小的文件时在后台执行，通过 tid 查询进度
+const copyTaskMinSize = 16 * 1024 * 1024
+
+// 复制任务结束后保留的时间，超过后自动清理
+const copyTaskKeepTime = time.Hour
+
+type CopyTaskEntry struct {
+	Tid          string
+	UserId       int64  // 创建任务的用户ID，只有该用户可以查询和取消
+	SrcPath      string // 用户看到的源路径
+	DestPath     string // 用户看到的目标路径
+	DestRealPath string
+	Progress     *lib.CopyProgress
+}
+
+type CopyTaskProgressEntry struct {
+	StartTime       string `json:"start_time"`
+	SrcPath         string `json:"src_path"`
+	DestPath        string `json:"dest_path"`
+	FinishFileCount uint64 `json:"finish_file_count"`
+	TotalFileCount  uint64 `json:"total_file_count"`
+	FinishSize      uint64 `json:"finish_size"`
+	TotalSize       uint64 `json:"total_size"`
+	Finished        bool   `json:"finished"`
+	Canceled        bool   `json:"canceled"`
+	Error           string `json:"error"`
+}
+
+// startCopyTask 在后台复制文件或目录，失败或取消时删除已复制的内容
+func (ws *WebServer) startCopyTask(userEntry db.UserEntry, plan copyPlan) string {
+	tid, _ := lib.GenerateRandomString(16)
+	task := &CopyTaskEntry{
+		Tid:          tid,
+		UserId:       userEntry.Id,
+		SrcPath:      plan.SrcPath,
+		DestPath:     plan.DestPath,
+		DestRealPath: plan.DestRealPath,
+		Progress: &lib.CopyProgress{
+			StartTime:   time.Now(),
+			SkipSymlink: ws.getSymlinkPolicy() == SymlinkPolicyDeny,
+		},
+	}
+	GetInstance().Lock.Lock()
+	GetInstance().CopyTasks[tid] = task
+	GetInstance().Lock.Unlock()
+
+	go func() {
+		progress := task.Progress
+		err := ws.runCopy(plan, progress)
+		if err != nil && !errors.Is(err, lib.ErrCopyCanceled) {
+			lib.Logger.Error("copy task failed!", err, plan.SrcRealPath, plan.DestRealPath)
+		}
+		progress.Finish(err)
+	}()
+	return tid
+}
+
+// CleanCopyTasks 清理已经结束的复制任务，由后台定时调用
+func CleanCopyTasks() {
+	GetInstance().Lock.Lock()
+	defer GetInstance().Lock.Unlock()
+	for tid, task := range GetInstance().CopyTasks {
+		if task.Progress.Finished.Load() && time.Since(task.Progress.FinishTime) > copyTaskKeepTime {
+			delete(GetInstance().CopyTasks, tid)
+		}
+	}
+}
+
+// getCopyTask 获取参数 tid 指定的复制任务，只能获取自己创建的任务
+func getCopyTask(c *gin.Context) (*CopyTaskEntry, bool) {
+	tid := c.Query("tid")
+	if tid == "" {
+		c.JSON(http.StatusOK, gin.H{"code": 2009, "message": "tid invalid"})
+		return nil, false
+	}
+	GetInstance().Lock.Lock()
+	task, exist := GetInstance().CopyTasks[tid]
+	GetInstance().Lock.Unlock()
+	loginUserInfo := getLoginUser(c)
+	if !exist || task.UserId != loginUserInfo.UserEntry.Id {
+		c.JSON(http.StatusOK, gin.H{"code": 2009, "message": "tid not found"})
+		return nil, false
+	}
+	return task, true
+}
+
+// ReqQueryCopyTask 查询复制进度
+func (ws *WebServer) ReqQueryCopyTask() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		task, succeed := getCopyTask(c)
+		if !succeed {
+			return
+		}
+		progress := task.Progress
+		entry := CopyTaskProgressEntry{
+			StartTime:       progress.StartTime.Format(time.DateTime),
+			SrcPath:         task.SrcPath,
+			DestPath:        task.DestPath,
+			FinishFileCount: progress.FinishFileCount.Load(),
+			TotalFileCount:  progress.TotalFileCount.Load(),
+			FinishSize:      progress.FinishSize.Load(),
+			TotalSize:       progress.TotalSize.Load(),
+			Finished:        progress.Finished.Load(),
+			Canceled:        progress.Canceled.Load(),
+		}
+		// 结束后才能读取复制的错误
+		if entry.Finished && progress.ProgressError != nil {
+			entry.Error = progress.ProgressError.Error()
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "query progress succeed", "data": entry})
+	}
+}
+
+// ReqDeleteCopyTask 取消正在进行的复制任务，已结束的任务直接删除记录
+func (ws *WebServer) ReqDeleteCopyTask() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		task, succeed := getCopyTask(c)
+		if !succeed {
+			return
+		}
+		if !task.Progress.Finished.Load() {
+			task.Progress.Canceled.Store(true)
+			c.JSON(http.StatusOK, gin.H{"code": 0, "message": "cancel succeed"})
+			return
+		}
+		GetInstance().Lock.Lock()
+		delete(GetInstance().CopyTasks, task.Tid)
+		GetInstance().Lock.Unlock()
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "delete succeed"})
+	}
+}
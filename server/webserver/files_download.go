@@ -2,11 +2,16 @@ package webserver
 
 import (
 	"fmt"
+	"io"
+	"mime"
+	"myfileserver/db"
 	"myfileserver/lib"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,14 +35,18 @@ func (ws *WebServer) ReqCreatePackage() gin.HandlerFunc {
 			return
 		}
 		extName := c.Query("ext")
-		loginUserInfo := getLoginUser(c)
-		filePath := filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path)
+		filePath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+		if !succeed {
+			return
+		}
 		// 创建下载压缩包
 		stat, err := os.Stat(filePath)
 		if os.IsNotExist(err) {
 			c.JSON(http.StatusNotFound, gin.H{"code": 10006, "message": "File or directory not found"})
 			return
 		}
+		loginUserInfo := getLoginUser(c)
+		base, _ := ws.resolveUserPath(loginUserInfo.UserEntry, path)
 		pid, _ := lib.GenerateRandomString(16)
 		// 创建压缩包
 		// 压缩包路径
@@ -52,6 +61,7 @@ func (ws *WebServer) ReqCreatePackage() gin.HandlerFunc {
 			TotalFileCount:  0,
 			Finished:        false,
 			DownloadCount:   0,
+			AllowSymlink:    ws.symlinkChecker(base, &loginUserInfo.UserEntry),
 		}
 
 		GetInstance().Lock.Lock()
@@ -164,8 +174,152 @@ func (ws *WebServer) ReqDownloadPackage() gin.HandlerFunc {
 			return
 		}
 		// 下载压缩包
+		info, err := os.Stat(processRW.DestFilename)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"code": 2009, "message": "not found"})
+			return
+		}
+		if isNewDownload(c, info) {
+			processRW.DownloadCount++
+		}
 		filename := filepath.Base(processRW.SrcFilename) + processRW.ExtName
-		processRW.DownloadCount++
-		c.FileAttachment(processRW.DestFilename, filename)
+		serveFile(c, processRW.DestFilename, filename, info)
+	}
+}
+
+// 文件下载
+// 由 http.ServeContent 处理 Range、If-Range、If-Match、If-Unmodified-Since、If-None-Match 和 If-Modified-Since，
+// 请求多个范围时返回 multipart/byteranges，文件没有变化时返回 304
+
+// fileETag 按文件的修改时间和大小生成 ETag，文件修改后 ETag 随之变化
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// etagMatch 判断 If-None-Match 中是否有和 etag 相同的值，按弱比较
+func etagMatch(header string, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// isNewDownload 判断请求是否开始一次新的下载，用于统计下载次数
+// 返回 304 的请求和从中间继续下载的范围请求不算新的下载
+func isNewDownload(c *gin.Context, info os.FileInfo) bool {
+	etag := fileETag(info)
+	modTime := info.ModTime().Truncate(time.Second)
+	if header := c.GetHeader("If-None-Match"); header != "" {
+		if etagMatch(header, etag) {
+			return false
+		}
+	} else if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && !modTime.After(since) {
+		return false
+	}
+	ranges := c.GetHeader("Range")
+	if ranges == "" {
+		return true
+	}
+	// If-Range 和文件不一致时返回整个文件
+	if header := c.GetHeader("If-Range"); header != "" && header != etag {
+		if t, err := http.ParseTime(header); err != nil || !modTime.Equal(t) {
+			return true
+		}
+	}
+	return rangeCoversStart(ranges, info.Size())
+}
+
+// rangeCoversStart 判断 Range 中是否有包含文件开头的范围，如 0-99、0- 或不小于文件大小的 -n
+// 多个范围时只要有一个包含开头就返回 true，避免用 bytes=1-,0-0 这样的请求下载整个文件而不计数
+func rangeCoversStart(ranges string, size int64) bool {
+	specs, ok := strings.CutPrefix(ranges, "bytes=")
+	if !ok {
+		return false
+	}
+	for _, spec := range strings.Split(specs, ",") {
+		start, end, ok := strings.Cut(strings.TrimSpace(spec), "-")
+		if !ok {
+			continue
+		}
+		start, end = strings.TrimSpace(start), strings.TrimSpace(end)
+		if start == "" {
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err == nil && n > 0 && n >= size {
+				return true
+			}
+			continue
+		}
+		if n, err := strconv.ParseInt(start, 10, 64); err == nil && n == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// serveFile 以附件的形式下载文件，info 为 realPath 的信息，name 为下载的文件名
+func serveFile(c *gin.Context, realPath string, name string, info os.FileInfo) {
+	serveContent(c, realPath, name, info, "attachment")
+}
+
+// activeContentTypes 浏览器会当作页面解析、可以执行脚本的类型
+var activeContentTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"text/xml",
+	"application/xml",
+	"text/xsl",
+	"application/xslt+xml",
+}
+
+// isActiveContentType 判断 contentType 是否会被浏览器当作页面解析
+func isActiveContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	return slices.Contains(activeContentTypes, mediaType) || strings.HasSuffix(mediaType, "+xml")
+}
+
+// detectContentType 按扩展名得到文件的类型，没有对应的类型时按文件开头的内容判断
+func detectContentType(f *os.File, name string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType
+	}
+	var buf [512]byte
+	n, _ := io.ReadFull(f, buf[:])
+	f.Seek(0, io.SeekStart)
+	return http.DetectContentType(buf[:n])
+}
+
+// serveContent 返回文件的内容，disposition 为 attachment 或 inline
+// 文件内容由用户上传，不能在本站的源下执行脚本：禁止浏览器猜测类型，用 sandbox 把页面放到独立的源，
+// 会被当作页面解析的类型总是以附件的形式返回
+func serveContent(c *gin.Context, realPath string, name string, info os.FileInfo, disposition string) {
+	if info.IsDir() {
+		c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "bad file type"})
+		return
+	}
+	f, err := os.Open(realPath)
+	if err != nil {
+		lib.Logger.Error("serveContent: open file failed!", err, realPath)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to read file"})
+		return
+	}
+	defer f.Close()
+	contentType := detectContentType(f, name)
+	if isActiveContentType(contentType) {
+		disposition = "attachment"
 	}
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "sandbox")
+	c.Header("ETag", fileETag(info))
+	// 每次使用缓存前都要向服务器确认，文件没有变化时返回 304
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime(), f)
 }
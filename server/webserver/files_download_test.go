@@ -0,0 +1,136 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRangeCoversStart(t *testing.T) {
+	tests := []struct {
+		ranges string
+		want   bool
+	}{
+		{"bytes=0-99", true},
+		{"bytes=0-", true},
+		{"bytes= 0 - 10", true},
+		{"bytes=-100", true},
+		{"bytes=-1000", true},
+		{"bytes=-99", false},
+		{"bytes=-0", false},
+		{"bytes=1-", false},
+		{"bytes=50-99", false},
+		{"bytes=1-,0-0", true},
+		{"bytes=50-60,-100", true},
+		{"bytes=50-60,70-80", false},
+		{"bytes=00-10", true},
+		{"bytes=x-10", false},
+		{"items=0-10", false},
+		{"bytes=", false},
+		{"bytes=0", false},
+	}
+	for _, tt := range tests {
+		if got := rangeCoversStart(tt.ranges, 100); got != tt.want {
+			t.Errorf("rangeCoversStart(%q, 100) = %v, want %v", tt.ranges, got, tt.want)
+		}
+	}
+}
+
+func TestEtagMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"a-1"`, true},
+		{`W/"a-1"`, true},
+		{`"b-2", "a-1"`, true},
+		{`*`, true},
+		{`"b-2"`, false},
+		{`a-1`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatch(tt.header, `"a-1"`); got != tt.want {
+			t.Errorf("etagMatch(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestIsNewDownload(t *testing.T) {
+	realPath := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(realPath, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 600, time.UTC)
+	if err := os.Chtimes(realPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := fileETag(info)
+	lastModified := modTime.Format(http.TimeFormat)
+	before := modTime.Add(-time.Hour).Format(http.TimeFormat)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"plain", nil, true},
+		{"if-none-match matched", map[string]string{"If-None-Match": etag}, false},
+		{"if-none-match weak matched", map[string]string{"If-None-Match": "W/" + etag}, false},
+		{"if-none-match changed", map[string]string{"If-None-Match": `"0-0"`}, true},
+		{"if-modified-since not modified", map[string]string{"If-Modified-Since": lastModified}, false},
+		{"if-modified-since modified", map[string]string{"If-Modified-Since": before}, true},
+		{"if-none-match takes precedence", map[string]string{"If-None-Match": `"0-0"`, "If-Modified-Since": lastModified}, true},
+		{"range from start", map[string]string{"Range": "bytes=0-9"}, true},
+		{"range resume", map[string]string{"Range": "bytes=10-"}, false},
+		{"range suffix whole file", map[string]string{"Range": "bytes=-100"}, true},
+		{"range multiple with start", map[string]string{"Range": "bytes=1-,0-0"}, true},
+		{"if-range etag matched", map[string]string{"Range": "bytes=10-", "If-Range": etag}, false},
+		{"if-range etag changed", map[string]string{"Range": "bytes=10-", "If-Range": `"0-0"`}, true},
+		{"if-range date matched", map[string]string{"Range": "bytes=10-", "If-Range": lastModified}, false},
+		{"if-range date changed", map[string]string{"Range": "bytes=10-", "If-Range": before}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/file", nil)
+			for k, v := range tt.headers {
+				c.Request.Header.Set(k, v)
+			}
+			if got := isNewDownload(c, info); got != tt.want {
+				t.Errorf("isNewDownload = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsActiveContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"TEXT/HTML", true},
+		{"image/svg+xml", true},
+		{"application/xhtml+xml", true},
+		{"application/atom+xml", true},
+		{"text/xml; charset=utf-8", true},
+		{"", true},
+		{"text/plain; charset=utf-8", false},
+		{"image/png", false},
+		{"application/pdf", false},
+		{"video/mp4", false},
+	}
+	for _, tt := range tests {
+		if got := isActiveContentType(tt.contentType); got != tt.want {
+			t.Errorf("isActiveContentType(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package webserver
+
+import (
+	"errors"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文件操作
+// 删除、重命名、移动和复制的实现，单个文件的接口和批量操作共用，失败时返回 FileOpError 或 PathError
+
+// FileOpError 文件操作失败的错误，返回给客户端的状态码、错误码和信息
+type FileOpError struct {
+	Status  int
+	Code    int
+	Message string
+	Data    any
+}
+
+func (e *FileOpError) Error() string {
+	return e.Message
+}
+
+// 目标位置已存在文件，按 conflict 跳过了该操作
+var errConflictSkipped = errors.New("file is exist, skipped")
+
+func newFileOpError(status int, code int, message string) *FileOpError {
+	return &FileOpError{Status: status, Code: code, Message: message}
+}
+
+// errPermissionDenied 没有权限时和其他业务错误一样返回 200，由错误码 1009 区分
+func errPermissionDenied() *FileOpError {
+	return newFileOpError(http.StatusOK, 1009, "permission denied")
+}
+
+func errNotFound() *FileOpError {
+	return newFileOpError(http.StatusNotFound, 1001, "File or directory not found")
+}
+
+// writeFileOpError 按文件操作的错误类型返回错误
+func writeFileOpError(c *gin.Context, err error) {
+	var opErr *FileOpError
+	switch {
+	case errors.Is(err, errConflictSkipped):
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": err.Error(), "data": gin.H{"skipped": true}})
+	case errors.As(err, &opErr):
+		h := gin.H{"code": opErr.Code, "message": opErr.Message}
+		if opErr.Data != nil {
+			h["data"] = opErr.Data
+		}
+		c.JSON(opErr.Status, h)
+	default:
+		writePathError(c, err)
+	}
+}
+
+// checkPermission 校验用户是否允许执行操作
+func checkPermission(userEntry db.UserEntry, action string) error {
+	if !isUserAllowed(userEntry, action) {
+		return errPermissionDenied()
+	}
+	return nil
+}
+
+// resolveOpPath 整理并解析文件操作的源路径，followLast 为 false 时操作符号链接本身
+// 根目录和挂载点本身不能删除、重命名和移动
+func (ws *WebServer) resolveOpPath(userEntry db.UserEntry, path string, access string, followLast bool) (string, string, error) {
+	path, succeed := cleanPath(path)
+	if !succeed {
+		return "", "", &PathError{Path: path, Err: ErrPathInvalid}
+	}
+	if !followLast && (path == "" || ws.isMountPoint(userEntry, path)) {
+		return "", "", errPermissionDenied()
+	}
+	realPath, err := ws.resolveUserRealPath(userEntry, path, access, followLast)
+	if err != nil {
+		return "", "", err
+	}
+	return path, realPath, nil
+}
+
+// resolveOpDest 整理并解析移动和复制的目标路径
+func (ws *WebServer) resolveOpDest(userEntry db.UserEntry, dest string) (string, string, error) {
+	dest, succeed := cleanPath(dest)
+	if !succeed || dest == "" {
+		return "", "", newFileOpError(http.StatusBadRequest, 1001, "dstPath is invalid")
+	}
+	realPath, err := ws.resolveUserRealPath(userEntry, dest, db.AclAccessWrite, false)
+	if err != nil {
+		return "", "", err
+	}
+	return dest, realPath, nil
+}
+
+// applyConflict 目标位置已存在文件时按 conflict 处理，path 为用户看到的路径，realPath 为服务器上的路径
+// 返回处理后的路径，跳过时返回 errConflictSkipped
+func (ws *WebServer) applyConflict(userEntry db.UserEntry, conflict string, path string, realPath string) (string, string, error) {
+	info, err := os.Lstat(realPath)
+	if err != nil {
+		return path, realPath, nil
+	}
+	switch conflict {
+	case conflictRename:
+		realPath = getAvailablePath(realPath)
+		path = filepath.ToSlash(filepath.Join(filepath.Dir(path), filepath.Base(realPath)))
+		return path, realPath, nil
+	case conflictOverwrite:
+		if err := checkPermission(userEntry, actionDelete); err != nil {
+			return path, realPath, err
+		}
+		// 不能覆盖挂载点本身
+		if path == "" || ws.isMountPoint(userEntry, path) {
+			return path, realPath, errPermissionDenied()
+		}
+		trash, err := ws.moveToTrash(userEntry, path, realPath)
+		// 空间不足等业务错误直接返回
+		var opErr *FileOpError
+		if errors.As(err, &opErr) {
+			return path, realPath, err
+		}
+		if err != nil {
+			lib.Logger.Error("applyConflict: move to trash failed!", err)
+			return path, realPath, newFileOpError(http.StatusInternalServerError, 1001, "Failed to overwrite file")
+		}
+		ws.addUsedSize(realPath, -trash.Size)
+		ws.notify(fileEventDelete, realPath, "", info.IsDir())
+		return path, realPath, nil
+	case conflictSkip:
+		return path, realPath, errConflictSkipped
+	default:
+		return path, realPath, newFileOpError(http.StatusOK, 1001, "file is exist")
+	}
+}
+
+// deleteEntry 把文件或目录移到回收站，删除符号链接时只删除链接本身
+func (ws *WebServer) deleteEntry(userEntry db.UserEntry, path string) error {
+	if err := checkPermission(userEntry, actionDelete); err != nil {
+		return err
+	}
+	path, filePath, err := ws.resolveOpPath(userEntry, path, db.AclAccessWrite, false)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(filePath)
+	if os.IsNotExist(err) {
+		return newFileOpError(http.StatusNotFound, 10006, "File or directory not found")
+	}
+	trash, err := ws.moveToTrash(userEntry, path, filePath)
+	var opErr *FileOpError
+	if errors.As(err, &opErr) {
+		return err
+	}
+	if err != nil {
+		lib.Logger.Error("move to trash failed!", err)
+		return newFileOpError(http.StatusNotFound, 10006, "delete failed!")
+	}
+	ws.addUsedSize(filePath, -trash.Size)
+	ws.notify(fileEventDelete, filePath, "", info != nil && info.IsDir())
+	return nil
+}
+
+// renameEntry 重命名文件或目录，返回重命名后用户看到的路径
+func (ws *WebServer) renameEntry(userEntry db.UserEntry, path string, newName string, conflict string) (string, error) {
+	if err := checkPermission(userEntry, actionModify); err != nil {
+		return "", err
+	}
+	path, filePath, err := ws.resolveOpPath(userEntry, path, db.AclAccessWrite, false)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return "", errNotFound()
+	}
+	if newName == "" {
+		return "", newFileOpError(http.StatusBadRequest, 1001, "newName is empty")
+	}
+	newUserPath, succeed := joinPath(filepath.ToSlash(filepath.Dir(path)), newName)
+	newPath := filepath.Join(filepath.Dir(filePath), newName)
+	if !succeed || newPath == filePath {
+		return "", newFileOpError(http.StatusBadRequest, 1001, "newName is invalid")
+	}
+	newUserPath, newPath, err = ws.applyConflict(userEntry, conflict, newUserPath, newPath)
+	if err != nil {
+		return "", err
+	}
+	err = lib.MovePath(filePath, newPath)
+	if err != nil {
+		lib.Logger.Error("Rename failed!", err)
+		return "", newFileOpError(http.StatusInternalServerError, 1001, "Failed to rename file")
+	}
+	ws.notify(fileEventRename, newPath, filePath, info.IsDir())
+	return newUserPath, nil
+}
+
+// moveEntry 移动文件或目录，源和目标在不同的磁盘上时先复制再删除，返回移动后用户看到的路径
+func (ws *WebServer) moveEntry(userEntry db.UserEntry, path string, dest string, conflict string) (string, error) {
+	if err := checkPermission(userEntry, actionModify); err != nil {
+		return "", err
+	}
+	_, filePath, err := ws.resolveOpPath(userEntry, path, db.AclAccessWrite, false)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return "", errNotFound()
+	}
+	dest, dstPath, err := ws.resolveOpDest(userEntry, dest)
+	if err != nil {
+		return "", err
+	}
+	// 不能移动到自己的子目录中，覆盖时也不能把包含源文件的目录移到回收站
+	if isSubPath(filePath, dstPath) || isSubPath(dstPath, filePath) {
+		return "", newFileOpError(http.StatusBadRequest, 1001, "dstPath is invalid")
+	}
+	// 移动到其他用户的根目录下时，从源路径的用户的已使用空间转到目标路径的用户
+	removedUsers, addedUsers := ws.getMoveQuotaUsers(filePath, dstPath)
+	size := int64(0)
+	if len(removedUsers) > 0 || len(addedUsers) > 0 {
+		size = ws.getPathSize(filePath)
+		if info.Mode()&os.ModeSymlink != 0 {
+			size = info.Size()
+		}
+	}
+	if err := usersQuotaError(addedUsers, size); err != nil {
+		return "", err
+	}
+	dest, dstPath, err = ws.applyConflict(userEntry, conflict, dest, dstPath)
+	if err != nil {
+		return "", err
+	}
+	err = lib.MovePath(filePath, dstPath)
+	if err != nil {
+		lib.Logger.Error("Move failed!", err)
+		return "", newFileOpError(http.StatusInternalServerError, 1001, "Failed to move file")
+	}
+	for _, user := range removedUsers {
+		ws.Database.AddUserUsedSize(user.Id, -size)
+	}
+	for _, user := range addedUsers {
+		ws.Database.AddUserUsedSize(user.Id, size)
+	}
+	ws.notify(fileEventRename, dstPath, filePath, info.IsDir())
+	return dest, nil
+}
+
+// copyPlan 校验通过后待执行的复制操作
+type copyPlan struct {
+	SrcPath      string // 用户看到的源路径
+	DestPath     string // 用户看到的目标路径
+	SrcRealPath  string
+	DestRealPath string
+	Size         int64
+	IsDir        bool
+}
+
+// prepareCopy 校验复制操作并处理目标位置已存在的文件，复制只需要源文件的读取权限
+func (ws *WebServer) prepareCopy(userEntry db.UserEntry, path string, dest string, conflict string) (copyPlan, error) {
+	plan := copyPlan{}
+	if err := checkPermission(userEntry, actionModify); err != nil {
+		return plan, err
+	}
+	path, filePath, err := ws.resolveOpPath(userEntry, path, db.AclAccessRead, true)
+	if err != nil {
+		return plan, err
+	}
+	dest, dstPath, err := ws.resolveOpDest(userEntry, dest)
+	if err != nil {
+		return plan, err
+	}
+	// 不能把目录复制到它自己的子目录中
+	if isSubPath(filePath, dstPath) || isSubPath(dstPath, filePath) {
+		return plan, newFileOpError(http.StatusBadRequest, 1001, "dstPath is invalid")
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return plan, errNotFound()
+	}
+	size := ws.getPathSize(filePath)
+	if err := ws.quotaError(dstPath, size); err != nil {
+		return plan, err
+	}
+	dest, dstPath, err = ws.applyConflict(userEntry, conflict, dest, dstPath)
+	if err != nil {
+		return plan, err
+	}
+	return copyPlan{
+		SrcPath:      path,
+		DestPath:     dest,
+		SrcRealPath:  filePath,
+		DestRealPath: dstPath,
+		Size:         size,
+		IsDir:        info.IsDir(),
+	}, nil
+}
+
+// runCopy 执行复制，progress 不为空时更新进度，失败或取消时删除已复制的内容
+func (ws *WebServer) runCopy(plan copyPlan, progress *lib.CopyProgress) error {
+	var err error
+	if progress != nil {
+		err = lib.CopyPathWithProgress(plan.SrcRealPath, plan.DestRealPath, progress)
+	} else {
+		err = lib.CopyPath(plan.SrcRealPath, plan.DestRealPath)
+	}
+	if err != nil {
+		os.RemoveAll(plan.DestRealPath)
+		return err
+	}
+	ws.addUsedSize(plan.DestRealPath, plan.Size)
+	ws.notify(fileEventCreate, plan.DestRealPath, "", plan.IsDir)
+	return nil
+}
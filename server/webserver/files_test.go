@@ -0,0 +1,39 @@
+package webserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetAvailablePath(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "a (1).txt", "b", "c.tar.gz"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 指向不存在的文件的符号链接也算已存在
+	if err := os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"new.txt", "new.txt"},
+		{"a.txt", "a (2).txt"},
+		{"b", "b (1)"},
+		{"c.tar.gz", "c.tar (1).gz"},
+		{"d", "d (1)"},
+		{"link", "link (1)"},
+	}
+	for _, tt := range tests {
+		if got := getAvailablePath(filepath.Join(dir, tt.name)); got != filepath.Join(dir, tt.want) {
+			t.Errorf("getAvailablePath(%q) = %q, want %q", tt.name, filepath.Base(got), tt.want)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"myfileserver/lib"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"time"
 
@@ -23,6 +22,7 @@ type UploadFileEntry struct {
 	TempFilePath string
 	DestFilePath string
 	UserEntry    db.UserEntry
+	Precondition filePrecondition // 覆盖已有的文件时，上传完成后再次检查文件是否已经被修改
 }
 
 func (ws *WebServer) ReqUploadFile() gin.HandlerFunc {
@@ -31,8 +31,23 @@ func (ws *WebServer) ReqUploadFile() gin.HandlerFunc {
 		if !succeed {
 			return
 		}
-		loginUserInfo := getLoginUser(c)
-		path = filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path)
+		if !checkUserPermission(c, actionUpload) {
+			return
+		}
+		// 同名文件已存在时默认覆盖
+		conflict, succeed := getConflict(c, conflictOverwrite)
+		if !succeed {
+			return
+		}
+		userPath := path
+		path, succeed = ws.resolvePath(c, path, db.AclAccessWrite)
+		if !succeed {
+			return
+		}
+		// 接收文件前先按请求的大小检查配额
+		if !ws.checkQuota(c, path, c.Request.ContentLength) {
+			return
+		}
 		// 单文件上传
 		file, err := c.FormFile("file")
 		if err != nil {
@@ -40,29 +55,96 @@ func (ws *WebServer) ReqUploadFile() gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1000, "message": "upload error"})
 			return
 		}
+		if !ws.checkQuota(c, path, file.Size) {
+			return
+		}
 
-		destFilePath := filepath.Join(path, file.Filename)
-		destFilePath, err = filepath.Abs(destFilePath)
-		if err != nil {
-			lib.Logger.Error("upload error:", err)
+		destPath, succeed := joinPath(userPath, file.Filename)
+		if !succeed {
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "bad file path"})
 			return
 		}
+		destFilePath, succeed := ws.resolvePath(c, destPath, db.AclAccessWrite)
+		if !succeed {
+			return
+		}
+		// 要覆盖的文件已经被其他客户端修改时拒绝上传
+		precondition, succeed := getFilePrecondition(c)
+		if !succeed {
+			return
+		}
+		if err := precondition.check(destFilePath); err != nil {
+			writeFileOpError(c, err)
+			return
+		}
+		checkedPath := destFilePath
+		destPath, destFilePath, succeed = ws.resolveUploadConflict(c, conflict, destPath, destFilePath)
+		if !succeed {
+			return
+		}
+		// 按 conflict 改名后不会覆盖检查过的文件
+		if destFilePath != checkedPath {
+			precondition = filePrecondition{size: -1}
+		}
 
-		if err := c.SaveUploadedFile(file, destFilePath); err != nil {
+		// 先保存到同一目录下的临时文件，保存完成后再替换，上传失败时不影响原来的文件
+		suffix, _ := lib.GenerateRandomString(8)
+		tempPath := destFilePath + "." + suffix
+		if err := c.SaveUploadedFile(file, tempPath); err != nil {
+			os.Remove(tempPath)
 			lib.Logger.Error("SaveUploadedFile error:", err)
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1002, "message": "upload error"})
 			return
 		}
 		// 修改文件权限
-		if err := os.Chmod(destFilePath, 0644); err != nil {
+		if err := os.Chmod(tempPath, 0644); err != nil {
+			os.Remove(tempPath)
 			lib.Logger.Error("Chmod error:", err)
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1003, "message": "upload error"})
 			return
 		}
+		// 接收文件期间文件被其他客户端修改时放弃这次上传
+		if err := precondition.check(destFilePath); err != nil {
+			os.Remove(tempPath)
+			writeFileOpError(c, err)
+			return
+		}
+		// 覆盖已有的文件前保存原来的内容
+		loginUserInfo := getLoginUser(c)
+		existed := lib.IsExist(destFilePath)
+		replacedSize, err := ws.replaceFile(loginUserInfo.UserEntry, tempPath, destFilePath)
+		if err != nil {
+			lib.Logger.Error("replace file failed!", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "upload error"})
+			return
+		}
+		ws.addUsedSize(destFilePath, file.Size-replacedSize)
+		ws.notifyWrite(destFilePath, existed)
+
+		data := gin.H{"path": destPath}
+		// 返回上传后的 ETag，下次覆盖时作为 If-Match
+		if info, err := os.Stat(destFilePath); err == nil {
+			data["etag"] = fileETag(info)
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "upload success", "data": data})
+	}
+}
 
-		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "upload success"})
+// resolveUploadConflict 上传的目标位置已存在时按 conflict 处理
+// 覆盖时只能覆盖普通文件，需要修改文件的权限，原来的内容在上传完成后保存为历史版本；不会把目录等其他类型的文件移到回收站
+func (ws *WebServer) resolveUploadConflict(c *gin.Context, conflict string, path string, realPath string) (string, string, bool) {
+	info, err := os.Lstat(realPath)
+	if err != nil {
+		return path, realPath, true
+	}
+	if conflict != conflictOverwrite {
+		return ws.resolveConflict(c, conflict, path, realPath)
+	}
+	if !info.Mode().IsRegular() {
+		writeFileOpError(c, newFileOpError(http.StatusOK, 1001, "file is exist"))
+		return path, realPath, false
 	}
+	return path, realPath, checkUserPermission(c, actionModify)
 }
 
 func (ws *WebServer) ReqCreateFileChunk() gin.HandlerFunc {
@@ -75,6 +157,14 @@ func (ws *WebServer) ReqCreateFileChunk() gin.HandlerFunc {
 			})
 			return
 		}
+		if !checkUserPermission(c, actionUpload) {
+			return
+		}
+		// 同名文件已存在时默认覆盖
+		conflict, succeed := getConflict(c, conflictOverwrite)
+		if !succeed {
+			return
+		}
 		req := lib.FileEntry{}
 		err := c.ShouldBindJSON(&req)
 		if err != nil {
@@ -84,6 +174,50 @@ func (ws *WebServer) ReqCreateFileChunk() gin.HandlerFunc {
 			})
 			return
 		}
+		dirPath, succeed := ws.resolvePath(c, path, db.AclAccessWrite)
+		if !succeed {
+			return
+		}
+		if req.Size < 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "size is invalid",
+			})
+			return
+		}
+		if !ws.checkQuota(c, dirPath, req.Size) {
+			return
+		}
+		destPath, succeed := joinPath(path, req.Name)
+		if !succeed {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "name is invalid",
+			})
+			return
+		}
+		destFilePath, succeed := ws.resolvePath(c, destPath, db.AclAccessWrite)
+		if !succeed {
+			return
+		}
+		// 要覆盖的文件已经被其他客户端修改时拒绝上传
+		precondition, succeed := getFilePrecondition(c)
+		if !succeed {
+			return
+		}
+		if err := precondition.check(destFilePath); err != nil {
+			writeFileOpError(c, err)
+			return
+		}
+		checkedPath := destFilePath
+		destPath, destFilePath, succeed = ws.resolveUploadConflict(c, conflict, destPath, destFilePath)
+		if !succeed {
+			return
+		}
+		// 按 conflict 改名后不会覆盖检查过的文件
+		if destFilePath != checkedPath {
+			precondition = filePrecondition{size: -1}
+		}
 		loginUserInfo := getLoginUser(c)
 		uploadTaskId, _ := lib.GenerateRandomString(16)
 		count := 32
@@ -94,8 +228,9 @@ func (ws *WebServer) ReqCreateFileChunk() gin.HandlerFunc {
 			TotalSize:    uint64(req.Size),
 			Finished:     false,
 			FileEntry:    req,
-			DestFilePath: filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path, req.Name),
+			DestFilePath: destFilePath,
 			UserEntry:    loginUserInfo.UserEntry,
+			Precondition: precondition,
 		}
 		GetInstance().Lock.Lock()
 		for i := 0; i < count; i++ {
@@ -136,6 +271,7 @@ func (ws *WebServer) ReqCreateFileChunk() gin.HandlerFunc {
 			"message": "创建上传任务成功",
 			"data": gin.H{
 				"upload_task_id": uploadTaskId,
+				"path":           destPath,
 			},
 		})
 	}
@@ -189,6 +325,14 @@ func (ws *WebServer) ReqUploadFileChunk() gin.HandlerFunc {
 			})
 			return
 		}
+		// 配额是按创建任务时的文件大小检查的，不允许写入超过该大小的数据
+		if position < 0 || uint64(position)+uint64(len(data)) > uploadFileEntry.TotalSize {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "上传文件大小超过限制",
+			})
+			return
+		}
 		//lib.Logger.Error("接收上传任务158...", uploadTaskId, "position", position, "data_len", len(data))
 		_, err = file.WriteAt(data, position)
 		if err != nil {
@@ -221,22 +365,37 @@ func (ws *WebServer) ReqUploadFileChunk() gin.HandlerFunc {
 			GetInstance().Lock.Lock()
 			GetInstance().UploadTask[uploadTaskId] = uploadFileEntry
 			GetInstance().Lock.Unlock()
-			// 上传完成，移动文件
-			err = os.Rename(uploadFileEntry.TempFilePath, uploadFileEntry.DestFilePath)
+			// 上传期间文件被其他客户端修改时放弃这次上传
+			if err := uploadFileEntry.Precondition.check(uploadFileEntry.DestFilePath); err != nil {
+				os.Remove(uploadFileEntry.TempFilePath)
+				GetInstance().Lock.Lock()
+				delete(GetInstance().UploadTask, uploadTaskId)
+				GetInstance().Lock.Unlock()
+				writeFileOpError(c, err)
+				return
+			}
+			// 修改文件权限
+			if err := os.Chmod(uploadFileEntry.TempFilePath, 0644); err != nil {
+				lib.Logger.Error("Chmod error:", err)
+				c.JSON(http.StatusBadRequest, gin.H{"code": 1003, "message": "change file permission failed"})
+				return
+			}
+			// 上传完成，覆盖已有的文件前保存原来的内容，再移动文件
+			existed := lib.IsExist(uploadFileEntry.DestFilePath)
+			replacedSize, err := ws.replaceFile(uploadFileEntry.UserEntry, uploadFileEntry.TempFilePath, uploadFileEntry.DestFilePath)
 			if err != nil {
 				lib.Logger.Error("Rename error:", err)
+				GetInstance().Lock.Lock()
+				delete(GetInstance().UploadTask, uploadTaskId)
+				GetInstance().Lock.Unlock()
 				c.JSON(http.StatusOK, gin.H{
 					"code":    1000,
 					"message": err.Error(),
 				})
 				return
 			}
-			// 修改文件权限
-			if err := os.Chmod(uploadFileEntry.DestFilePath, 0644); err != nil {
-				lib.Logger.Error("Chmod error:", err)
-				c.JSON(http.StatusBadRequest, gin.H{"code": 1003, "message": "change file permission failed"})
-				return
-			}
+			ws.addUsedSize(uploadFileEntry.DestFilePath, int64(uploadFileEntry.TotalSize)-replacedSize)
+			ws.notifyWrite(uploadFileEntry.DestFilePath, existed)
 			ws.Database.AddUserHistory(db.UserHistoryEntry{
 				UserId:   uploadFileEntry.UserEntry.Id,
 				UserName: uploadFileEntry.UserEntry.Name,
@@ -252,13 +411,20 @@ func (ws *WebServer) ReqUploadFileChunk() gin.HandlerFunc {
 		GetInstance().Lock.Lock()
 		GetInstance().UploadTask[uploadTaskId] = uploadFileEntry
 		GetInstance().Lock.Unlock()
+		result := gin.H{
+			"finish_size": uploadFileEntry.FinishSize,
+			"total_size":  uploadFileEntry.TotalSize,
+		}
+		// 上传完成时返回文件的 ETag，下次覆盖时作为 If-Match
+		if uploadFileEntry.Finished {
+			if info, err := os.Stat(uploadFileEntry.DestFilePath); err == nil {
+				result["etag"] = fileETag(info)
+			}
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"code":    0,
 			"message": "上传成功",
-			"data": gin.H{
-				"finish_size": uploadFileEntry.FinishSize,
-				"total_size":  uploadFileEntry.TotalSize,
-			},
+			"data":    result,
 		})
 	}
 }
@@ -0,0 +1,313 @@
+package webserver
+
+import (
+	"errors"
+	"myfileserver/db"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkGroupEntry 校验并整理用户组的配置
+func checkGroupEntry(group *db.GroupEntry) error {
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		return errors.New("name is empty")
+	}
+	if strings.Contains(group.RootTemplate, "..") {
+		return errors.New("root_template is invalid")
+	}
+	if group.Quota < 0 {
+		return errors.New("quota is invalid")
+	}
+	permissions, err := normalizePermissions(group.Permissions)
+	if err != nil {
+		return err
+	}
+	group.Permissions = permissions
+	return nil
+}
+
+// checkSharedGroup 分享限定了用户组时，只有登录的组成员、分享者和管理员可以访问
+func checkSharedGroup(c *gin.Context, sharedEntry db.SharedEntry) bool {
+	if sharedEntry.GroupId == 0 {
+		return true
+	}
+	userInfo, ok := authenticate(c)
+	if !ok || !checkApiTokenScope(c, userInfo, false) {
+		return false
+	}
+	return userInfo.UserEntry.IsAdmin ||
+		userInfo.UserEntry.Id == sharedEntry.UserId ||
+		GetInstance().Database.IsGroupMember(sharedEntry.GroupId, userInfo.UserEntry.Id)
+}
+
+// getQueryInt64 获取整数类型的参数，参数错误时返回错误
+func getQueryInt64(c *gin.Context, key string) (int64, bool) {
+	val, err := strconv.ParseInt(c.Query(key), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    1000,
+			"message": key + " is invalid",
+		})
+		return 0, false
+	}
+	return val, true
+}
+
+func (ws *WebServer) ReqGetGroupList() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groups, err := ws.Database.GetGroups()
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    groups,
+		})
+	}
+}
+
+func (ws *WebServer) ReqCreateGroup() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		group := db.GroupEntry{}
+		err := c.ShouldBindJSON(&group)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		err = checkGroupEntry(&group)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		group.Id, err = ws.Database.AddGroup(group)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		loginUserInfo := getLoginUser(c)
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "create_group",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"group_id":   strconv.FormatInt(group.Id, 10),
+				"group_name": group.Name,
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "create group succeed",
+			"data":    group.Id,
+		})
+	}
+}
+
+// ReqUpdateGroup 修改用户组的配置，已有的用户不受影响
+func (ws *WebServer) ReqUpdateGroup() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		group := db.GroupEntry{}
+		err := c.ShouldBindJSON(&group)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		_, err = ws.Database.GetGroup(group.Id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "group not found",
+			})
+			return
+		}
+		err = checkGroupEntry(&group)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		err = ws.Database.UpdateGroup(group)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		loginUserInfo := getLoginUser(c)
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "update_group",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"group_id":   strconv.FormatInt(group.Id, 10),
+				"group_name": group.Name,
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "update group succeed",
+		})
+	}
+}
+
+// ReqDeleteGroup 删除用户组，同时删除成员关系和授权给该用户组的访问权限
+func (ws *WebServer) ReqDeleteGroup() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		group_id, ok := getQueryInt64(c, "group_id")
+		if !ok {
+			return
+		}
+		group, err := ws.Database.GetGroup(group_id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "group not found",
+			})
+			return
+		}
+		err = ws.Database.DeleteGroup(group_id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		ws.Database.DeleteGroupAcls(group_id)
+
+		loginUserInfo := getLoginUser(c)
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "delete_group",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"group_id":   strconv.FormatInt(group.Id, 10),
+				"group_name": group.Name,
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "delete group succeed",
+		})
+	}
+}
+
+// ReqAddGroupMember 把用户加入用户组，参数为 group_id 和 user_id
+func (ws *WebServer) ReqAddGroupMember() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		group_id, ok := getQueryInt64(c, "group_id")
+		if !ok {
+			return
+		}
+		user_id, ok := getQueryInt64(c, "user_id")
+		if !ok {
+			return
+		}
+		_, err := ws.Database.GetGroup(group_id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "group not found",
+			})
+			return
+		}
+		_, err = ws.Database.GetUserById(user_id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "user not found",
+			})
+			return
+		}
+		err = ws.Database.AddGroupMember(group_id, user_id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		loginUserInfo := getLoginUser(c)
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "add_group_member",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"group_id": strconv.FormatInt(group_id, 10),
+				"user_id":  strconv.FormatInt(user_id, 10),
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "add group member succeed",
+		})
+	}
+}
+
+// ReqDeleteGroupMember 把用户移出用户组，参数为 group_id 和 user_id
+func (ws *WebServer) ReqDeleteGroupMember() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		group_id, ok := getQueryInt64(c, "group_id")
+		if !ok {
+			return
+		}
+		user_id, ok := getQueryInt64(c, "user_id")
+		if !ok {
+			return
+		}
+		err := ws.Database.DeleteGroupMember(group_id, user_id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		loginUserInfo := getLoginUser(c)
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "delete_group_member",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"group_id": strconv.FormatInt(group_id, 10),
+				"user_id":  strconv.FormatInt(user_id, 10),
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "delete group member succeed",
+		})
+	}
+}
@@ -0,0 +1,573 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文件索引
+// 启动时遍历服务根目录，把所有文件的路径、大小、修改时间、权限和内容的 sha256 保存到 FileIndex 表
+// 之后通过 inotify 监视目录的变化，只重新扫描发生变化的目录，另外定时完整扫描一次，弥补漏掉的事件
+// 索引建立完成后，搜索、最近修改、最大的文件和目录大小都从索引中查询，不再遍历目录
+
+const (
+	// 只计算不超过该大小的文件的 sha256
+	indexMaxHashSize = 16 * 1024 * 1024
+	// 收到事件后等待一段时间再扫描，合并连续的修改
+	indexDebounce       = 2 * time.Second
+	indexRescanInterval = time.Hour
+	indexDefaultLimit   = 50
+	indexMaxLimit       = 1000
+	// 搜索时每次从索引中读取的文件数
+	indexSearchPageSize = 500
+)
+
+type FileIndexer struct {
+	ws         *WebServer
+	watcher    *lib.Watcher
+	rescan     chan struct{}
+	lock       sync.Mutex
+	ready      bool // 第一次完整扫描已完成
+	scanning   bool
+	lastScan   time.Time
+	watchError string
+}
+
+type FileIndexStatusEntry struct {
+	Ready        bool   `json:"ready"`
+	Scanning     bool   `json:"scanning"`
+	Watching     bool   `json:"watching"`
+	WatchCount   int    `json:"watch_count"`
+	WatchError   string `json:"watch_error"`
+	FileCount    int64  `json:"file_count"`
+	LastScanTime string `json:"last_scan_time"`
+}
+
+// indexScope 从索引中查询的一个目录，userPath 为用户看到的路径，skipNames 为被挂载的目录覆盖的名称
+type indexScope struct {
+	prefix    string
+	userPath  string
+	skipNames map[string]bool
+}
+
+// StartIndexer 在后台建立并维护文件索引
+func (ws *WebServer) StartIndexer() {
+	ws.Indexer = &FileIndexer{
+		ws:     ws,
+		rescan: make(chan struct{}, 1),
+	}
+	go ws.Indexer.run()
+}
+
+func (idx *FileIndexer) run() {
+	watcher, err := lib.NewWatcher()
+	if err != nil {
+		lib.Logger.Error("FileIndexer: create watcher failed, only rescan periodically!", err)
+		idx.lock.Lock()
+		idx.watchError = err.Error()
+		idx.lock.Unlock()
+	} else {
+		idx.watcher = watcher
+	}
+	idx.fullScan()
+
+	ticker := time.NewTicker(indexRescanInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(indexDebounce)
+	timer.Stop()
+	var events <-chan string
+	if idx.watcher != nil {
+		events = idx.watcher.Events
+	}
+	dirty := make(map[string]bool)
+	overflow := false
+	for {
+		select {
+		case path, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			// 第一个事件开始计时，期间的事件一起处理
+			if len(dirty) == 0 && !overflow {
+				timer.Reset(indexDebounce)
+			}
+			if path == "" {
+				overflow = true
+			} else {
+				dirty[path] = true
+			}
+		case <-timer.C:
+			if overflow {
+				idx.fullScan()
+			} else {
+				for path := range dirty {
+					idx.scanDir(path, false, true)
+				}
+			}
+			clear(dirty)
+			overflow = false
+		case <-ticker.C:
+			idx.fullScan()
+		case <-idx.rescan:
+			idx.fullScan()
+		}
+	}
+}
+
+func (idx *FileIndexer) fullScan() {
+	idx.lock.Lock()
+	idx.scanning = true
+	idx.lock.Unlock()
+	start := time.Now()
+	idx.scanDir(idx.ws.RootDir, true, true)
+	lib.Logger.Info("FileIndexer: scan finished, cost ", time.Since(start))
+	idx.lock.Lock()
+	idx.scanning = false
+	idx.ready = true
+	idx.lastScan = time.Now()
+	idx.lock.Unlock()
+}
+
+// excluded 临时文件夹在服务根目录下时不建立索引
+func (idx *FileIndexer) excluded(realPath string) bool {
+	return idx.ws.TempDir != "" && isSubPath(idx.ws.TempDir, realPath)
+}
+
+func (idx *FileIndexer) watch(realDir string) {
+	if idx.watcher == nil {
+		return
+	}
+	err := idx.watcher.Add(realDir)
+	if err == nil {
+		return
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	// 只记录第一次失败，超过监视数量限制的目录依靠定时扫描更新
+	if idx.watchError == "" {
+		lib.Logger.Error("FileIndexer: watch directory failed!", realDir, err)
+		idx.watchError = err.Error()
+	}
+}
+
+func indexJoin(parent string, name string) string {
+	if parent == "/" {
+		return "/" + name
+	}
+	return parent + "/" + name
+}
+
+func hashFile(realPath string) string {
+	f, err := os.Open(realPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// scanDir 扫描目录，保存新增和变化的文件，删除已经不存在的文件
+// recursive 为 true 时扫描所有子目录，否则只扫描新出现的子目录
+// notify 为 true 时通知发现的变化，新出现的目录只通知目录本身
+func (idx *FileIndexer) scanDir(realDir string, recursive bool, notify bool) {
+	if idx.excluded(realDir) {
+		return
+	}
+	entries, err := os.ReadDir(realDir)
+	if err != nil {
+		return
+	}
+	idx.watch(realDir)
+	idx.lock.Lock()
+	notify = notify && idx.ready
+	idx.lock.Unlock()
+	parent := idx.ws.toServerPath(realDir)
+	children, err := idx.ws.Database.GetFileIndexChildren(parent)
+	if err != nil {
+		return
+	}
+	old := make(map[string]db.FileIndexEntry)
+	for _, child := range children {
+		old[child.Name] = child
+	}
+
+	updates := []db.FileIndexEntry{}
+	removed := []string{}
+	subDirs := []string{}
+	newDirs := []string{}
+	events := []FileEvent{}
+	for _, entry := range entries {
+		realPath := filepath.Join(realDir, entry.Name())
+		if idx.excluded(realPath) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		prev, exist := old[entry.Name()]
+		delete(old, entry.Name())
+		if info.IsDir() && exist && prev.IsDir && recursive {
+			subDirs = append(subDirs, realPath)
+		} else if info.IsDir() && (!exist || !prev.IsDir) {
+			newDirs = append(newDirs, realPath)
+		}
+		if exist && prev.Size == info.Size() && prev.MTime == info.ModTime().UnixNano() &&
+			prev.Mode == uint32(info.Mode()) && prev.IsDir == info.IsDir() {
+			continue
+		}
+		// 目录变成了文件时删除原来目录下的索引
+		if exist && prev.IsDir && !info.IsDir() {
+			removed = append(removed, prev.Path)
+			if idx.watcher != nil {
+				idx.watcher.RemoveAll(realPath)
+			}
+		}
+		fileEntry := db.FileIndexEntry{
+			Path:       indexJoin(parent, entry.Name()),
+			Parent:     parent,
+			Name:       entry.Name(),
+			Size:       info.Size(),
+			Mode:       uint32(info.Mode()),
+			IsDir:      info.IsDir(),
+			CreatedAt:  lib.GetFileCreateTime(info).Format(time.DateTime),
+			ModifiedAt: info.ModTime().Format(time.DateTime),
+			MTime:      info.ModTime().UnixNano(),
+		}
+		if info.Mode().IsRegular() && info.Size() <= indexMaxHashSize {
+			fileEntry.Hash = hashFile(realPath)
+		}
+		updates = append(updates, fileEntry)
+		// 目录的修改时间随下面的文件变化，只通知新出现的目录
+		if !exist {
+			events = append(events, FileEvent{Type: fileEventCreate, RealPath: realPath, IsDir: info.IsDir()})
+		} else if !info.IsDir() {
+			events = append(events, FileEvent{Type: fileEventModify, RealPath: realPath})
+		}
+	}
+	for name, child := range old {
+		removed = append(removed, child.Path)
+		if child.IsDir && idx.watcher != nil {
+			idx.watcher.RemoveAll(filepath.Join(realDir, name))
+		}
+		events = append(events, FileEvent{Type: fileEventDelete, RealPath: filepath.Join(realDir, name), IsDir: child.IsDir})
+	}
+	if len(updates) > 0 || len(removed) > 0 {
+		if err := idx.ws.Database.UpdateFileIndexes(updates, removed); err != nil {
+			return
+		}
+	}
+	if notify {
+		for _, event := range events {
+			event.Time = time.Now()
+			idx.ws.Notifier.publish(event, true)
+		}
+	}
+	for _, subDir := range subDirs {
+		idx.scanDir(subDir, recursive, notify)
+	}
+	for _, newDir := range newDirs {
+		idx.scanDir(newDir, true, false)
+	}
+}
+
+// serverPath 返回服务器上的路径在索引中的路径，索引还没有建立或路径不在服务根目录下时返回 false
+func (idx *FileIndexer) serverPath(realPath string) (string, bool) {
+	if idx == nil {
+		return "", false
+	}
+	idx.lock.Lock()
+	ready := idx.ready
+	idx.lock.Unlock()
+	if !ready || !isSubPath(idx.ws.RootDir, realPath) || idx.excluded(realPath) {
+		return "", false
+	}
+	return idx.ws.toServerPath(realPath), true
+}
+
+// dirSize 从索引中统计目录下的目录数、文件数和文件的总大小，无法使用索引时返回 false
+func (idx *FileIndexer) dirSize(realPath string, hideDotFiles bool) (uint64, uint64, int64, bool) {
+	prefix, ok := idx.serverPath(realPath)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	dirCount, fileCount, size, err := idx.ws.Database.GetFileIndexDirSize(prefix, hideDotFiles)
+	return dirCount, fileCount, size, err == nil
+}
+
+// indexUserPath 把索引中的路径转换成用户看到的路径，同时返回第一级的名称
+func indexUserPath(scope indexScope, path string) (string, string) {
+	rel := path
+	if scope.prefix != "/" {
+		rel = strings.TrimPrefix(path, scope.prefix)
+	}
+	first, _, _ := strings.Cut(strings.TrimPrefix(rel, "/"), "/")
+	return scope.userPath + rel, first
+}
+
+func newIndexResult(userPath string, entry db.FileIndexEntry) SearchResult {
+	return SearchResult{
+		FileEntry: lib.FileEntry{
+			Host:       runtime.GOOS,
+			Name:       entry.Name,
+			Size:       entry.Size,
+			FileMode:   entry.Mode,
+			IsDir:      entry.IsDir,
+			CreatedAt:  entry.CreatedAt,
+			ModifiedAt: entry.ModifiedAt,
+		},
+		Path: userPath,
+		Hash: entry.Hash,
+	}
+}
+
+// getIndexScopes 获取用户的目录对应的索引范围，在用户的根目录下时包括挂载的目录
+func (ws *WebServer) getIndexScopes(userEntry db.UserEntry, path string, realPath string) ([]indexScope, bool) {
+	scopes := []indexScope{}
+	var skipNames map[string]bool
+	if path == "" {
+		skipNames = make(map[string]bool)
+		for _, mount := range ws.getUserMounts(userEntry) {
+			skipNames[mount.MountName] = true
+			mountPath := filepath.Join(ws.RootDir, mount.Path)
+			prefix, ok := ws.Indexer.serverPath(mountPath)
+			if !ok {
+				return nil, false
+			}
+			scopes = append(scopes, indexScope{prefix: prefix, userPath: "/" + mount.MountName})
+		}
+	}
+	prefix, ok := ws.Indexer.serverPath(realPath)
+	if !ok {
+		return nil, false
+	}
+	scopes = append(scopes, indexScope{prefix: prefix, userPath: path, skipNames: skipNames})
+	return scopes, true
+}
+
+// searchIndex 在索引中按文件名、类型、大小和修改时间搜索，内容只在符合条件的文件中搜索
+// 返回 false 时已经找到足够的结果或请求已结束
+func (s *searcher) searchIndex(database *db.Database, scope indexScope) bool {
+	query := db.FileIndexQuery{
+		Prefix:       scope.prefix,
+		Exts:         s.exts,
+		MinSize:      s.minSize,
+		MaxSize:      s.maxSize,
+		HideDotFiles: s.hideDotFiles,
+	}
+	if s.glob {
+		query.Glob = s.name
+	} else {
+		query.Name = s.name
+	}
+	if s.fileType != "" {
+		isDir := s.fileType == "dir"
+		query.IsDir = &isDir
+	}
+	if !s.after.IsZero() {
+		query.ModifiedAfter = s.after.Format(time.DateTime)
+	}
+	if !s.before.IsZero() {
+		query.ModifiedBefore = s.before.Format(time.DateTime)
+	}
+	// 按路径分页查询，每页查询完关闭数据库游标后再搜索文件内容，避免搜索期间一直占用数据库
+	query.Limit = indexSearchPageSize
+	for {
+		entries := []db.FileIndexEntry{}
+		err := database.QueryFileIndexes(query, func(entry db.FileIndexEntry) bool {
+			entries = append(entries, entry)
+			return true
+		})
+		if err != nil {
+			return true
+		}
+		for _, entry := range entries {
+			if s.ctx.Err() != nil {
+				return false
+			}
+			userPath, first := indexUserPath(scope, entry.Path)
+			if scope.skipNames[first] {
+				continue
+			}
+			result := newIndexResult(userPath, entry)
+			if s.content != nil {
+				realPath := filepath.Join(s.root, filepath.FromSlash(entry.Path))
+				info, err := os.Lstat(realPath)
+				if err != nil {
+					continue
+				}
+				result.Matches = s.matchContent(realPath, info)
+				if len(result.Matches) == 0 {
+					continue
+				}
+			}
+			if !s.add(result) {
+				return false
+			}
+		}
+		if len(entries) < indexSearchPageSize {
+			return true
+		}
+		query.After = entries[len(entries)-1].Path
+	}
+}
+
+// searchDir 搜索目录，建立索引后从索引中查询，否则遍历目录
+func (s *searcher) searchDir(ws *WebServer, userEntry db.UserEntry, userDir string, realDir string, base string, skipNames map[string]bool) bool {
+	s.allowSymlink = ws.symlinkChecker(base, &userEntry)
+	if prefix, ok := ws.Indexer.serverPath(realDir); ok {
+		return s.searchIndex(&ws.Database, indexScope{prefix: prefix, userPath: userDir, skipNames: skipNames})
+	}
+	return s.walk(userDir, realDir, skipNames)
+}
+
+// queryIndexFiles 按 orderBy 从索引中查询用户的目录下的文件，参数 path 为开始查询的目录，limit 为返回的文件数
+func (ws *WebServer) queryIndexFiles(c *gin.Context, orderBy string) {
+	path, succeed := getPath(c)
+	if !succeed {
+		return
+	}
+	realPath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+	if !succeed {
+		return
+	}
+	limit, succeed := getQueryInt64Default(c, "limit", indexDefaultLimit)
+	if !succeed {
+		return
+	}
+	if limit < 1 || limit > indexMaxLimit {
+		c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "limit is invalid"})
+		return
+	}
+	loginUserInfo := getLoginUser(c)
+	scopes, ok := ws.getIndexScopes(loginUserInfo.UserEntry, path, realPath)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "file index is not ready"})
+		return
+	}
+	isDir := false
+	files := []SearchResult{}
+	for _, scope := range scopes {
+		count := 0
+		err := ws.Database.QueryFileIndexes(db.FileIndexQuery{
+			Prefix:       scope.prefix,
+			IsDir:        &isDir,
+			MinSize:      -1,
+			MaxSize:      -1,
+			HideDotFiles: !loginUserInfo.UserEntry.ShowDotFiles,
+			OrderBy:      orderBy,
+		}, func(entry db.FileIndexEntry) bool {
+			userPath, first := indexUserPath(scope, entry.Path)
+			if scope.skipNames[first] {
+				return true
+			}
+			files = append(files, newIndexResult(userPath, entry))
+			count++
+			return count < int(limit)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 1000, "message": "query file index failed"})
+			return
+		}
+	}
+	// 合并多个目录的结果
+	sort.SliceStable(files, func(i, j int) bool {
+		if orderBy == "size" {
+			return files[i].Size > files[j].Size
+		}
+		return files[i].ModifiedAt > files[j].ModifiedAt
+	})
+	if len(files) > int(limit) {
+		files = files[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    0,
+		"message": "success",
+		"data": gin.H{
+			"files": files,
+		},
+	})
+}
+
+// ReqGetRecentFiles 最近修改的文件，按修改时间从新到旧排序
+func (ws *WebServer) ReqGetRecentFiles() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ws.queryIndexFiles(c, "modified_at")
+	}
+}
+
+// ReqGetLargestFiles 最大的文件，按大小从大到小排序
+func (ws *WebServer) ReqGetLargestFiles() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ws.queryIndexFiles(c, "size")
+	}
+}
+
+// ReqGetIndexStatus 查询文件索引的状态
+func (ws *WebServer) ReqGetIndexStatus() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idx := ws.Indexer
+		if idx == nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "file index is not started"})
+			return
+		}
+		count, _ := ws.Database.GetFileIndexCount()
+		idx.lock.Lock()
+		status := FileIndexStatusEntry{
+			Ready:      idx.ready,
+			Scanning:   idx.scanning,
+			Watching:   idx.watcher != nil,
+			WatchError: idx.watchError,
+			FileCount:  count,
+		}
+		if !idx.lastScan.IsZero() {
+			status.LastScanTime = idx.lastScan.Format(time.DateTime)
+		}
+		idx.lock.Unlock()
+		if idx.watcher != nil {
+			status.WatchCount = idx.watcher.Count()
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "success", "data": status})
+	}
+}
+
+// ReqRescanIndex 立即完整扫描一次，正在扫描时扫描结束后再扫描一次
+func (ws *WebServer) ReqRescanIndex() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ws.Indexer == nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "file index is not started"})
+			return
+		}
+		select {
+		case ws.Indexer.rescan <- struct{}{}:
+		default:
+		}
+		loginUserInfo := getLoginUser(c)
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:      loginUserInfo.UserEntry.Id,
+			UserName:    loginUserInfo.UserEntry.Name,
+			Action:      "rescan_index",
+			Information: ws.getRequestInfo(c, map[string]string{}),
+			Ip:          c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "rescan started"})
+	}
+}
@@ -0,0 +1,178 @@
+package webserver
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 登录和分享码的防暴力破解策略
+// 每次失败后需要等待的时间按指数增长，连续失败次数达到上限后锁定一段时间
+const (
+	attemptBaseDelay     = 1 * time.Second  // 第一次失败后需要等待的时间
+	attemptMaxDelay      = 5 * time.Minute  // 指数退避的最长等待时间
+	attemptLockout       = 15 * time.Minute // 达到失败次数上限后锁定的时间
+	attemptResetAfter    = 1 * time.Hour    // 超过该时间没有失败，清除失败记录
+	maxUserFailures      = 5                // 同一个 IP 对同一个用户名允许连续失败的次数
+	maxAccountFailures   = 30               // 同一个用户名在所有 IP 上允许连续失败的次数，限制更换 IP 的尝试
+	maxIpFailures        = 20               // 同一个 IP 允许连续失败的次数
+	maxSharedCodeFailure = 10               // 同一个分享允许连续输错分享码的次数
+)
+
+type LoginAttempt struct {
+	Key         string    `json:"key"`          // 限制的对象，如 ip:127.0.0.1、user:admin@127.0.0.1、account:admin、shared:sid
+	Failures    int       `json:"failures"`     // 连续失败的次数
+	LastFailure time.Time `json:"last_failure"` // 最后一次失败的时间
+	LockedUntil time.Time `json:"locked_until"` // 在此时间之前拒绝尝试
+	MaxFailures int       `json:"max_failures"` // 允许连续失败的次数
+}
+
+func attemptIpKey(ip string) string {
+	return "ip:" + ip
+}
+
+// attemptUserKey 按用户名和 IP 一起限制，其他 IP 的错误密码不会锁定用户的登录
+func attemptUserKey(username string, ip string) string {
+	return "user:" + username + "@" + ip
+}
+
+// attemptAccountKey 按用户名限制，不区分 IP，允许的失败次数比 attemptUserKey 多，
+// 正常用户在自己的 IP 上被锁定之前，不会因为其他 IP 的尝试被锁定
+func attemptAccountKey(username string) string {
+	return "account:" + username
+}
+
+// attemptLoginKeys 密码登录检查和记录失败使用的限制对象
+func attemptLoginKeys(c *gin.Context, username string) []string {
+	return []string{attemptIpKey(c.ClientIP()), attemptUserKey(username, c.ClientIP()), attemptAccountKey(username)}
+}
+
+func attemptSharedIpKey(ip string) string {
+	return "shared_ip:" + ip
+}
+
+func attemptSharedKey(sid string) string {
+	return "shared:" + sid
+}
+
+// checkAttempt 检查是否允许再次尝试，不允许时返回需要等待的时间
+func checkAttempt(keys ...string) (time.Duration, bool) {
+	GetInstance().Lock.Lock()
+	defer GetInstance().Lock.Unlock()
+	wait := time.Duration(0)
+	for _, key := range keys {
+		attempt, exist := GetInstance().LoginAttempts[key]
+		if !exist {
+			continue
+		}
+		remain := time.Until(attempt.LockedUntil)
+		if remain > wait {
+			wait = remain
+		}
+	}
+	return wait, wait <= 0
+}
+
+// recordAttemptFailure 记录一次失败，key 与允许连续失败的次数一一对应
+func recordAttemptFailure(keys []string, maxFailures []int) {
+	GetInstance().Lock.Lock()
+	defer GetInstance().Lock.Unlock()
+	now := time.Now()
+	for i, key := range keys {
+		attempt, exist := GetInstance().LoginAttempts[key]
+		if !exist || now.Sub(attempt.LastFailure) > attemptResetAfter {
+			attempt = &LoginAttempt{
+				Key:         key,
+				MaxFailures: maxFailures[i],
+			}
+			GetInstance().LoginAttempts[key] = attempt
+		}
+		attempt.Failures++
+		attempt.LastFailure = now
+		if attempt.Failures >= attempt.MaxFailures {
+			attempt.LockedUntil = now.Add(attemptLockout)
+			continue
+		}
+		delay := attemptBaseDelay << (attempt.Failures - 1)
+		if delay > attemptMaxDelay {
+			delay = attemptMaxDelay
+		}
+		attempt.LockedUntil = now.Add(delay)
+	}
+}
+
+// recordSharedCodeFailure 记录一次分享ID或分享码错误
+func recordSharedCodeFailure(c *gin.Context, sid string) {
+	recordAttemptFailure(
+		[]string{attemptSharedIpKey(c.ClientIP()), attemptSharedKey(sid)},
+		[]int{maxIpFailures, maxSharedCodeFailure})
+}
+
+// clearAttempt 验证成功后清除失败记录
+func clearAttempt(keys ...string) {
+	GetInstance().Lock.Lock()
+	defer GetInstance().Lock.Unlock()
+	for _, key := range keys {
+		delete(GetInstance().LoginAttempts, key)
+	}
+}
+
+// CleanLoginAttempts 清理已经过期的失败记录
+func CleanLoginAttempts() {
+	GetInstance().Lock.Lock()
+	defer GetInstance().Lock.Unlock()
+	for key, attempt := range GetInstance().LoginAttempts {
+		if time.Since(attempt.LastFailure) > attemptResetAfter && time.Now().After(attempt.LockedUntil) {
+			delete(GetInstance().LoginAttempts, key)
+		}
+	}
+}
+
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1004,
+		"message": "尝试次数过多，请稍后再试",
+		"data": gin.H{
+			"retry_after": int64(wait.Seconds()) + 1,
+		},
+	})
+}
+
+func (ws *WebServer) ReqGetLockouts() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		GetInstance().Lock.Lock()
+		attempts := []LoginAttempt{}
+		for _, attempt := range GetInstance().LoginAttempts {
+			attempts = append(attempts, *attempt)
+		}
+		GetInstance().Lock.Unlock()
+		sort.Slice(attempts, func(i, j int) bool {
+			return attempts[i].LastFailure.After(attempts[j].LastFailure)
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    attempts,
+		})
+	}
+}
+
+// ReqDeleteLockouts 解除锁定，参数 key 为空时清除所有记录
+func (ws *WebServer) ReqDeleteLockouts() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Query("key")
+		GetInstance().Lock.Lock()
+		if key == "" {
+			GetInstance().LoginAttempts = make(map[string]*LoginAttempt)
+		} else {
+			delete(GetInstance().LoginAttempts, key)
+		}
+		GetInstance().Lock.Unlock()
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "clear lockouts succeed",
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loginContext 生成来自 ip 的请求，X-Forwarded-For 由客户端随意填写，和 main.go 一样不信任任何代理
+func loginContext(ip string, forwardedFor string) *gin.Context {
+	c, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.SetTrustedProxies(nil)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/login", nil)
+	c.Request.RemoteAddr = ip + ":12345"
+	c.Request.Header.Set("X-Forwarded-For", forwardedFor)
+	return c
+}
+
+func resetLoginAttempts() {
+	GetInstance().Lock.Lock()
+	GetInstance().LoginAttempts = make(map[string]*LoginAttempt)
+	GetInstance().Lock.Unlock()
+}
+
+func recordLoginFailure(c *gin.Context, username string) {
+	recordAttemptFailure(attemptLoginKeys(c, username), []int{maxIpFailures, maxUserFailures, maxAccountFailures})
+}
+
+func TestLoginLockoutPerIp(t *testing.T) {
+	resetLoginAttempts()
+	defer resetLoginAttempts()
+	c := loginContext("192.0.2.1", "")
+	for i := 0; i < maxUserFailures; i++ {
+		recordLoginFailure(c, "alice")
+	}
+	if _, ok := checkAttempt(attemptLoginKeys(c, "alice")...); ok {
+		t.Error("user is not locked on the failing ip")
+	}
+	// 其他 IP 上的正常用户不会被锁定，只受按用户名计数的退避限制
+	if _, ok := checkAttempt(attemptIpKey("192.0.2.2"), attemptUserKey("alice", "192.0.2.2")); !ok {
+		t.Error("user is locked on another ip")
+	}
+	GetInstance().Lock.Lock()
+	account := GetInstance().LoginAttempts[attemptAccountKey("alice")]
+	GetInstance().Lock.Unlock()
+	if account == nil || account.Failures != maxUserFailures || account.Failures >= account.MaxFailures {
+		t.Errorf("account attempt = %+v, want %d failures without lockout", account, maxUserFailures)
+	}
+}
+
+// 客户端在每次尝试时更换 X-Forwarded-For，不能绕过限制
+func TestLoginLockoutForwardedFor(t *testing.T) {
+	resetLoginAttempts()
+	defer resetLoginAttempts()
+	var c *gin.Context
+	for i := 0; i < maxUserFailures; i++ {
+		c = loginContext("192.0.2.1", fmt.Sprintf("198.51.100.%d", i))
+		recordLoginFailure(c, "alice")
+	}
+	if ip := c.ClientIP(); ip != "192.0.2.1" {
+		t.Fatalf("ClientIP = %s, want the remote address", ip)
+	}
+	if _, ok := checkAttempt(attemptLoginKeys(c, "alice")...); ok {
+		t.Error("user is not locked after changing X-Forwarded-For")
+	}
+}
+
+// 攻击者更换 IP 时，按用户名的计数仍然会锁定账号
+func TestLoginLockoutPerAccount(t *testing.T) {
+	resetLoginAttempts()
+	defer resetLoginAttempts()
+	for i := 0; i < maxAccountFailures; i++ {
+		c := loginContext(fmt.Sprintf("203.0.113.%d", i), "")
+		recordLoginFailure(c, "alice")
+	}
+	if _, ok := checkAttempt(attemptLoginKeys(loginContext("192.0.2.9", ""), "alice")...); ok {
+		t.Error("account is not locked after failures from many ips")
+	}
+	if _, ok := checkAttempt(attemptLoginKeys(loginContext("192.0.2.9", ""), "bob")...); !ok {
+		t.Error("another account is locked")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"myfileserver/db"
 	"myfileserver/lib"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,25 +14,24 @@ import (
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	TotpCode string `json:"totp_code"` // 两步验证码或恢复码，启用两步验证后使用密码登录时需要
 }
 
 func (ws *WebServer) ReqLogout() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userSessionId := c.GetHeader("session-id")
 		loginUserInfo := getLoginUser(c)
+		userSessionId := loginUserInfo.SessionId
 		ws.Database.AddUserHistory(db.UserHistoryEntry{
 			UserId:   loginUserInfo.UserEntry.Id,
 			UserName: loginUserInfo.UserEntry.Name,
 			Action:   "logout",
 			Information: ws.getRequestInfo(c, map[string]string{
-				"user_session_id": userSessionId,
+				"user_session_id": sessionPrefix(userSessionId),
 			}),
 			Ip: c.ClientIP(),
 		})
 
-		GetInstance().Lock.Lock()
-		delete(GetInstance().Tokens, userSessionId)
-		GetInstance().Lock.Unlock()
+		ws.Database.DeleteSession(userSessionId)
 		c.JSON(http.StatusOK, gin.H{
 			"code":    0,
 			"message": "退出成功",
@@ -39,13 +39,45 @@ func (ws *WebServer) ReqLogout() gin.HandlerFunc {
 	}
 }
 
+// 记录请求信息时需要隐藏的凭据，包括请求头和参数
+var credentialHeaders = []string{"Authorization", "Cookie", "session-id", "user-token"}
+var credentialQueries = []string{"session-id", "user-token"}
+
+// redactRequestURI 隐藏参数中的会话ID和用户令牌
+func redactRequestURI(requestURI string) string {
+	u, err := url.ParseRequestURI(requestURI)
+	if err != nil {
+		return requestURI
+	}
+	query := u.Query()
+	redacted := false
+	for _, key := range credentialQueries {
+		if query.Has(key) {
+			query.Set(key, "***")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return requestURI
+	}
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
 func (ws *WebServer) getRequestInfo(c *gin.Context, actionInfo map[string]string) string {
+	header := c.Request.Header.Clone()
+	for _, key := range credentialHeaders {
+		if header.Get(key) != "" {
+			header.Set(key, "***")
+		}
+	}
+	userSessionId, _ := getSessionCredential(c)
 	info := make(map[string]interface{})
 	info["ip"] = c.ClientIP()
-	info["session_id"] = c.GetHeader("session-id")
+	info["session_id"] = sessionPrefix(userSessionId)
 	info["user_agent"] = c.Request.UserAgent()
-	info["header"] = c.Request.Header
-	info["url"] = c.Request.RequestURI
+	info["header"] = header
+	info["url"] = redactRequestURI(c.Request.RequestURI)
 	info["method"] = c.Request.Method
 	info["action_info"] = actionInfo
 	information, _ := json.Marshal(info)
@@ -77,6 +109,20 @@ func (ws *WebServer) getUserEntry(username string) (*db.UserEntry, error) {
 	return &userEntry, nil
 }
 
+// loginFailed 记录一次登录失败，用于防止暴力破解
+func (ws *WebServer) loginFailed(c *gin.Context, username string, userId int64, reason string) {
+	recordAttemptFailure(attemptLoginKeys(c, username), []int{maxIpFailures, maxUserFailures, maxAccountFailures})
+	ws.Database.AddUserHistory(db.UserHistoryEntry{
+		UserId:   userId,
+		UserName: username,
+		Action:   "login_failed",
+		Information: ws.getRequestInfo(c, map[string]string{
+			"reason": reason,
+		}),
+		Ip: c.ClientIP(),
+	})
+}
+
 func (ws *WebServer) ReqLogin() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		req := LoginRequest{}
@@ -89,9 +135,20 @@ func (ws *WebServer) ReqLogin() gin.HandlerFunc {
 			})
 			return
 		}
+		// 只限制密码和验证码登录，使用会话刷新登录状态时不检查，避免被他人的错误尝试影响
+		if req.Password != "" {
+			if wait, ok := checkAttempt(attemptLoginKeys(c, req.Username)...); !ok {
+				lib.Logger.Error("too many login attempts!", " username: ", req.Username, " ip: ", c.ClientIP())
+				tooManyAttempts(c, wait)
+				return
+			}
+		}
 		userEntry, err := ws.getUserEntry(req.Username)
 		if err != nil {
 			lib.Logger.Error("get user entry error: ", err, "username: ", req.Username)
+			if req.Password != "" {
+				ws.loginFailed(c, req.Username, 0, "user not found")
+			}
 			c.JSON(http.StatusOK, gin.H{
 				"code":    1001,
 				"message": "用户或密码错误",
@@ -101,64 +158,116 @@ func (ws *WebServer) ReqLogin() gin.HandlerFunc {
 		userSessionId := c.GetHeader("session-id")
 		userToken := c.GetHeader("user-token")
 		if req.Password != "" {
-			if userEntry.Password != req.Password {
-				lib.Logger.Error("bad password!", "username: ", req.Username, "|", req.Password, "|", userEntry.Password, "|")
+			match, needRehash := lib.CheckPassword(userEntry.Password, req.Password)
+			if !match {
+				lib.Logger.Error("bad password!", " username: ", req.Username)
+				ws.loginFailed(c, req.Username, userEntry.Id, "bad password")
 				c.JSON(http.StatusOK, gin.H{
 					"code":    1001,
 					"message": "用户名或密码错误",
 				})
 				return
 			}
+			// 启用了两步验证时，还需要校验验证码
+			totpEntry, err := ws.Database.GetUserTotp(userEntry.Id)
+			if err == nil && totpEntry.Enabled {
+				if req.TotpCode == "" {
+					c.JSON(http.StatusOK, gin.H{
+						"code":    1002,
+						"message": "需要两步验证",
+						"data": gin.H{
+							"totp_required": true,
+						},
+					})
+					return
+				}
+				ok, isRecoveryCode := ws.verifyTotpCode(totpEntry, req.TotpCode)
+				if !ok {
+					lib.Logger.Error("bad totp code!", " username: ", req.Username)
+					ws.loginFailed(c, req.Username, userEntry.Id, "bad totp code")
+					c.JSON(http.StatusOK, gin.H{
+						"code":    1003,
+						"message": "验证码错误",
+					})
+					return
+				}
+				if isRecoveryCode {
+					lib.Logger.Info("user login with recovery code!", " user_id:", userEntry.Id)
+				}
+			}
+			clearAttempt(attemptUserKey(req.Username, c.ClientIP()), attemptAccountKey(req.Username))
+			// 旧版本保存的明文密码，登录成功后转换为哈希
+			if needRehash {
+				err = ws.Database.UpdateUserPassword(userEntry.Id, req.Password)
+				if err != nil {
+					lib.Logger.Error("rehash password failed!", " user_id:", userEntry.Id, " err:", err)
+				} else {
+					lib.Logger.Info("rehash password succeed!", " user_id:", userEntry.Id)
+				}
+			}
 			oldUserSessionID := userSessionId
-			userSessionId = ""
-			userToken, _ = lib.GenerateRandomString(16)
-			GetInstance().Lock.Lock()
 			if oldUserSessionID != "" {
-				delete(GetInstance().Tokens, oldUserSessionID)
-			}
-			for {
-				userSessionId, _ = lib.GenerateRandomString(16)
-				_, exist := GetInstance().Tokens[userSessionId]
-				if !exist {
-					GetInstance().Tokens[userSessionId] = UserInfo{
-						UserName:     req.Username,
-						UserToken:    userToken,
-						LoginAt:      time.Now(),
-						FirstLoginAt: time.Now(),
-						UserEntry:    *userEntry,
-					}
-					break
+				// 只删除属于当前用户的旧会话
+				oldSession, err := ws.Database.GetSession(oldUserSessionID)
+				if err == nil && oldSession.UserId == userEntry.Id {
+					ws.Database.DeleteSession(oldUserSessionID)
 				}
 			}
-			GetInstance().Lock.Unlock()
+			userSessionId = newSessionId()
+			userToken, _ = lib.GenerateRandomString(16)
+			now := time.Now().Format(time.DateTime)
+			err = ws.Database.AddSession(db.SessionEntry{
+				SessionId:    userSessionId,
+				UserId:       userEntry.Id,
+				UserName:     userEntry.Name,
+				UserToken:    userToken,
+				Ip:           c.ClientIP(),
+				UserAgent:    c.Request.UserAgent(),
+				LoginAt:      now,
+				FirstLoginAt: now,
+			})
+			if err != nil {
+				lib.Logger.Error("add session failed!", err)
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1001,
+					"message": "创建会话失败",
+				})
+				return
+			}
 			lib.Logger.Error("user login with password succeed!", " user_id:", userEntry.Id, " username:", req.Username)
 		} else {
-			if userSessionId != "" && userToken != "" {
-				GetInstance().Lock.Lock()
-				loginUserInfo, exist := GetInstance().Tokens[userSessionId]
-				// 如果上次登录时间超过7天，就认为删除
-				// 如果第一次登录时间超过30天，也认为过期
-				if !exist ||
-					loginUserInfo.UserEntry.Name != req.Username ||
-					time.Since(loginUserInfo.LoginAt).Hours() > 7*24 ||
-					time.Since(loginUserInfo.FirstLoginAt).Hours() > 30*24 {
-					delete(GetInstance().Tokens, userSessionId)
-					GetInstance().Lock.Unlock()
-					lib.Logger.Error("user login failed! token expried.", "username: ", req.Username)
-					c.JSON(http.StatusOK, gin.H{
-						"code":    1001,
-						"message": "Token已过期",
-					})
-					return
-				}
-				loginUserInfo.UserToken, _ = lib.GenerateRandomString(16)
-				userToken = loginUserInfo.UserToken
-				loginUserInfo.LoginAt = time.Now()
-				loginUserInfo.UserEntry = *userEntry
-				GetInstance().Tokens[userSessionId] = loginUserInfo
-				GetInstance().Lock.Unlock()
-				lib.Logger.Error("user login with session id succeed!", " user_id:", loginUserInfo.UserEntry.Id, " username:", req.Username)
+			// 没有密码时使用会话刷新令牌，会话ID和用户令牌都要正确，只有会话ID时不能换取新的令牌
+			if userSessionId == "" || userToken == "" {
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1001,
+					"message": "用户名或密码错误",
+				})
+				return
+			}
+			// 过期的会话在 loadSession 中会被删除
+			session, err := loadSession(userSessionId)
+			if err != nil || session.UserId != userEntry.Id || !checkUserToken(session, userToken) {
+				lib.Logger.Error("user login failed! token expried.", "username: ", req.Username)
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1001,
+					"message": "Token已过期",
+				})
+				return
+			}
+			session.UserToken, _ = lib.GenerateRandomString(16)
+			session.Ip = c.ClientIP()
+			session.UserAgent = c.Request.UserAgent()
+			session.LoginAt = time.Now().Format(time.DateTime)
+			err = ws.Database.RefreshSession(session)
+			if err != nil {
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1001,
+					"message": "刷新会话失败",
+				})
+				return
 			}
+			userToken = session.UserToken
+			lib.Logger.Error("user login with session id succeed!", " user_id:", userEntry.Id, " username:", req.Username)
 		}
 		userEntry.Password = ""
 		userSettingEntries, err := ws.Database.GetUserSettings(userEntry.Id)
@@ -184,7 +293,7 @@ func (ws *WebServer) ReqLogin() gin.HandlerFunc {
 			UserName: userEntry.Name,
 			Action:   "login",
 			Information: ws.getRequestInfo(c, map[string]string{
-				"user_session_id": userSessionId,
+				"user_session_id": sessionPrefix(userSessionId),
 			}),
 			Ip: c.ClientIP(),
 		})
@@ -0,0 +1,387 @@
+package webserver
+
+import (
+	"encoding/json"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// 文件变化通知
+// 客户端通过 WebSocket 订阅自己可以读取的目录，目录下的文件被创建、修改、删除和重命名时推送事件
+// 事件来自服务自身的接口和文件索引的目录监视，监视发现的变化如果刚由接口通知过则不再重复通知
+
+const (
+	fileEventCreate = "create"
+	fileEventModify = "modify"
+	fileEventDelete = "delete"
+	fileEventRename = "rename"
+)
+
+const (
+	// 接口通知过的变化在这段时间内不再由目录监视重复通知
+	eventDedupWindow = 10 * time.Second
+	// 每个连接最多订阅的目录数和缓存的消息数
+	eventMaxSubscriptions = 100
+	eventQueueSize        = 256
+	eventPingInterval     = 30 * time.Second
+	eventReadTimeout      = 2 * eventPingInterval
+)
+
+// 不设置 CheckOrigin，只允许同源的网页建立连接，避免其他网站借助 cookie 中的会话订阅文件变化
+// 不是浏览器的客户端不会发送 Origin 头，不受限制
+var events_upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// FileEvent 服务器上的路径发生的变化，重命名和移动时 OldRealPath 为原来的路径
+type FileEvent struct {
+	Type        string
+	RealPath    string
+	OldRealPath string
+	IsDir       bool
+	Time        time.Time
+}
+
+// FileEventEntry 推送给客户端的事件，路径为用户看到的路径
+type FileEventEntry struct {
+	Type    string `json:"type"`
+	Path    string `json:"path"`
+	OldPath string `json:"old_path,omitempty"`
+	IsDir   bool   `json:"is_dir"`
+	Time    string `json:"time"`
+}
+
+// EventMessage WebSocket 上收发的消息
+// 客户端发送 action 为 subscribe 或 unsubscribe 的消息，服务端回复 subscribed、unsubscribed、error，
+// 推送 event，消息过多来不及发送时推送 overflow，客户端需要重新读取订阅的目录
+type EventMessage struct {
+	Action    string          `json:"action,omitempty"`
+	Type      string          `json:"type,omitempty"`
+	Path      string          `json:"path,omitempty"`
+	Recursive bool            `json:"recursive,omitempty"`
+	Message   string          `json:"message,omitempty"`
+	Data      *FileEventEntry `json:"data,omitempty"`
+}
+
+type eventSubscription struct {
+	userPath  string
+	realDir   string
+	recursive bool
+}
+
+type eventSubscriber struct {
+	userEntry db.UserEntry
+	lock      sync.Mutex
+	subs      map[string][]eventSubscription // 按订阅时的路径保存，根目录会同时订阅挂载的目录
+	messages  chan EventMessage
+	closed    chan struct{} // 写入结束后关闭，不再接收回复
+	overflow  bool
+}
+
+type EventHub struct {
+	lock        sync.Mutex
+	subscribers map[*eventSubscriber]bool
+	recent      map[string]time.Time // 接口最近通知过的变化
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: make(map[*eventSubscriber]bool),
+		recent:      make(map[string]time.Time),
+	}
+}
+
+func (hub *EventHub) subscribe(sub *eventSubscriber) {
+	hub.lock.Lock()
+	hub.subscribers[sub] = true
+	hub.lock.Unlock()
+}
+
+func (hub *EventHub) unsubscribe(sub *eventSubscriber) {
+	hub.lock.Lock()
+	delete(hub.subscribers, sub)
+	hub.lock.Unlock()
+}
+
+// dedup 记录接口通知的变化，watched 为 true 时只判断是否刚由接口通知过
+func (hub *EventHub) dedup(event FileEvent, watched bool) bool {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	now := time.Now()
+	for key, t := range hub.recent {
+		if now.Sub(t) > eventDedupWindow {
+			delete(hub.recent, key)
+		}
+	}
+	if watched {
+		_, exist := hub.recent[event.RealPath]
+		return exist
+	}
+	hub.recent[event.RealPath] = now
+	if event.OldRealPath != "" {
+		hub.recent[event.OldRealPath] = now
+	}
+	return false
+}
+
+// publish 把事件推送给订阅了相关目录的客户端，watched 为 true 表示来自目录监视
+func (hub *EventHub) publish(event FileEvent, watched bool) {
+	if hub == nil || hub.dedup(event, watched) {
+		return
+	}
+	hub.lock.Lock()
+	subscribers := make([]*eventSubscriber, 0, len(hub.subscribers))
+	for sub := range hub.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	hub.lock.Unlock()
+	for _, sub := range subscribers {
+		sub.deliver(event)
+	}
+}
+
+// match 返回事件中的路径在订阅的目录中对应的用户路径
+func (s eventSubscription) match(realPath string, hideDotFiles bool) (string, bool) {
+	if realPath == "" || !isSubPath(s.realDir, realPath) {
+		return "", false
+	}
+	rel, err := filepath.Rel(s.realDir, realPath)
+	if err != nil {
+		return "", false
+	}
+	if rel == "." {
+		if s.userPath == "" {
+			return "/", true
+		}
+		return s.userPath, true
+	}
+	rel = filepath.ToSlash(rel)
+	if !s.recursive && strings.Contains(rel, "/") {
+		return "", false
+	}
+	if hideDotFiles && (strings.HasPrefix(rel, ".") || strings.Contains(rel, "/.")) {
+		return "", false
+	}
+	return s.userPath + "/" + rel, true
+}
+
+func (sub *eventSubscriber) deliver(event FileEvent) {
+	hideDotFiles := !sub.userEntry.ShowDotFiles
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	path, oldPath := "", ""
+	for _, subs := range sub.subs {
+		for _, s := range subs {
+			if p, ok := s.match(event.RealPath, hideDotFiles); ok && path == "" {
+				path = p
+			}
+			if p, ok := s.match(event.OldRealPath, hideDotFiles); ok && oldPath == "" {
+				oldPath = p
+			}
+		}
+	}
+	entry := &FileEventEntry{
+		Type:    event.Type,
+		Path:    path,
+		OldPath: oldPath,
+		IsDir:   event.IsDir,
+		Time:    event.Time.Format(time.DateTime),
+	}
+	// 只能看到重命名的一侧时按创建或删除通知
+	switch {
+	case path == "" && oldPath == "":
+		return
+	case event.Type == fileEventRename && oldPath == "":
+		entry.Type = fileEventCreate
+	case event.Type == fileEventRename && path == "":
+		entry.Type = fileEventDelete
+		entry.Path, entry.OldPath = oldPath, ""
+	}
+	if sub.overflow {
+		return
+	}
+	select {
+	case sub.messages <- EventMessage{Type: "event", Data: entry}:
+	default:
+		// 队列已满时丢弃之后的事件，通知客户端重新读取
+		sub.overflow = true
+	}
+}
+
+// notify 通知服务自身的接口对文件的修改
+func (ws *WebServer) notify(eventType string, realPath string, oldRealPath string, isDir bool) {
+	ws.Notifier.publish(FileEvent{
+		Type:        eventType,
+		RealPath:    realPath,
+		OldRealPath: oldRealPath,
+		IsDir:       isDir,
+		Time:        time.Now(),
+	}, false)
+}
+
+// notifyWrite 写入文件后通知，existed 为写入前文件是否存在
+func (ws *WebServer) notifyWrite(realPath string, existed bool) {
+	if existed {
+		ws.notify(fileEventModify, realPath, "", false)
+	} else {
+		ws.notify(fileEventCreate, realPath, "", false)
+	}
+}
+
+// addSubscription 订阅目录，订阅根目录且包含子目录时同时订阅挂载的目录
+func (ws *WebServer) addSubscription(sub *eventSubscriber, path string, recursive bool) (string, error) {
+	path, succeed := cleanPath(path)
+	if !succeed {
+		return path, &PathError{Path: path, Err: ErrPathInvalid}
+	}
+	realDir, err := ws.resolveUserRealPath(sub.userEntry, path, db.AclAccessRead, true)
+	if err != nil {
+		return path, err
+	}
+	if info, err := os.Stat(realDir); err != nil || !info.IsDir() {
+		return path, newFileOpError(http.StatusNotFound, 1001, "Directory not found")
+	}
+	subs := []eventSubscription{{userPath: path, realDir: realDir, recursive: recursive}}
+	if path == "" && recursive {
+		for _, mount := range ws.getUserMounts(sub.userEntry) {
+			subs = append(subs, eventSubscription{
+				userPath:  "/" + mount.MountName,
+				realDir:   filepath.Join(ws.RootDir, mount.Path),
+				recursive: true,
+			})
+		}
+	}
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if _, exist := sub.subs[path]; !exist && len(sub.subs) >= eventMaxSubscriptions {
+		return path, newFileOpError(http.StatusOK, 1000, "too many subscriptions")
+	}
+	sub.subs[path] = subs
+	return path, nil
+}
+
+func (sub *eventSubscriber) reply(message EventMessage) {
+	select {
+	case sub.messages <- message:
+	case <-sub.closed:
+	}
+}
+
+// handleEventMessage 处理客户端发送的订阅和取消订阅
+func (ws *WebServer) handleEventMessage(sub *eventSubscriber, data []byte) {
+	message := EventMessage{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		sub.reply(EventMessage{Type: "error", Message: "invalid message"})
+		return
+	}
+	switch message.Action {
+	case "subscribe":
+		path, err := ws.addSubscription(sub, message.Path, message.Recursive)
+		if err != nil {
+			sub.reply(EventMessage{Type: "error", Path: message.Path, Message: err.Error()})
+			return
+		}
+		sub.reply(EventMessage{Type: "subscribed", Path: path, Recursive: message.Recursive})
+	case "unsubscribe":
+		path, _ := cleanPath(message.Path)
+		sub.lock.Lock()
+		delete(sub.subs, path)
+		sub.lock.Unlock()
+		sub.reply(EventMessage{Type: "unsubscribed", Path: path})
+	default:
+		sub.reply(EventMessage{Type: "error", Message: "invalid action"})
+	}
+}
+
+// writeEvents 把消息写到连接上，所有的写入都在这里进行
+func writeEvents(conn *websocket.Conn, sub *eventSubscriber, done chan struct{}) {
+	defer close(sub.closed)
+	ticker := time.NewTicker(eventPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-sub.messages:
+			conn.SetWriteDeadline(time.Now().Add(WSWriteDeadline))
+			if err := conn.WriteJSON(message); err != nil {
+				conn.Close()
+				return
+			}
+			sub.lock.Lock()
+			overflow := sub.overflow && len(sub.messages) == 0
+			sub.lock.Unlock()
+			if overflow {
+				conn.SetWriteDeadline(time.Now().Add(WSWriteDeadline))
+				if err := conn.WriteJSON(EventMessage{Type: "overflow"}); err != nil {
+					conn.Close()
+					return
+				}
+				sub.lock.Lock()
+				sub.overflow = false
+				sub.lock.Unlock()
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WSWriteDeadline)); err != nil {
+				conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// ReqSubscribeEvents 建立 WebSocket 连接接收文件变化的通知，可以用参数 path 和 recursive 在连接时订阅一个目录
+func (ws *WebServer) ReqSubscribeEvents() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		sub := &eventSubscriber{
+			userEntry: loginUserInfo.UserEntry,
+			subs:      make(map[string][]eventSubscription),
+			messages:  make(chan EventMessage, eventQueueSize),
+			closed:    make(chan struct{}),
+		}
+		if path, exist := c.GetQuery("path"); exist {
+			if _, err := ws.addSubscription(sub, path, c.Query("recursive") == "1"); err != nil {
+				writeFileOpError(c, err)
+				return
+			}
+		}
+		conn, err := events_upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			lib.Logger.Error("ReqSubscribeEvents: upgrade failed!", err)
+			return
+		}
+		defer conn.Close()
+
+		ws.Notifier.subscribe(sub)
+		defer ws.Notifier.unsubscribe(sub)
+		done := make(chan struct{})
+		defer close(done)
+		go writeEvents(conn, sub, done)
+
+		conn.SetReadLimit(64 * 1024)
+		conn.SetReadDeadline(time.Now().Add(eventReadTimeout))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(eventReadTimeout))
+			return nil
+		})
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(eventReadTimeout))
+			ws.handleEventMessage(sub, data)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package webserver
+
+import (
+	"errors"
+	"myfileserver/db"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 需要校验权限的操作
+const (
+	actionDelete = "delete" // 删除文件或目录
+	actionModify = "modify" // 重命名、移动、复制、编辑已有的文件
+	actionUpload = "upload" // 上传文件、新建文件和目录
+	actionXterm  = "xterm"  // 使用终端
+	actionShare  = "share"  // 创建和修改分享
+)
+
+// isUserAllowed 根据用户的权限限制判断是否允许执行操作，管理员不受限制
+func isUserAllowed(userEntry db.UserEntry, action string) bool {
+	if userEntry.IsAdmin {
+		return true
+	}
+	switch action {
+	case actionDelete:
+		return !userEntry.HasPermission(db.PermissionReadOnly) &&
+			!userEntry.HasPermission(db.PermissionUploadOnly) &&
+			!userEntry.HasPermission(db.PermissionNoDelete)
+	case actionModify:
+		return !userEntry.HasPermission(db.PermissionReadOnly) &&
+			!userEntry.HasPermission(db.PermissionUploadOnly)
+	case actionUpload:
+		return !userEntry.HasPermission(db.PermissionReadOnly)
+	case actionXterm:
+		return !userEntry.HasPermission(db.PermissionReadOnly) &&
+			!userEntry.HasPermission(db.PermissionUploadOnly) &&
+			!userEntry.HasPermission(db.PermissionNoXterm)
+	case actionShare:
+		return !userEntry.HasPermission(db.PermissionUploadOnly) &&
+			!userEntry.HasPermission(db.PermissionNoShare)
+	}
+	return false
+}
+
+// checkUserPermission 校验登录用户是否允许执行操作，不允许时返回错误
+func checkUserPermission(c *gin.Context, action string) bool {
+	loginUserInfo := getLoginUser(c)
+	if isUserAllowed(loginUserInfo.UserEntry, action) {
+		return true
+	}
+	writeFileOpError(c, errPermissionDenied())
+	return false
+}
+
+// normalizePermissions 校验并整理权限限制，去掉空白和重复的项
+func normalizePermissions(permissions string) (string, error) {
+	ret := []string{}
+	for _, v := range strings.Split(permissions, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" || slices.Contains(ret, v) {
+			continue
+		}
+		if !slices.Contains(db.AllPermissions, v) {
+			return "", errors.New("permission is invalid: " + v)
+		}
+		ret = append(ret, v)
+	}
+	return strings.Join(ret, ","), nil
+}
@@ -0,0 +1,31 @@
+package webserver
+
+import "testing"
+
+func TestNormalizePermissions(t *testing.T) {
+	tests := []struct {
+		permissions string
+		want        string
+		wantErr     bool
+	}{
+		{"", "", false},
+		{" , ,", "", false},
+		{"read_only", "read_only", false},
+		{" no_delete , no_share ", "no_delete,no_share", false},
+		{"no_xterm,no_xterm,upload_only", "no_xterm,upload_only", false},
+		{"upload_only,read_only", "upload_only,read_only", false},
+		{"read_only,unknown", "", true},
+		{"READ_ONLY", "", true},
+		{"read only", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizePermissions(tt.permissions)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizePermissions(%q) err = %v, want error %v", tt.permissions, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizePermissions(%q) = %q, want %q", tt.permissions, got, tt.want)
+		}
+	}
+}
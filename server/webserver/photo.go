@@ -0,0 +1,756 @@
+package webserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"io/fs"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 相册
+// 扫描用户设置的照片目录（photo_folders，用户看到的路径的 JSON 数组），把照片的 EXIF 信息保存到数据库
+// 按拍摄时间提供年、月、日的时间线；相册只记录照片的路径，不复制文件
+// 设置照片目录后立即扫描，之后每小时扫描一次，只读取新增和变化的文件
+
+const (
+	PhotoFoldersKey       = "photo_folders"
+	photoMaxFolders       = 100
+	photoDefaultPageSize  = 100
+	photoMaxPageSize      = 1000
+	photoMaxAlbumName     = 255
+	photoMaxAlbumPaths    = 1000
+	photoScanPeriod       = time.Hour
+	photoScanKeepTime     = time.Hour
+	photoScanFlushEntries = 200
+)
+
+// 扫描照片目录时只读取这些扩展名的文件
+var photoExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".bmp":  true,
+}
+
+// 时间线的日期参数：2006、2006-01 或 2006-01-02
+var photoDatePattern = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// PhotoScanEntry 用户的照片目录的扫描进度
+type PhotoScanEntry struct {
+	UserId      int64     `json:"user_id"`
+	Finished    bool      `json:"finished"`
+	StartTime   time.Time `json:"start_time"`
+	FinishTime  time.Time `json:"finish_time"`
+	ScanCount   int64     `json:"scan_count"`   // 已检查的照片数
+	UpdateCount int64     `json:"update_count"` // 新增或变化的照片数
+	RemoveCount int64     `json:"remove_count"` // 已经不存在的照片数
+	Error       string    `json:"error,omitempty"`
+	lock        sync.Mutex
+}
+
+type AlbumPhotoResult struct {
+	db.AlbumPhotoEntry
+	Exist bool           `json:"exist"`           // 文件是否还存在
+	Photo *db.PhotoEntry `json:"photo,omitempty"` // 扫描照片目录时记录的信息
+}
+
+// getPhotoFolders 获取用户设置的照片目录
+func (ws *WebServer) getPhotoFolders(userId int64) []string {
+	folders := []string{}
+	setting, err := ws.Database.GetUserSetting(userId, PhotoFoldersKey)
+	if err != nil || setting.Value == "" {
+		return folders
+	}
+	if err := json.Unmarshal([]byte(setting.Value), &folders); err != nil {
+		return []string{}
+	}
+	return folders
+}
+
+// readPhoto 读取照片的尺寸和 EXIF 信息，不是支持的图片时返回 false
+func readPhoto(realPath string, info os.FileInfo) (db.PhotoEntry, bool) {
+	photo := db.PhotoEntry{
+		Size:        info.Size(),
+		MTime:       info.ModTime().UnixNano(),
+		TakenAt:     info.ModTime().Format(time.DateTime),
+		Orientation: 1,
+	}
+	f, err := os.Open(realPath)
+	if err != nil {
+		return photo, false
+	}
+	defer f.Close()
+	config, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return photo, false
+	}
+	photo.Width, photo.Height = config.Width, config.Height
+	if format != "jpeg" {
+		return photo, true
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return photo, true
+	}
+	exif, err := lib.ReadExif(f)
+	if err != nil {
+		return photo, true
+	}
+	if !exif.TakenAt.IsZero() {
+		photo.TakenAt = exif.TakenAt.Format(time.DateTime)
+	}
+	photo.Make = exif.Make
+	photo.Model = exif.Model
+	photo.Orientation = exif.Orientation
+	photo.HasGPS = exif.HasGPS
+	photo.Latitude = exif.Latitude
+	photo.Longitude = exif.Longitude
+	// 记录按方向旋转后显示的尺寸，和缩略图一致
+	if photo.Orientation >= 5 {
+		photo.Width, photo.Height = photo.Height, photo.Width
+	}
+	return photo, true
+}
+
+// newPhotoScan 记录用户的扫描任务，用户的上一次扫描还没有结束时返回 false
+func newPhotoScan(userId int64) (*PhotoScanEntry, bool) {
+	GetInstance().Lock.Lock()
+	defer GetInstance().Lock.Unlock()
+	if scan, exist := GetInstance().PhotoScans[userId]; exist {
+		scan.lock.Lock()
+		finished := scan.Finished
+		scan.lock.Unlock()
+		if !finished {
+			return scan, false
+		}
+	}
+	scan := &PhotoScanEntry{
+		UserId:    userId,
+		StartTime: time.Now(),
+	}
+	GetInstance().PhotoScans[userId] = scan
+	return scan, true
+}
+
+// scanPhotos 扫描用户的照片目录，更新数据库中的照片记录，删除已经不存在或不在照片目录中的照片
+func (ws *WebServer) scanPhotos(userEntry db.UserEntry, scan *PhotoScanEntry) {
+	defer func() {
+		scan.lock.Lock()
+		scan.Finished = true
+		scan.FinishTime = time.Now()
+		scan.lock.Unlock()
+	}()
+	setError := func(err error) {
+		scan.lock.Lock()
+		scan.Error = err.Error()
+		scan.lock.Unlock()
+	}
+	photos, err := ws.Database.GetUserPhotos(userEntry.Id)
+	if err != nil {
+		setError(err)
+		return
+	}
+	existing := make(map[string]db.PhotoEntry, len(photos))
+	for _, photo := range photos {
+		existing[photo.Path] = photo
+	}
+	seen := make(map[string]bool)
+	changed := []db.PhotoEntry{}
+	flush := func() bool {
+		if len(changed) == 0 {
+			return true
+		}
+		if err := ws.Database.UpdatePhotos(userEntry.Id, changed, nil); err != nil {
+			setError(err)
+			return false
+		}
+		scan.lock.Lock()
+		scan.UpdateCount += int64(len(changed))
+		scan.lock.Unlock()
+		changed = changed[:0]
+		return true
+	}
+
+	hideDotFiles := !userEntry.ShowDotFiles
+	for _, folder := range ws.getPhotoFolders(userEntry.Id) {
+		folder, ok := cleanPath(folder)
+		if !ok {
+			continue
+		}
+		realDir, err := ws.resolveUserRealPath(userEntry, folder, db.AclAccessRead, true)
+		if err != nil {
+			continue
+		}
+		// 不进入指向目录的符号链接和临时目录
+		filepath.WalkDir(realDir, func(realPath string, entry fs.DirEntry, err error) error {
+			if err != nil || realPath == realDir {
+				return nil
+			}
+			if hideDotFiles && strings.HasPrefix(entry.Name(), ".") ||
+				entry.IsDir() && isSubPath(ws.TempDir, realPath) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() || !photoExts[strings.ToLower(filepath.Ext(entry.Name()))] {
+				return nil
+			}
+			rel, _ := filepath.Rel(realDir, realPath)
+			userPath := folder + "/" + filepath.ToSlash(rel)
+			if seen[userPath] {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			seen[userPath] = true
+			scan.lock.Lock()
+			scan.ScanCount++
+			scan.lock.Unlock()
+			if old, exist := existing[userPath]; exist && old.Size == info.Size() && old.MTime == info.ModTime().UnixNano() {
+				return nil
+			}
+			photo, ok := readPhoto(realPath, info)
+			if !ok {
+				// 不是支持的图片，之前记录过时删除
+				delete(seen, userPath)
+				return nil
+			}
+			photo.Path = userPath
+			changed = append(changed, photo)
+			if len(changed) >= photoScanFlushEntries && !flush() {
+				return filepath.SkipAll
+			}
+			return nil
+		})
+	}
+	if !flush() {
+		return
+	}
+
+	removed := []string{}
+	for path := range existing {
+		if !seen[path] {
+			removed = append(removed, path)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	if err := ws.Database.UpdatePhotos(userEntry.Id, nil, removed); err != nil {
+		setError(err)
+		return
+	}
+	scan.lock.Lock()
+	scan.RemoveCount = int64(len(removed))
+	scan.lock.Unlock()
+}
+
+// AutoScanPhotos 定时扫描所有设置了照片目录的用户，依次扫描，避免同时读取太多文件
+func (ws *WebServer) AutoScanPhotos() {
+	ticker := time.NewTicker(photoScanPeriod)
+	defer ticker.Stop()
+	for {
+		users, err := ws.Database.GetUsers()
+		if err == nil {
+			for _, user := range users {
+				if len(ws.getPhotoFolders(user.Id)) == 0 {
+					continue
+				}
+				if scan, ok := newPhotoScan(user.Id); ok {
+					ws.scanPhotos(user, scan)
+				}
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// CleanPhotoScans 清理已经结束的扫描记录，由后台定时调用
+func CleanPhotoScans() {
+	GetInstance().Lock.Lock()
+	defer GetInstance().Lock.Unlock()
+	for userId, scan := range GetInstance().PhotoScans {
+		scan.lock.Lock()
+		expired := scan.Finished && time.Since(scan.FinishTime) > photoScanKeepTime
+		scan.lock.Unlock()
+		if expired {
+			delete(GetInstance().PhotoScans, userId)
+		}
+	}
+}
+
+// getPhotoPage 获取分页参数 page 和 page_size
+func getPhotoPage(c *gin.Context) (int64, int64, bool) {
+	page, succeed := getQueryInt64Default(c, "page", 1)
+	if !succeed {
+		return 0, 0, false
+	}
+	pageSize, succeed := getQueryInt64Default(c, "page_size", photoDefaultPageSize)
+	if !succeed {
+		return 0, 0, false
+	}
+	if page < 1 || pageSize < 1 || pageSize > photoMaxPageSize {
+		c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "page is invalid"})
+		return 0, 0, false
+	}
+	return page, pageSize, true
+}
+
+// getPhotoDate 获取日期参数 date，没有传入时返回空字符串
+func getPhotoDate(c *gin.Context) (string, bool) {
+	date := c.Query("date")
+	if date != "" && !photoDatePattern.MatchString(date) {
+		c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "date is invalid"})
+		return "", false
+	}
+	return date, true
+}
+
+// getAlbum 获取登录用户的相册，参数 id 为相册的 id，不存在时返回错误
+func (ws *WebServer) getAlbum(c *gin.Context, id int64) (db.AlbumEntry, bool) {
+	loginUserInfo := getLoginUser(c)
+	album, err := ws.Database.GetAlbum(loginUserInfo.UserEntry.Id, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "album not found"})
+		return album, false
+	}
+	if err != nil {
+		lib.Logger.Error("getAlbum", err)
+		c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+		return album, false
+	}
+	return album, true
+}
+
+// getAlbumName 整理相册的名称，名称为空或太长时返回错误
+func getAlbumName(c *gin.Context, name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > photoMaxAlbumName {
+		c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "name is invalid"})
+		return "", false
+	}
+	return name, true
+}
+
+// ReqGetPhotoFolders 获取照片目录
+func (ws *WebServer) ReqGetPhotoFolders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    ws.getPhotoFolders(loginUserInfo.UserEntry.Id),
+		})
+	}
+}
+
+// ReqSetPhotoFolders 设置照片目录并开始扫描，不再是照片目录的照片在扫描后删除
+func (ws *WebServer) ReqSetPhotoFolders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Folders []string `json:"folders"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		if len(req.Folders) > photoMaxFolders {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "too many folders"})
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		folders := []string{}
+		exist := make(map[string]bool)
+		for _, folder := range req.Folders {
+			folder, ok := cleanPath(folder)
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"code": 1000, "message": "Invalid path"})
+				return
+			}
+			realDir, succeed := ws.resolvePath(c, folder, db.AclAccessRead)
+			if !succeed {
+				return
+			}
+			if info, err := os.Stat(realDir); err != nil || !info.IsDir() {
+				c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "Directory not found"})
+				return
+			}
+			if !exist[folder] {
+				exist[folder] = true
+				folders = append(folders, folder)
+			}
+		}
+		value, _ := json.Marshal(folders)
+		err := ws.Database.SetUserSetting(loginUserInfo.UserEntry.Id, PhotoFoldersKey, string(value))
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		if scan, ok := newPhotoScan(loginUserInfo.UserEntry.Id); ok {
+			go ws.scanPhotos(loginUserInfo.UserEntry, scan)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    folders,
+		})
+	}
+}
+
+// ReqScanPhotos 开始扫描照片目录，上一次扫描还没有结束时返回正在进行的扫描
+func (ws *WebServer) ReqScanPhotos() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		scan, ok := newPhotoScan(loginUserInfo.UserEntry.Id)
+		if ok {
+			go ws.scanPhotos(loginUserInfo.UserEntry, scan)
+		}
+		scan.lock.Lock()
+		defer scan.lock.Unlock()
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    scan,
+		})
+	}
+}
+
+// ReqQueryPhotoScan 查询扫描进度，没有进行中或最近结束的扫描时 data 为空
+func (ws *WebServer) ReqQueryPhotoScan() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		GetInstance().Lock.Lock()
+		scan, exist := GetInstance().PhotoScans[loginUserInfo.UserEntry.Id]
+		GetInstance().Lock.Unlock()
+		if !exist {
+			c.JSON(http.StatusOK, gin.H{"code": 0, "message": "success", "data": nil})
+			return
+		}
+		scan.lock.Lock()
+		defer scan.lock.Unlock()
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    scan,
+		})
+	}
+}
+
+// ReqGetPhotoTimeline 时间线，按拍摄时间分组统计照片数，从新到旧排序
+// 参数：group 为 year、month 或 day，默认 month；date 只统计该年或该月的照片；page、page_size 分页
+func (ws *WebServer) ReqGetPhotoTimeline() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		group := c.DefaultQuery("group", "month")
+		if group != "year" && group != "month" && group != "day" {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "group is invalid"})
+			return
+		}
+		date, succeed := getPhotoDate(c)
+		if !succeed {
+			return
+		}
+		// 分组的日期必须比 date 更细
+		if date != "" && (group == "year" || group == "month" && len(date) > 4) {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "date is invalid"})
+			return
+		}
+		page, pageSize, succeed := getPhotoPage(c)
+		if !succeed {
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		// 多查询一条判断是否还有下一页
+		groups, err := ws.Database.GetPhotoGroups(loginUserInfo.UserEntry.Id, group, date, (page-1)*pageSize, pageSize+1)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		hasMore := int64(len(groups)) > pageSize
+		if hasMore {
+			groups = groups[:pageSize]
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data": gin.H{
+				"groups":    groups,
+				"page":      page,
+				"page_size": pageSize,
+				"has_more":  hasMore,
+			},
+		})
+	}
+}
+
+// ReqGetPhotos 获取照片，按拍摄时间从新到旧排序
+// 参数：date 只返回该年、月或日拍摄的照片，为空时返回所有照片；page、page_size 分页
+func (ws *WebServer) ReqGetPhotos() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		date, succeed := getPhotoDate(c)
+		if !succeed {
+			return
+		}
+		page, pageSize, succeed := getPhotoPage(c)
+		if !succeed {
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		photos, err := ws.Database.GetPhotos(loginUserInfo.UserEntry.Id, date, (page-1)*pageSize, pageSize+1)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		hasMore := int64(len(photos)) > pageSize
+		if hasMore {
+			photos = photos[:pageSize]
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data": gin.H{
+				"photos":    photos,
+				"page":      page,
+				"page_size": pageSize,
+				"has_more":  hasMore,
+			},
+		})
+	}
+}
+
+func (ws *WebServer) ReqGetAlbumList() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		albums, err := ws.Database.GetAlbums(loginUserInfo.UserEntry.Id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    albums,
+		})
+	}
+}
+
+func (ws *WebServer) ReqCreateAlbum() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		name, succeed := getAlbumName(c, req.Name)
+		if !succeed {
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		id, err := ws.Database.AddAlbum(loginUserInfo.UserEntry.Id, name)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "create album succeed",
+			"data":    id,
+		})
+	}
+}
+
+// ReqUpdateAlbum 修改相册的名称
+func (ws *WebServer) ReqUpdateAlbum() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Id   int64  `json:"id"`
+			Name string `json:"name"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		name, succeed := getAlbumName(c, req.Name)
+		if !succeed {
+			return
+		}
+		album, succeed := ws.getAlbum(c, req.Id)
+		if !succeed {
+			return
+		}
+		if err := ws.Database.RenameAlbum(album.Id, name); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "update album succeed"})
+	}
+}
+
+// ReqDeleteAlbum 删除相册，相册中的文件不会被删除
+func (ws *WebServer) ReqDeleteAlbum() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, succeed := getQueryInt64(c, "id")
+		if !succeed {
+			return
+		}
+		album, succeed := ws.getAlbum(c, id)
+		if !succeed {
+			return
+		}
+		if err := ws.Database.DeleteAlbum(album.Id); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "delete album succeed"})
+	}
+}
+
+// ReqGetAlbumPhotos 获取相册中的照片，按加入的时间从新到旧排序，参数 id 为相册的 id，page、page_size 分页
+// 文件被删除或移动后仍然保留在相册中，exist 为 false
+func (ws *WebServer) ReqGetAlbumPhotos() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, succeed := getQueryInt64(c, "id")
+		if !succeed {
+			return
+		}
+		album, succeed := ws.getAlbum(c, id)
+		if !succeed {
+			return
+		}
+		page, pageSize, succeed := getPhotoPage(c)
+		if !succeed {
+			return
+		}
+		entries, err := ws.Database.GetAlbumPhotos(album.Id, (page-1)*pageSize, pageSize+1)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		hasMore := int64(len(entries)) > pageSize
+		if hasMore {
+			entries = entries[:pageSize]
+		}
+		loginUserInfo := getLoginUser(c)
+		photos := make([]AlbumPhotoResult, 0, len(entries))
+		for _, entry := range entries {
+			result := AlbumPhotoResult{AlbumPhotoEntry: entry}
+			if realPath, err := ws.resolveUserRealPath(loginUserInfo.UserEntry, entry.Path, db.AclAccessRead, true); err == nil {
+				result.Exist = lib.IsExist(realPath)
+			}
+			if photo, err := ws.Database.GetPhotoByPath(loginUserInfo.UserEntry.Id, entry.Path); err == nil {
+				result.Photo = &photo
+			}
+			photos = append(photos, result)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data": gin.H{
+				"album":     album,
+				"photos":    photos,
+				"page":      page,
+				"page_size": pageSize,
+				"has_more":  hasMore,
+			},
+		})
+	}
+}
+
+// ReqAddAlbumPhotos 向相册中加入文件，只记录路径，文件必须存在且有读取权限
+func (ws *WebServer) ReqAddAlbumPhotos() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Id    int64    `json:"id"`
+			Paths []string `json:"paths"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		if len(req.Paths) == 0 || len(req.Paths) > photoMaxAlbumPaths {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "paths is invalid"})
+			return
+		}
+		album, succeed := ws.getAlbum(c, req.Id)
+		if !succeed {
+			return
+		}
+		paths := make([]string, 0, len(req.Paths))
+		for _, path := range req.Paths {
+			path, ok := cleanPath(path)
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"code": 1000, "message": "Invalid path"})
+				return
+			}
+			realPath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+			if !succeed {
+				return
+			}
+			info, err := os.Stat(realPath)
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "File or directory not found"})
+				return
+			}
+			if info.IsDir() {
+				c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "bad file type"})
+				return
+			}
+			paths = append(paths, path)
+		}
+		if err := ws.Database.AddAlbumPhotos(album.Id, paths); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "add photos succeed"})
+	}
+}
+
+// ReqDeleteAlbumPhotos 从相册中移除文件，参数 id 为相册的 id，path 可以有多个，文件不会被删除
+func (ws *WebServer) ReqDeleteAlbumPhotos() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, succeed := getQueryInt64(c, "id")
+		if !succeed {
+			return
+		}
+		album, succeed := ws.getAlbum(c, id)
+		if !succeed {
+			return
+		}
+		paths := []string{}
+		for _, path := range c.QueryArray("path") {
+			path, ok := cleanPath(path)
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"code": 1000, "message": "Invalid path"})
+				return
+			}
+			paths = append(paths, path)
+		}
+		if len(paths) == 0 || len(paths) > photoMaxAlbumPaths {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "path is invalid"})
+			return
+		}
+		if err := ws.Database.DeleteAlbumPhotos(album.Id, paths); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "delete photos succeed"})
+	}
+}
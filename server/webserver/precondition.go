@@ -0,0 +1,116 @@
+package webserver
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 写入文件前的并发检查
+// 客户端可以传入读取文件时得到的修改时间（expected_mtime）、大小（expected_size）、
+// 内容的 sha256（expected_hash）或 If-Match 头（下载文件时返回的 ETag），传入多个时都要符合
+// expected_mtime 为 RFC3339 格式（如 2006-01-02T15:04:05.999999999+08:00）时按纳秒比较，
+// 为 2006-01-02 15:04:05 格式时只能按秒比较，同一秒内的修改检查不出来，需要准确判断时使用 ETag 或 expected_hash
+// 文件已经被修改或删除时拒绝写入，返回错误码 1008 和文件当前的信息，由客户端提示合并或覆盖
+
+type filePrecondition struct {
+	ifMatch string    // If-Match 头
+	mtime   time.Time // 为零时不检查
+	exact   bool      // mtime 是否精确到纳秒
+	size    int64     // 小于 0 时不检查
+	hash    string
+}
+
+func errFileModified(current gin.H) *FileOpError {
+	return &FileOpError{
+		Status:  http.StatusConflict,
+		Code:    1008,
+		Message: "file has been modified",
+		Data:    current,
+	}
+}
+
+// getFilePrecondition 获取写入文件的前置条件
+func getFilePrecondition(c *gin.Context) (filePrecondition, bool) {
+	p := filePrecondition{
+		ifMatch: c.GetHeader("If-Match"),
+		hash:    strings.ToLower(c.Query("expected_hash")),
+	}
+	if val := c.Query("expected_mtime"); val != "" {
+		if mtime, err := time.Parse(time.RFC3339Nano, val); err == nil {
+			p.mtime, p.exact = mtime, true
+		} else if mtime, err := time.ParseInLocation(time.DateTime, val, time.Local); err == nil {
+			p.mtime = mtime
+		} else {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "expected_mtime is invalid"})
+			return p, false
+		}
+	}
+	size, succeed := getQueryInt64Default(c, "expected_size", -1)
+	if !succeed {
+		return p, false
+	}
+	p.size = size
+	return p, true
+}
+
+func (p filePrecondition) empty() bool {
+	return p.ifMatch == "" && p.mtime.IsZero() && p.size < 0 && p.hash == ""
+}
+
+// matchMtime 判断文件的修改时间是否和 expected_mtime 一致
+func (p filePrecondition) matchMtime(modTime time.Time) bool {
+	if p.mtime.IsZero() {
+		return true
+	}
+	if p.exact {
+		return modTime.UnixNano() == p.mtime.UnixNano()
+	}
+	return modTime.Truncate(time.Second).Equal(p.mtime)
+}
+
+// ifMatchETag 判断 If-Match 中是否有和 etag 相同的值，按强比较，弱 ETag 不匹配
+func ifMatchETag(header string, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// check 检查文件是否符合前置条件，不符合时返回包含文件当前信息的错误
+func (p filePrecondition) check(realPath string) error {
+	if p.empty() {
+		return nil
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		return errFileModified(gin.H{"exist": false})
+	}
+	etag := fileETag(info)
+	matched := (p.ifMatch == "" || ifMatchETag(p.ifMatch, etag)) &&
+		p.matchMtime(info.ModTime()) &&
+		(p.size < 0 || p.size == info.Size())
+	current := gin.H{
+		"exist":       true,
+		"size":        info.Size(),
+		"modified_at": info.ModTime().Format(time.DateTime),
+		"mtime":       info.ModTime().Format(time.RFC3339Nano),
+		"etag":        etag,
+	}
+	// 只在传入 expected_hash 时计算文件内容的 sha256
+	if p.hash != "" && matched {
+		hash := hashFile(realPath)
+		current["hash"] = hash
+		matched = hash == p.hash
+	}
+	if matched {
+		return nil
+	}
+	return errFileModified(current)
+}
@@ -0,0 +1,83 @@
+package webserver
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIfMatchETag(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"a-1"`, true},
+		{` "b-2" , "a-1" `, true},
+		{`*`, true},
+		{`W/"a-1"`, false},
+		{`"b-2"`, false},
+		{`a-1`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := ifMatchETag(tt.header, `"a-1"`); got != tt.want {
+			t.Errorf("ifMatchETag(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestFilePreconditionCheck(t *testing.T) {
+	realPath := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(realPath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 600, time.Local)
+	if err := os.Chtimes(realPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256("hello")
+	const hash = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	tests := []struct {
+		name  string
+		p     filePrecondition
+		path  string
+		match bool
+	}{
+		{"empty", filePrecondition{size: -1}, realPath, true},
+		{"empty missing file", filePrecondition{size: -1}, realPath + ".missing", true},
+		{"etag matched", filePrecondition{ifMatch: fileETag(info), size: -1}, realPath, true},
+		{"etag changed", filePrecondition{ifMatch: `"0-5"`, size: -1}, realPath, false},
+		{"size matched", filePrecondition{size: 5}, realPath, true},
+		{"size changed", filePrecondition{size: 4}, realPath, false},
+		{"exact mtime matched", filePrecondition{mtime: modTime, exact: true, size: -1}, realPath, true},
+		{"exact mtime changed", filePrecondition{mtime: modTime.Truncate(time.Second), exact: true, size: -1}, realPath, false},
+		{"second mtime matched", filePrecondition{mtime: modTime.Truncate(time.Second), size: -1}, realPath, true},
+		{"second mtime changed", filePrecondition{mtime: modTime.Add(-time.Second).Truncate(time.Second), size: -1}, realPath, false},
+		{"hash matched", filePrecondition{hash: hash, size: -1}, realPath, true},
+		{"hash changed", filePrecondition{hash: "00", size: -1}, realPath, false},
+		{"all matched", filePrecondition{ifMatch: fileETag(info), mtime: modTime, exact: true, size: 5, hash: hash}, realPath, true},
+		{"one changed", filePrecondition{ifMatch: fileETag(info), size: 4, hash: hash}, realPath, false},
+		{"missing file", filePrecondition{size: 5}, realPath + ".missing", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.p.check(tt.path)
+			if tt.match {
+				if err != nil {
+					t.Errorf("check = %v, want nil", err)
+				}
+				return
+			}
+			var opErr *FileOpError
+			if !errors.As(err, &opErr) || opErr.Code != 1008 {
+				t.Errorf("check = %v, want file modified error", err)
+			}
+		})
+	}
+}
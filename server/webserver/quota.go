@@ -0,0 +1,242 @@
+package webserver
+
+import (
+	"io/fs"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 空间配额
+// 用户的已使用空间为根目录下所有文件的大小，保存在数据库中，写入和删除文件时增减，并定时按实际大小校正
+// 写入的路径在多个用户的根目录下时（如挂载给其他用户的目录），同时计入这些用户的已使用空间
+// 移动文件时只增减源和目标不在同一个根目录下的用户的已使用空间
+// 回收站和历史版本保存在临时目录中，计入文件所属用户的已使用空间，见 getPathOwner
+
+// getQuotaUsers 获取根目录包含该路径的用户
+func (ws *WebServer) getQuotaUsers(realPath string) []db.UserEntry {
+	users := []db.UserEntry{}
+	allUsers, err := ws.Database.GetUsers()
+	if err != nil {
+		return users
+	}
+	for _, user := range allUsers {
+		if isSubPath(filepath.Join(ws.RootDir, user.RootDir), realPath) {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// getPathOwner 获取路径所属的用户，回收站和历史版本计入该用户的已使用空间
+// 所属用户为根目录包含该路径的用户中根目录最深的用户（如管理员操作了其他用户根目录下的文件），根目录相同时优先操作的用户
+// 都不包含时（如通过挂载访问了所有用户根目录以外的目录）为操作的用户，返回的用户信息从数据库中重新读取
+func (ws *WebServer) getPathOwner(userEntry db.UserEntry, realPath string) db.UserEntry {
+	owner := userEntry
+	if user, err := ws.Database.GetUserById(userEntry.Id); err == nil {
+		owner = user
+	}
+	ownerRoot := ""
+	for _, user := range ws.getQuotaUsers(realPath) {
+		rootDir := filepath.Join(ws.RootDir, user.RootDir)
+		if len(rootDir) > len(ownerRoot) || (len(rootDir) == len(ownerRoot) && user.Id == userEntry.Id) {
+			owner, ownerRoot = user, rootDir
+		}
+	}
+	return owner
+}
+
+// getAvailableSize 获取用户剩余的空间，不限制时返回-1
+func getAvailableSize(user db.UserEntry) int64 {
+	if user.Quota <= 0 {
+		return -1
+	}
+	if user.UsedSize >= user.Quota {
+		return 0
+	}
+	return user.Quota - user.UsedSize
+}
+
+// getPathAvailableSize 获取在该路径还能写入的大小，取相关用户剩余空间的最小值，都不限制时返回-1
+func (ws *WebServer) getPathAvailableSize(realPath string) int64 {
+	available := int64(-1)
+	for _, user := range ws.getQuotaUsers(realPath) {
+		if size := getAvailableSize(user); size >= 0 && (available < 0 || size < available) {
+			available = size
+		}
+	}
+	return available
+}
+
+// getPathSize 获取文件或目录的大小，目录优先从文件索引中统计，索引还没有建立时遍历目录
+func (ws *WebServer) getPathSize(realPath string) int64 {
+	info, err := os.Stat(realPath)
+	if err != nil {
+		return 0
+	}
+	if !info.IsDir() {
+		return info.Size()
+	}
+	if _, _, size, ok := ws.Indexer.dirSize(realPath, false); ok {
+		return size
+	}
+	_, _, size := lib.CalcDir(realPath, false, nil)
+	return size
+}
+
+// quotaError 检查在该路径写入 size 字节后是否超过配额，超过时返回错误
+func (ws *WebServer) quotaError(realPath string, size int64) error {
+	return usersQuotaError(ws.getQuotaUsers(realPath), size)
+}
+
+// usersQuotaError 检查这些用户增加 size 字节后是否超过配额，超过时返回错误
+func usersQuotaError(users []db.UserEntry, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	for _, user := range users {
+		if user.Quota <= 0 || user.UsedSize+size <= user.Quota {
+			continue
+		}
+		return &FileOpError{
+			Status:  http.StatusOK,
+			Code:    1005,
+			Message: "空间不足",
+			Data: gin.H{
+				"user_id":   user.Id,
+				"quota":     user.Quota,
+				"used_size": user.UsedSize,
+				"available": getAvailableSize(user),
+				"required":  size,
+			},
+		}
+	}
+	return nil
+}
+
+// exceededQuotaError 请求的数据超过剩余空间 available 时返回的错误
+func (ws *WebServer) exceededQuotaError(realPath string, available int64) error {
+	if err := ws.quotaError(realPath, available+1); err != nil {
+		return err
+	}
+	return newFileOpError(http.StatusOK, 1005, "空间不足")
+}
+
+// checkQuota 检查在该路径写入 size 字节后是否超过配额，超过时返回错误
+func (ws *WebServer) checkQuota(c *gin.Context, realPath string, size int64) bool {
+	if err := ws.quotaError(realPath, size); err != nil {
+		writeFileOpError(c, err)
+		return false
+	}
+	return true
+}
+
+// addUsedSize 在该路径写入或删除文件后，增减相关用户的已使用空间
+func (ws *WebServer) addUsedSize(realPath string, delta int64) {
+	if delta == 0 {
+		return
+	}
+	for _, user := range ws.getQuotaUsers(realPath) {
+		ws.Database.AddUserUsedSize(user.Id, delta)
+	}
+}
+
+// getMoveQuotaUsers 获取移动文件时已使用空间会变化的用户，removed 为只包含源路径的用户，added 为只包含目标路径的用户
+// 源和目标都在根目录下的用户，移动后已使用空间不变
+func (ws *WebServer) getMoveQuotaUsers(srcPath string, dstPath string) (removed []db.UserEntry, added []db.UserEntry) {
+	srcUsers := ws.getQuotaUsers(srcPath)
+	dstUsers := ws.getQuotaUsers(dstPath)
+	contains := func(users []db.UserEntry, user db.UserEntry) bool {
+		return slices.ContainsFunc(users, func(v db.UserEntry) bool { return v.Id == user.Id })
+	}
+	for _, user := range srcUsers {
+		if !contains(dstUsers, user) {
+			removed = append(removed, user)
+		}
+	}
+	for _, user := range dstUsers {
+		if !contains(srcUsers, user) {
+			added = append(added, user)
+		}
+	}
+	return removed, added
+}
+
+// calcUsedSize 统计根目录下所有文件的大小，不包括服务的临时目录
+// 优先从文件索引中统计（索引中不包括临时目录），索引还没有建立时遍历目录
+func (ws *WebServer) calcUsedSize(rootDir string) int64 {
+	if _, _, size, ok := ws.Indexer.dirSize(rootDir, false); ok {
+		return size
+	}
+	size := int64(0)
+	filepath.WalkDir(rootDir, func(realPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			if isSubPath(ws.TempDir, realPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// getExtraUsedSize 获取用户在回收站和历史版本中占用的空间
+func (ws *WebServer) getExtraUsedSize(userId int64) int64 {
+	trashSize, _ := ws.Database.GetUserTrashSize(userId)
+	versionSize, _ := ws.Database.GetUserFileVersionSize(userId)
+	return trashSize + versionSize
+}
+
+// getQuotaUsedSizes 获取根目录为 rootDir 的用户当前记录的已使用空间
+func (ws *WebServer) getQuotaUsedSizes(rootDir string) map[int64]int64 {
+	usedSizes := make(map[int64]int64)
+	users, err := ws.Database.GetUsers()
+	if err != nil {
+		return usedSizes
+	}
+	for _, user := range users {
+		if filepath.Join(ws.RootDir, user.RootDir) == rootDir {
+			usedSizes[user.Id] = user.UsedSize
+		}
+	}
+	return usedSizes
+}
+
+// ReconcileUsedSize 按实际大小校正所有用户的已使用空间，根目录相同的用户只统计一次
+// 没有设置配额的用户也需要校正，已使用空间减到 0 以下时会被截断，之后设置配额时不能按偏差的值限制
+// 统计前记录已使用空间，统计后只增减差值，统计期间写入和删除文件时记录的增减不会被覆盖
+func (ws *WebServer) ReconcileUsedSize() {
+	users, err := ws.Database.GetUsers()
+	if err != nil {
+		return
+	}
+	rootDirs := []string{}
+	for _, user := range users {
+		rootDir := filepath.Join(ws.RootDir, user.RootDir)
+		if !slices.Contains(rootDirs, rootDir) {
+			rootDirs = append(rootDirs, rootDir)
+		}
+	}
+	for _, rootDir := range rootDirs {
+		usedSizes := ws.getQuotaUsedSizes(rootDir)
+		size := ws.calcUsedSize(rootDir)
+		for userId, usedSize := range usedSizes {
+			actualSize := size + ws.getExtraUsedSize(userId)
+			if actualSize != usedSize {
+				ws.Database.AddUserUsedSize(userId, actualSize-usedSize)
+			}
+		}
+	}
+}
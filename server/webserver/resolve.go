@@ -0,0 +1,225 @@
+package webserver
+
+import (
+	"errors"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 路径解析
+// 所有文件操作都通过这里把用户传入的路径转换为服务器上的路径，路径中的符号链接按配置的策略处理：
+//   deny        不允许访问路径中的任何符号链接
+//   within_root 符号链接指向的位置必须在所在的根目录（用户的根目录或挂载的目录）下，默认的策略
+//   allow       允许访问符号链接指向的任何位置
+// 不管哪种策略，符号链接指向服务根目录下的其他位置时，也需要对指向的位置有访问权限
+
+const (
+	SymlinkPolicyDeny       = "deny"
+	SymlinkPolicyWithinRoot = "within_root"
+	SymlinkPolicyAllow      = "allow"
+)
+
+var (
+	ErrPathInvalid   = errors.New("invalid path")
+	ErrPathOutside   = errors.New("path is outside of root")
+	ErrSymlinkDenied = errors.New("symlink is not allowed")
+	ErrAccessDenied  = errors.New("permission denied")
+)
+
+// PathError 路径解析失败的错误，Path 为用户传入的路径
+type PathError struct {
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return e.Err.Error() + ": " + e.Path
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// getSymlinkPolicy 获取符号链接的策略，没有配置或配置错误时使用 within_root
+func (ws *WebServer) getSymlinkPolicy() string {
+	switch ws.SymlinkPolicy {
+	case SymlinkPolicyDeny, SymlinkPolicyAllow:
+		return ws.SymlinkPolicy
+	}
+	return SymlinkPolicyWithinRoot
+}
+
+// resolveSafePath 解析 base 下的相对路径 rel，base 为可信的根目录，rel 中的符号链接按策略处理
+// followLast 为 false 时不解析最后一级，用于删除、重命名和移动等操作链接本身的场景
+// 返回的路径在 base 下时仍以 base 开头，以便和数据库中保存的路径比较
+func (ws *WebServer) resolveSafePath(base string, rel string, followLast bool) (string, error) {
+	target := filepath.Join(base, rel)
+	if !isSubPath(base, target) {
+		return "", &PathError{Path: rel, Err: ErrPathOutside}
+	}
+	baseReal, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		// 根目录不存在时，其中也不会有符号链接
+		if os.IsNotExist(err) {
+			return target, nil
+		}
+		return "", &PathError{Path: rel, Err: err}
+	}
+
+	checkPath := target
+	last := ""
+	if !followLast && target != base {
+		checkPath = filepath.Dir(target)
+		last = filepath.Base(target)
+	}
+	// 只能解析已存在的部分，不存在的部分（如要创建的文件）原样拼接
+	existing := checkPath
+	rest := ""
+	for existing != base {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		// 指向的位置不存在的符号链接
+		if os.IsNotExist(err) && ws.getSymlinkPolicy() == SymlinkPolicyDeny {
+			return "", &PathError{Path: rel, Err: ErrSymlinkDenied}
+		}
+		return "", &PathError{Path: rel, Err: err}
+	}
+	resolved = filepath.Join(resolved, rest)
+	relPath, _ := filepath.Rel(base, checkPath)
+	if resolved == filepath.Join(baseReal, relPath) {
+		return target, nil
+	}
+
+	// 路径中有符号链接
+	switch ws.getSymlinkPolicy() {
+	case SymlinkPolicyDeny:
+		return "", &PathError{Path: rel, Err: ErrSymlinkDenied}
+	case SymlinkPolicyWithinRoot:
+		if !isSubPath(baseReal, resolved) {
+			return "", &PathError{Path: rel, Err: ErrPathOutside}
+		}
+		relPath, _ = filepath.Rel(baseReal, resolved)
+		return filepath.Join(base, relPath, last), nil
+	}
+	// 指向的位置在服务根目录下时，转换为以服务根目录开头的路径
+	rootReal, err := filepath.EvalSymlinks(ws.RootDir)
+	if err == nil && isSubPath(rootReal, resolved) {
+		relPath, _ = filepath.Rel(rootReal, resolved)
+		resolved = filepath.Join(ws.RootDir, relPath)
+	}
+	return filepath.Join(resolved, last), nil
+}
+
+// resolveUserRealPath 把用户看到的路径转换为服务器上的路径，并校验访问权限
+func (ws *WebServer) resolveUserRealPath(userEntry db.UserEntry, path string, access string, followLast bool) (string, error) {
+	base, rel := ws.resolveUserPath(userEntry, path)
+	level := db.AclAccessLevel(access)
+	if ws.getPathAccess(userEntry, filepath.Join(base, rel)) < level {
+		return "", &PathError{Path: path, Err: ErrAccessDenied}
+	}
+	realPath, err := ws.resolveSafePath(base, rel, followLast)
+	if err != nil {
+		return "", &PathError{Path: path, Err: errors.Unwrap(err)}
+	}
+	// 符号链接指向服务根目录下的其他位置时，不能借此获得更高的权限
+	if realPath != filepath.Join(base, rel) && isSubPath(ws.RootDir, realPath) &&
+		ws.getPathAccess(userEntry, realPath) < level {
+		return "", &PathError{Path: path, Err: ErrAccessDenied}
+	}
+	return realPath, nil
+}
+
+// writePathError 按路径解析的错误类型返回错误
+func writePathError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrPathInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"code": 1000, "message": "Invalid path"})
+	case errors.Is(err, ErrAccessDenied):
+		c.JSON(http.StatusOK, gin.H{"code": 1009, "message": "permission denied"})
+	case errors.Is(err, ErrPathOutside), errors.Is(err, ErrSymlinkDenied):
+		c.JSON(http.StatusOK, gin.H{"code": 1009, "message": errors.Unwrap(err).Error()})
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "File or directory not found"})
+	default:
+		lib.Logger.Error("resolve path failed!", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "resolve path failed"})
+	}
+}
+
+// resolvePath 把登录用户看到的路径转换为服务器上的路径，并校验访问权限，失败时返回错误
+func (ws *WebServer) resolvePath(c *gin.Context, path string, access string) (string, bool) {
+	loginUserInfo := getLoginUser(c)
+	realPath, err := ws.resolveUserRealPath(loginUserInfo.UserEntry, path, access, true)
+	if err != nil {
+		writePathError(c, err)
+		return "", false
+	}
+	return realPath, true
+}
+
+// resolveEntryPath 和 resolvePath 相同，但最后一级是符号链接时返回链接本身，用于删除、重命名和移动
+func (ws *WebServer) resolveEntryPath(c *gin.Context, path string, access string) (string, bool) {
+	loginUserInfo := getLoginUser(c)
+	realPath, err := ws.resolveUserRealPath(loginUserInfo.UserEntry, path, access, false)
+	if err != nil {
+		writePathError(c, err)
+		return "", false
+	}
+	return realPath, true
+}
+
+// resolveSharedPath 把分享中的路径转换为服务器上的路径，path 为相对于分享目录的路径
+// 分享的路径在创建时已经转换为相对于服务根目录的路径，不再受创建者根目录变化的影响
+func (ws *WebServer) resolveSharedPath(c *gin.Context, sharedEntry db.SharedEntry, path string) (string, bool) {
+	relPath, succeed := cleanPath(path)
+	if !succeed {
+		writePathError(c, &PathError{Path: path, Err: ErrPathInvalid})
+		return "", false
+	}
+	realPath, err := ws.resolveSafePath(ws.RootDir, filepath.Join(sharedEntry.Path, relPath), true)
+	if err != nil {
+		writePathError(c, err)
+		return "", false
+	}
+	return realPath, true
+}
+
+// symlinkChecker 返回打包目录时判断是否包含符号链接的函数，base 为打包的目录所在的根目录
+// userEntry 不为空时，还需要对链接指向的位置有读取权限
+func (ws *WebServer) symlinkChecker(base string, userEntry *db.UserEntry) func(string) bool {
+	return func(path string) bool {
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return false
+		}
+		realPath, err := ws.resolveSafePath(base, rel, true)
+		if err != nil {
+			return false
+		}
+		if userEntry != nil && isSubPath(ws.RootDir, realPath) &&
+			ws.getPathAccess(*userEntry, realPath) < db.AclAccessLevel(db.AclAccessRead) {
+			return false
+		}
+		return true
+	}
+}
+
+// joinPath 拼接用户看到的目录和文件名，文件名不能包含路径分隔符
+func joinPath(dir string, name string) (string, bool) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", false
+	}
+	return dir + "/" + name, true
+}
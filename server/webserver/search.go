@@ -0,0 +1,381 @@
+package webserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文件搜索
+// 从指定的目录开始按文件名排序遍历，按文件名、类型、大小、修改时间过滤，可以用正则表达式搜索文本文件的内容
+// 结果按 page 和 page_size 分页，has_more 表示是否还有下一页
+// 不进入指向目录的符号链接，用户的根目录下同时搜索挂载的目录
+// 文件索引建立完成后从索引中查询，结果按路径排序
+
+const (
+	searchDefaultPageSize = 100
+	searchMaxPageSize     = 1000
+	// 只搜索不超过该大小的文本文件的内容
+	searchMaxContentSize = 10 * 1024 * 1024
+	// 每个文件最多返回的匹配行数和每行的长度
+	searchMaxMatches   = 5
+	searchMaxMatchText = 200
+	searchMaxPattern   = 1000
+)
+
+type SearchMatch struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type SearchResult struct {
+	lib.FileEntry
+	Path    string        `json:"path"`           // 用户看到的路径
+	Hash    string        `json:"hash,omitempty"` // 从索引中查询时返回文件内容的 sha256
+	Matches []SearchMatch `json:"matches,omitempty"`
+}
+
+type searcher struct {
+	ctx          context.Context
+	root         string // 服务根目录，从索引中查询时用于找到文件
+	name         string // 文件名中包含的字符串或通配符，不区分大小写
+	glob         bool
+	fileType     string // file 或 dir，为空时不限
+	exts         []string
+	minSize      int64
+	maxSize      int64
+	after        time.Time
+	before       time.Time
+	content      *regexp.Regexp
+	hideDotFiles bool
+	allowSymlink func(string) bool // 是否可以读取符号链接指向的文件的内容
+	skip         int
+	limit        int
+	results      []SearchResult
+	hasMore      bool
+}
+
+// getQueryInt64Default 获取可选的整数参数，没有传入时返回默认值
+func getQueryInt64Default(c *gin.Context, key string, defaultValue int64) (int64, bool) {
+	if c.Query(key) == "" {
+		return defaultValue, true
+	}
+	return getQueryInt64(c, key)
+}
+
+// getQueryTime 获取可选的时间参数，格式为 2006-01-02 15:04:05 或 2006-01-02
+func getQueryTime(c *gin.Context, key string) (time.Time, bool) {
+	val := c.Query(key)
+	if val == "" {
+		return time.Time{}, true
+	}
+	for _, layout := range []string{time.DateTime, time.DateOnly} {
+		t, err := time.ParseInLocation(layout, val, time.Local)
+		if err == nil {
+			return t, true
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1000,
+		"message": key + " is invalid",
+	})
+	return time.Time{}, false
+}
+
+func (s *searcher) matchName(name string) bool {
+	if s.name == "" {
+		return true
+	}
+	name = strings.ToLower(name)
+	if s.glob {
+		matched, _ := filepath.Match(s.name, name)
+		return matched
+	}
+	return strings.Contains(name, s.name)
+}
+
+// matchInfo 按文件名、类型、大小和修改时间过滤
+func (s *searcher) matchInfo(info os.FileInfo) bool {
+	if !s.matchName(info.Name()) {
+		return false
+	}
+	if s.fileType == "file" && info.IsDir() || s.fileType == "dir" && !info.IsDir() {
+		return false
+	}
+	if len(s.exts) > 0 {
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(info.Name()), "."))
+		found := false
+		for _, v := range s.exts {
+			if v == ext {
+				found = true
+				break
+			}
+		}
+		if !found || info.IsDir() {
+			return false
+		}
+	}
+	if s.minSize >= 0 && info.Size() < s.minSize || s.maxSize >= 0 && info.Size() > s.maxSize {
+		return false
+	}
+	if !s.after.IsZero() && info.ModTime().Before(s.after) || !s.before.IsZero() && !info.ModTime().Before(s.before) {
+		return false
+	}
+	return true
+}
+
+// matchContent 搜索文本文件的内容，返回匹配的行，二进制文件和过大的文件不搜索
+func (s *searcher) matchContent(realPath string, info os.FileInfo) []SearchMatch {
+	if info.Mode()&os.ModeSymlink != 0 {
+		if s.allowSymlink == nil || !s.allowSymlink(realPath) {
+			return nil
+		}
+		target, err := os.Stat(realPath)
+		if err != nil {
+			return nil
+		}
+		info = target
+	}
+	if !info.Mode().IsRegular() || info.Size() > searchMaxContentSize {
+		return nil
+	}
+	f, err := os.Open(realPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	// 开头包含空字符的按二进制文件处理
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if bytes.IndexByte(head[:n], 0) >= 0 {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	matches := []SearchMatch{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if !s.content.MatchString(text) {
+			continue
+		}
+		if runes := []rune(text); len(runes) > searchMaxMatchText {
+			text = string(runes[:searchMaxMatchText])
+		}
+		matches = append(matches, SearchMatch{Line: line, Text: text})
+		if len(matches) >= searchMaxMatches {
+			break
+		}
+	}
+	return matches
+}
+
+func newSearchResult(userPath string, name string, info os.FileInfo) SearchResult {
+	return SearchResult{
+		FileEntry: lib.FileEntry{
+			Host:       runtime.GOOS,
+			Name:       name,
+			Size:       info.Size(),
+			FileMode:   uint32(info.Mode()),
+			IsDir:      info.IsDir(),
+			CreatedAt:  lib.GetFileCreateTime(info).Format(time.DateTime),
+			ModifiedAt: info.ModTime().Format(time.DateTime),
+		},
+		Path: userPath,
+	}
+}
+
+// add 记录匹配的文件，返回 false 时已经找到足够的结果，停止搜索
+func (s *searcher) add(result SearchResult) bool {
+	if s.skip > 0 {
+		s.skip--
+		return true
+	}
+	if len(s.results) >= s.limit {
+		s.hasMore = true
+		return false
+	}
+	s.results = append(s.results, result)
+	return true
+}
+
+// walk 搜索目录，userDir 为用户看到的路径，skipNames 为被挂载的目录覆盖的名称
+// 返回 false 时停止搜索
+func (s *searcher) walk(userDir string, realDir string, skipNames map[string]bool) bool {
+	entries, err := os.ReadDir(realDir)
+	if err != nil {
+		return true
+	}
+	for _, entry := range entries {
+		if s.ctx.Err() != nil {
+			return false
+		}
+		if skipNames[entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if s.hideDotFiles && lib.IsHideFile(info) {
+			continue
+		}
+		userPath := userDir + "/" + entry.Name()
+		realPath := filepath.Join(realDir, entry.Name())
+		if s.matchInfo(info) {
+			result := newSearchResult(userPath, info.Name(), info)
+			matched := true
+			if s.content != nil {
+				result.Matches = s.matchContent(realPath, info)
+				matched = len(result.Matches) > 0
+			}
+			if matched && !s.add(result) {
+				return false
+			}
+		}
+		// 不进入指向目录的符号链接，避免离开根目录和出现循环
+		if entry.IsDir() && !s.walk(userPath, realPath, nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReqSearchFiles 搜索文件
+// 参数：path 开始搜索的目录，name 文件名中包含的字符串或通配符（* ? []），type 为 file 或 dir，
+// ext 扩展名（多个用逗号分隔），min_size、max_size 文件大小，modified_after、modified_before 修改时间，
+// content 搜索文本文件内容的正则表达式，page、page_size 分页
+func (ws *WebServer) ReqSearchFiles() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path, succeed := getPath(c)
+		if !succeed {
+			return
+		}
+		realPath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+		if !succeed {
+			return
+		}
+		if info, err := os.Stat(realPath); err != nil || !info.IsDir() {
+			c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "Directory not found"})
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		s := &searcher{
+			ctx:          c.Request.Context(),
+			root:         ws.RootDir,
+			name:         strings.ToLower(c.Query("name")),
+			fileType:     c.Query("type"),
+			hideDotFiles: !loginUserInfo.UserEntry.ShowDotFiles,
+			results:      []SearchResult{},
+		}
+		s.glob = strings.ContainsAny(s.name, "*?[")
+		if s.glob {
+			if _, err := filepath.Match(s.name, ""); err != nil {
+				c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "name is invalid"})
+				return
+			}
+		}
+		if s.fileType != "" && s.fileType != "file" && s.fileType != "dir" {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "type is invalid"})
+			return
+		}
+		for _, ext := range strings.Split(c.Query("ext"), ",") {
+			ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+			if ext != "" {
+				s.exts = append(s.exts, ext)
+			}
+		}
+		if s.minSize, succeed = getQueryInt64Default(c, "min_size", -1); !succeed {
+			return
+		}
+		if s.maxSize, succeed = getQueryInt64Default(c, "max_size", -1); !succeed {
+			return
+		}
+		if s.after, succeed = getQueryTime(c, "modified_after"); !succeed {
+			return
+		}
+		if s.before, succeed = getQueryTime(c, "modified_before"); !succeed {
+			return
+		}
+		if pattern := c.Query("content"); pattern != "" {
+			content, err := regexp.Compile(pattern)
+			if err != nil || len(pattern) > searchMaxPattern {
+				c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "content is invalid"})
+				return
+			}
+			s.content = content
+		}
+		page, succeed := getQueryInt64Default(c, "page", 1)
+		if !succeed {
+			return
+		}
+		pageSize, succeed := getQueryInt64Default(c, "page_size", searchDefaultPageSize)
+		if !succeed {
+			return
+		}
+		if page < 1 || pageSize < 1 || pageSize > searchMaxPageSize {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "page is invalid"})
+			return
+		}
+		s.skip = int((page - 1) * pageSize)
+		s.limit = int(pageSize)
+
+		// 在用户的根目录下搜索时，先搜索挂载的目录，根目录下同名的文件被挂载的目录覆盖
+		var skipNames map[string]bool
+		finished := true
+		if path == "" {
+			mounts := ws.getUserMounts(loginUserInfo.UserEntry)
+			skipNames = make(map[string]bool)
+			for _, mount := range mounts {
+				skipNames[mount.MountName] = true
+			}
+			for _, mount := range mounts {
+				mountPath := filepath.Join(ws.RootDir, mount.Path)
+				info, err := os.Stat(mountPath)
+				if err != nil || !info.IsDir() {
+					continue
+				}
+				userPath := "/" + mount.MountName
+				if s.content == nil && s.matchInfo(info) && !s.add(newSearchResult(userPath, mount.MountName, info)) {
+					finished = false
+					break
+				}
+				if !s.searchDir(ws, loginUserInfo.UserEntry, userPath, mountPath, mountPath, nil) {
+					finished = false
+					break
+				}
+			}
+		}
+		if finished {
+			base, _ := ws.resolveUserPath(loginUserInfo.UserEntry, path)
+			s.searchDir(ws, loginUserInfo.UserEntry, path, realPath, base, skipNames)
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data": gin.H{
+				"files":     s.results,
+				"page":      page,
+				"page_size": pageSize,
+				"has_more":  s.hasMore,
+			},
+		})
+	}
+}
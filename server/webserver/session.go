@@ -0,0 +1,323 @@
+package webserver
+
+import (
+	"crypto/subtle"
+	"errors"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SessionIdleTimeout = 7 * 24 * time.Hour  // 上次登录时间超过7天，会话过期
+	SessionMaxLifetime = 30 * 24 * time.Hour // 第一次登录时间超过30天，会话过期
+	loginUserKey       = "login_user"        // 保存在 gin.Context 中的登录用户信息
+)
+
+// getSessionCredential 依次从 cookie、head、参数中获取会话ID和用户令牌
+func getSessionCredential(c *gin.Context) (string, string) {
+	// 通过cookie校验用户身份
+	userSessionId, _ := c.Cookie("session-id")
+	userToken, _ := c.Cookie("user-token")
+	// 通过head校验用户身份
+	if userSessionId == "" && userToken == "" {
+		userSessionId = c.GetHeader("session-id")
+		userToken = c.GetHeader("user-token")
+	}
+	// 通过参数校验用户身份
+	if userSessionId == "" && userToken == "" {
+		userSessionId = c.Query("session-id")
+		userToken = c.Query("user-token")
+	}
+	return userSessionId, userToken
+}
+
+func isSessionExpired(session db.SessionEntry) bool {
+	loginAt, err := time.ParseInLocation(time.DateTime, session.LoginAt, time.Local)
+	if err != nil {
+		return true
+	}
+	firstLoginAt, err := time.ParseInLocation(time.DateTime, session.FirstLoginAt, time.Local)
+	if err != nil {
+		return true
+	}
+	// 如果上次登录时间超过7天，就认为过期
+	// 如果第一次登录时间超过30天，也认为过期
+	return time.Since(loginAt) > SessionIdleTimeout || time.Since(firstLoginAt) > SessionMaxLifetime
+}
+
+func newUserInfo(session db.SessionEntry, userEntry db.UserEntry) UserInfo {
+	loginAt, _ := time.ParseInLocation(time.DateTime, session.LoginAt, time.Local)
+	firstLoginAt, _ := time.ParseInLocation(time.DateTime, session.FirstLoginAt, time.Local)
+	return UserInfo{
+		SessionId:    session.SessionId,
+		UserName:     session.UserName,
+		UserToken:    session.UserToken,
+		LoginAt:      loginAt,
+		FirstLoginAt: firstLoginAt,
+		UserEntry:    userEntry,
+	}
+}
+
+// loadSession 从数据库中读取会话，过期的会话会被删除
+func loadSession(sessionId string) (db.SessionEntry, error) {
+	database := GetInstance().Database
+	if database == nil {
+		return db.SessionEntry{}, errors.New("database is not ready")
+	}
+	session, err := database.GetSession(sessionId)
+	if err != nil {
+		return session, err
+	}
+	if isSessionExpired(session) {
+		database.DeleteSession(sessionId)
+		return session, errors.New("session expired")
+	}
+	return session, nil
+}
+
+// authenticate 校验会话ID和用户令牌，返回登录用户的信息
+// 请求中带有 Authorization: Bearer 时使用个人访问令牌校验
+func authenticate(c *gin.Context) (UserInfo, bool) {
+	if token, ok := getBearerToken(c); ok {
+		return authenticateApiToken(c, token)
+	}
+	userSessionId, userToken := getSessionCredential(c)
+	if userSessionId == "" || userToken == "" {
+		return UserInfo{}, false
+	}
+	session, err := loadSession(userSessionId)
+	if err != nil {
+		lib.Logger.Info("user not login! session_id:", sessionPrefix(userSessionId), " err:", err)
+		return UserInfo{}, false
+	}
+	if !checkUserToken(session, userToken) {
+		lib.Logger.Info("check user token failed! session_id:", sessionPrefix(userSessionId))
+		return UserInfo{}, false
+	}
+	userEntry, err := GetInstance().Database.GetUserById(session.UserId)
+	if err != nil || !userEntry.Enabled {
+		lib.Logger.Info("user not found or disabled! user_id:", session.UserId)
+		return UserInfo{}, false
+	}
+	userInfo := newUserInfo(session, userEntry)
+	c.Set(loginUserKey, userInfo)
+	return userInfo, true
+}
+
+// checkUserToken 校验用户令牌是否和会话中的一致，按固定时间比较
+func checkUserToken(session db.SessionEntry, userToken string) bool {
+	return subtle.ConstantTimeCompare([]byte(session.UserToken), []byte(userToken)) == 1
+}
+
+// newSessionId 生成一个不存在的会话ID
+func newSessionId() string {
+	for {
+		userSessionId, _ := lib.GenerateRandomString(16)
+		if !GetInstance().Database.IsExistSession(userSessionId) {
+			return userSessionId
+		}
+	}
+}
+
+const sessionPrefixLength = 8 // 对外展示的会话ID前缀长度，完整的会话ID不对外展示
+
+type SessionInfo struct {
+	Session      string `json:"session"`        // 会话ID前缀
+	Ip           string `json:"ip"`             // 登录的 IP
+	UserAgent    string `json:"user_agent"`     // 客户端信息
+	LoginAt      string `json:"login_at"`       // 最近一次登录时间
+	FirstLoginAt string `json:"first_login_at"` // 第一次登录时间
+	Current      bool   `json:"current"`        // 是否是当前请求使用的会话
+}
+
+func sessionPrefix(sessionId string) string {
+	if len(sessionId) <= sessionPrefixLength {
+		return sessionId
+	}
+	return sessionId[:sessionPrefixLength]
+}
+
+// getSessionUserId 获取要管理的会话所属的用户，非管理员只能管理自己的会话
+func getSessionUserId(c *gin.Context, loginUserInfo UserInfo) (int64, bool) {
+	_user_id := c.Query("user_id")
+	if _user_id == "" {
+		return loginUserInfo.UserEntry.Id, true
+	}
+	user_id, err := strconv.ParseInt(_user_id, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    1000,
+			"message": err.Error(),
+		})
+		return 0, false
+	}
+	if user_id != loginUserInfo.UserEntry.Id && !loginUserInfo.UserEntry.IsAdmin {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    1000,
+			"message": "permission denied",
+		})
+		return 0, false
+	}
+	return user_id, true
+}
+
+func (ws *WebServer) ReqGetSessionList() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		user_id, ok := getSessionUserId(c, loginUserInfo)
+		if !ok {
+			return
+		}
+		sessions, err := ws.Database.GetUserSessions(user_id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		sessionInfos := []SessionInfo{}
+		for _, session := range sessions {
+			if isSessionExpired(session) {
+				continue
+			}
+			sessionInfos = append(sessionInfos, SessionInfo{
+				Session:      sessionPrefix(session.SessionId),
+				Ip:           session.Ip,
+				UserAgent:    session.UserAgent,
+				LoginAt:      session.LoginAt,
+				FirstLoginAt: session.FirstLoginAt,
+				Current:      session.SessionId == loginUserInfo.SessionId,
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    sessionInfos,
+		})
+	}
+}
+
+// ReqDeleteSession 注销指定的会话，参数 session 为会话ID前缀
+func (ws *WebServer) ReqDeleteSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		user_id, ok := getSessionUserId(c, loginUserInfo)
+		if !ok {
+			return
+		}
+		prefix := c.Query("session")
+		if len(prefix) != sessionPrefixLength {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "session is invalid",
+			})
+			return
+		}
+		sessions, err := ws.Database.GetUserSessions(user_id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		matched := []db.SessionEntry{}
+		for _, session := range sessions {
+			if strings.HasPrefix(session.SessionId, prefix) {
+				matched = append(matched, session)
+			}
+		}
+		if len(matched) != 1 {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "session not found",
+			})
+			return
+		}
+		err = ws.Database.DeleteSession(matched[0].SessionId)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "revoke_session",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"user_id":    strconv.FormatInt(user_id, 10),
+				"session":    prefix,
+				"ip":         matched[0].Ip,
+				"user_agent": matched[0].UserAgent,
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "revoke session succeed",
+		})
+	}
+}
+
+// ReqDeleteSessions 注销用户的所有会话，即“退出所有设备”
+// 参数 keep_current=1 时保留当前请求使用的会话
+func (ws *WebServer) ReqDeleteSessions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		user_id, ok := getSessionUserId(c, loginUserInfo)
+		if !ok {
+			return
+		}
+		sessions, err := ws.Database.GetUserSessions(user_id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		keepCurrent := c.Query("keep_current") == "1"
+		count := 0
+		for _, session := range sessions {
+			if keepCurrent && session.SessionId == loginUserInfo.SessionId {
+				continue
+			}
+			err = ws.Database.DeleteSession(session.SessionId)
+			if err != nil {
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1000,
+					"message": err.Error(),
+				})
+				return
+			}
+			count++
+		}
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "revoke_all_sessions",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"user_id":      strconv.FormatInt(user_id, 10),
+				"keep_current": strconv.FormatBool(keepCurrent),
+				"count":        strconv.Itoa(count),
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "revoke sessions succeed",
+			"data":    count,
+		})
+	}
+}
@@ -104,6 +104,22 @@ func (ws *WebServer) ReqUpdateShared() gin.HandlerFunc {
 			return
 		}
 		loginUserInfo := getLoginUser(c)
+		if !checkUserPermission(c, actionShare) {
+			return
+		}
+		// 没有上传权限的用户不能创建允许上传的分享
+		if sharedEntry.CanUpload && !checkUserPermission(c, actionUpload) {
+			return
+		}
+		// 只能把分享限定给自己所在的用户组
+		if sharedEntry.GroupId != 0 && !loginUserInfo.UserEntry.IsAdmin &&
+			!ws.Database.IsGroupMember(sharedEntry.GroupId, loginUserInfo.UserEntry.Id) {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1001,
+				"message": "no permission",
+			})
+			return
+		}
 		// 判断是否有权限, 只有管理员和自己可以修改
 		if loginUserInfo.UserEntry.Id != sharedEntry.UserId && !loginUserInfo.UserEntry.IsAdmin {
 			c.JSON(http.StatusOK, gin.H{
@@ -161,6 +177,28 @@ func (ws *WebServer) ReqCreateShared() gin.HandlerFunc {
 			return
 		}
 		loginUserInfo := getLoginUser(c)
+		if !checkUserPermission(c, actionShare) {
+			return
+		}
+		// 没有上传权限的用户不能创建允许上传的分享
+		if sharedEntry.CanUpload && !checkUserPermission(c, actionUpload) {
+			return
+		}
+		// 只能把分享限定给自己所在的用户组
+		if sharedEntry.GroupId != 0 && !loginUserInfo.UserEntry.IsAdmin &&
+			!ws.Database.IsGroupMember(sharedEntry.GroupId, loginUserInfo.UserEntry.Id) {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1001,
+				"message": "no permission",
+			})
+			return
+		}
+		// 分享的路径需要有读取权限，保存为相对于服务根目录的路径
+		realPath, succeed := ws.resolvePath(c, sharedEntry.Path, db.AclAccessRead)
+		if !succeed {
+			return
+		}
+		sharedEntry.Path = ws.toServerPath(realPath)
 		sharedEntry.UserId = loginUserInfo.UserEntry.Id
 		// 生成一个随机的 sid, 直到生成的 sid 不存在为止
 		for {
@@ -218,9 +256,14 @@ func (ws *WebServer) ReqGetShared() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		sid := c.Query("sid")
 		code := c.Query("code")
+		if wait, ok := checkAttempt(attemptSharedIpKey(c.ClientIP()), attemptSharedKey(sid)); !ok {
+			tooManyAttempts(c, wait)
+			return
+		}
 		sharedEntry, err := ws.Database.GetShared(sid)
 		if err != nil {
 			lib.Logger.Error("GetShared: get shared info failed!", err)
+			recordSharedCodeFailure(c, sid)
 			c.JSON(http.StatusOK, gin.H{
 				"code":    1000,
 				"message": err.Error(),
@@ -239,6 +282,10 @@ func (ws *WebServer) ReqGetShared() gin.HandlerFunc {
 
 		}
 		if sharedEntry.Code != code {
+			// 没有提供分享码时只是查看分享的基本信息，不计入失败次数
+			if code != "" {
+				recordSharedCodeFailure(c, sid)
+			}
 			// 隐藏名字中间的一部分
 			createName := Safestring(createUserEntry.Name)
 			name := Safestring(sharedEntry.Name)
@@ -255,6 +302,14 @@ func (ws *WebServer) ReqGetShared() gin.HandlerFunc {
 			})
 			return
 		}
+		clearAttempt(attemptSharedKey(sid))
+		if !checkSharedGroup(c, sharedEntry) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code":    1000,
+				"message": "Unauthorized",
+			})
+			return
+		}
 		remain_count := -1
 		if sharedEntry.MaxCount != 0 {
 			remain_count = sharedEntry.MaxCount - sharedEntry.CurrentCount
@@ -274,6 +329,7 @@ func (ws *WebServer) ReqGetShared() gin.HandlerFunc {
 				"time_limited":       sharedEntry.TimeLimied,
 				"remain_count":       remain_count,
 				"remain_upload_size": remain_upload_size,
+				"group_id":           sharedEntry.GroupId,
 				"creator":            createUserEntry.Name,
 				"create_at":          sharedEntry.CreatedAt,
 			},
@@ -305,7 +361,10 @@ func (ws *WebServer) ReqGetSharedFiles() gin.HandlerFunc {
 			})
 			return
 		}
-		filePath := filepath.Join(ws.RootDir, userEntry.RootDir, sharedEntry.Path, path)
+		filePath, succeed := ws.resolveSharedPath(c, sharedEntry, path)
+		if !succeed {
+			return
+		}
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			lib.Logger.Error("GetShared: file not exist!", err, filePath)
 			c.JSON(http.StatusOK, gin.H{"code": 1001, "message": "File or directory not found"})
@@ -371,11 +430,9 @@ func (ws *WebServer) ReqDownloadSharedFile() gin.HandlerFunc {
 			})
 			return
 		}
-		userEntry := db.UserEntry{}
-		if sharedEntry.UserId == 0 {
-			userEntry.RootDir = "/"
-		} else {
-			userEntry, err = ws.Database.GetUserById(sharedEntry.UserId)
+		// 创建者已经被删除的分享不能再访问
+		if sharedEntry.UserId != 0 {
+			_, err = ws.Database.GetUserById(sharedEntry.UserId)
 			if err != nil {
 				c.JSON(http.StatusOK, gin.H{
 					"code":    1000,
@@ -384,7 +441,10 @@ func (ws *WebServer) ReqDownloadSharedFile() gin.HandlerFunc {
 				return
 			}
 		}
-		filePath := filepath.Join(ws.RootDir, userEntry.RootDir, sharedEntry.Path)
+		filePath, succeed := ws.resolveSharedPath(c, sharedEntry, "")
+		if !succeed {
+			return
+		}
 		// 检查文件是否存在
 		fileInfo, err := os.Stat(filePath)
 		if os.IsNotExist(err) {
@@ -397,7 +457,10 @@ func (ws *WebServer) ReqDownloadSharedFile() gin.HandlerFunc {
 			return
 		}
 		if fileInfo.IsDir() {
-			filePath = filepath.Join(filePath, path)
+			filePath, succeed = ws.resolveSharedPath(c, sharedEntry, path)
+			if !succeed {
+				return
+			}
 		}
 		fileInfo, err = os.Stat(filePath)
 		if os.IsNotExist(err) {
@@ -434,35 +497,55 @@ func (ws *WebServer) ReqDownloadSharedFile() gin.HandlerFunc {
 				return
 			}
 		}
-		sharedEntry.CurrentCount++
-		lib.Logger.Error("download file success", sharedEntry.CurrentCount, filePath)
-		err = ws.Database.UpdateShared(sharedEntry)
-		if err != nil {
-			c.JSON(http.StatusOK, gin.H{"code": 1001, "message": "File not downloadable"})
-			return
-		}
+		// 继续下载和返回 304 的请求不计入下载次数
+		if isNewDownload(c, fileInfo) {
+			sharedEntry.CurrentCount++
+			lib.Logger.Error("download file success", sharedEntry.CurrentCount, filePath)
+			err = ws.Database.UpdateShared(sharedEntry)
+			if err != nil {
+				c.JSON(http.StatusOK, gin.H{"code": 1001, "message": "File not downloadable"})
+				return
+			}
 
-		// 生成下载动作历史记录
-		historyEntry := db.SharedHistoryEntry{
-			Sid:    sid,
-			Action: "download",
-			Information: ws.getRequestInfo(c, map[string]string{
-				"path_in_shared": path,
-				"file_size":      strconv.FormatInt(fileInfo.Size(), 10),
-				"download_type":  "file",
-			}),
-			Ip: c.ClientIP(),
-		}
-		err = ws.Database.AddSharedHistory(historyEntry)
-		if err != nil {
-			lib.Logger.Error("ReqUploadSharedFile: AddSharedHistory", err)
+			// 生成下载动作历史记录
+			historyEntry := db.SharedHistoryEntry{
+				Sid:    sid,
+				Action: "download",
+				Information: ws.getRequestInfo(c, map[string]string{
+					"path_in_shared": path,
+					"file_size":      strconv.FormatInt(fileInfo.Size(), 10),
+					"download_type":  "file",
+				}),
+				Ip: c.ClientIP(),
+			}
+			err = ws.Database.AddSharedHistory(historyEntry)
+			if err != nil {
+				lib.Logger.Error("ReqUploadSharedFile: AddSharedHistory", err)
+			}
 		}
 		// 下载文件
-		c.FileAttachment(filePath, filepath.Base(filePath))
+		serveFile(c, filePath, filepath.Base(filePath), fileInfo)
 
 	}
 }
 
+// checkSharedUploadTarget 通过分享上传时只能覆盖普通文件，且分享者需要有修改文件的权限
+func checkSharedUploadTarget(c *gin.Context, userEntry db.UserEntry, realPath string) bool {
+	info, err := os.Lstat(realPath)
+	if err != nil {
+		return true
+	}
+	if !info.Mode().IsRegular() {
+		c.JSON(http.StatusOK, gin.H{"code": 1001, "message": "file is exist"})
+		return false
+	}
+	if !isUserAllowed(userEntry, actionModify) {
+		c.JSON(http.StatusOK, gin.H{"code": 1001, "message": "File not uploadable"})
+		return false
+	}
+	return true
+}
+
 func (ws *WebServer) ReqCreateSharedFileChunk() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		sid := c.Query("sid")
@@ -496,14 +579,17 @@ func (ws *WebServer) ReqCreateSharedFileChunk() gin.HandlerFunc {
 				return
 			}
 		}
-		filePath := filepath.Join(ws.RootDir, userEntry.RootDir, sharedEntry.Path, path)
+		filePath, succeed := ws.resolveSharedPath(c, sharedEntry, path)
+		if !succeed {
+			return
+		}
 		// 检查文件是否存在
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			c.JSON(http.StatusOK, gin.H{"code": 1001, "message": "File or directory not found"})
 			return
 		}
-		// 检查文件是否可上传
-		if !sharedEntry.CanUpload {
+		// 检查文件是否可上传，分享者没有上传权限时也不允许上传
+		if !sharedEntry.CanUpload || !isUserAllowed(userEntry, actionUpload) {
 			c.JSON(http.StatusOK, gin.H{"code": 1001, "message": "File not uploadable"})
 			return
 		}
@@ -530,6 +616,38 @@ func (ws *WebServer) ReqCreateSharedFileChunk() gin.HandlerFunc {
 			})
 			return
 		}
+		if req.Size < 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "size is invalid",
+			})
+			return
+		}
+		// 分享上传的文件计入分享者的空间
+		if !ws.checkQuota(c, filePath, req.Size) {
+			return
+		}
+		destPath, succeed := joinPath(path, req.Name)
+		if !succeed {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "name is invalid",
+			})
+			return
+		}
+		destFilePath, succeed := ws.resolveSharedPath(c, sharedEntry, destPath)
+		if !succeed || !checkSharedUploadTarget(c, userEntry, destFilePath) {
+			return
+		}
+		// 要覆盖的文件已经被其他客户端修改时拒绝上传，上传完成时再检查一次
+		precondition, succeed := getFilePrecondition(c)
+		if !succeed {
+			return
+		}
+		if err := precondition.check(destFilePath); err != nil {
+			writeFileOpError(c, err)
+			return
+		}
 		uploadTaskId, _ := lib.GenerateRandomString(16)
 		count := 32
 		uploadFileEntry := &UploadFileEntry{
@@ -539,8 +657,9 @@ func (ws *WebServer) ReqCreateSharedFileChunk() gin.HandlerFunc {
 			TotalSize:    uint64(req.Size),
 			Finished:     false,
 			FileEntry:    req,
-			DestFilePath: filepath.Join(filePath, req.Name),
+			DestFilePath: destFilePath,
 			UserEntry:    userEntry,
+			Precondition: precondition,
 		}
 		GetInstance().Lock.Lock()
 		for i := 0; i < count; i++ {
@@ -623,14 +742,17 @@ func (ws *WebServer) ReqUploadSharedFile() gin.HandlerFunc {
 			})
 			return
 		}
-		filePath := filepath.Join(ws.RootDir, userEntry.RootDir, sharedEntry.Path, path)
+		filePath, succeed := ws.resolveSharedPath(c, sharedEntry, path)
+		if !succeed {
+			return
+		}
 		// 检查文件是否存在
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			c.JSON(http.StatusOK, gin.H{"code": 1001, "message": "File or directory not found"})
 			return
 		}
-		// 检查文件是否可上传
-		if !sharedEntry.CanUpload {
+		// 检查文件是否可上传，分享者没有上传权限时也不允许上传
+		if !sharedEntry.CanUpload || !isUserAllowed(*userEntry, actionUpload) {
 			c.JSON(http.StatusOK, gin.H{"code": 1001, "message": "File not uploadable"})
 			return
 		}
@@ -647,12 +769,19 @@ func (ws *WebServer) ReqUploadSharedFile() gin.HandlerFunc {
 				return
 			}
 		}
+		// 分享上传的文件计入分享者的空间，接收文件前先按请求的大小检查
+		if !ws.checkQuota(c, filePath, c.Request.ContentLength) {
+			return
+		}
 		// 单文件上传
 		file, err := c.FormFile("file")
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "upload error"})
 			return
 		}
+		if !ws.checkQuota(c, filePath, file.Size) {
+			return
+		}
 
 		if sharedEntry.MaxUploadSize > 0 {
 			if sharedEntry.CurrentUploadSize+file.Size > sharedEntry.MaxUploadSize {
@@ -661,18 +790,50 @@ func (ws *WebServer) ReqUploadSharedFile() gin.HandlerFunc {
 			}
 		}
 
-		destFilePath := filepath.Join(filePath, file.Filename)
-		destFilePath, err = filepath.Abs(destFilePath)
-		if err != nil {
+		destPath, succeed := joinPath(path, file.Filename)
+		if !succeed {
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "bad file path"})
 			return
 		}
+		destFilePath, succeed := ws.resolveSharedPath(c, sharedEntry, destPath)
+		if !succeed || !checkSharedUploadTarget(c, *userEntry, destFilePath) {
+			return
+		}
+		// 要覆盖的文件已经被其他客户端修改时拒绝上传
+		precondition, succeed := getFilePrecondition(c)
+		if !succeed {
+			return
+		}
+		if err := precondition.check(destFilePath); err != nil {
+			writeFileOpError(c, err)
+			return
+		}
 		lib.Logger.Infow("ReqUploadSharedFile: upload file", destFilePath)
-		if err := c.SaveUploadedFile(file, destFilePath); err != nil {
+		// 先保存到同一目录下的临时文件，保存完成后再替换，上传失败时不影响原来的文件
+		suffix, _ := lib.GenerateRandomString(8)
+		tempPath := destFilePath + "." + suffix
+		if err := c.SaveUploadedFile(file, tempPath); err != nil {
+			os.Remove(tempPath)
 			c.JSON(http.StatusBadRequest, gin.H{"code": 1001, "message": "upload error"})
 			return
 		}
+		// 接收文件期间文件被其他客户端修改时放弃这次上传
+		if err := precondition.check(destFilePath); err != nil {
+			os.Remove(tempPath)
+			writeFileOpError(c, err)
+			return
+		}
+		// 覆盖已有的文件前保存原来的内容
+		existed := lib.IsExist(destFilePath)
+		replacedSize, err := ws.replaceFile(*userEntry, tempPath, destFilePath)
+		if err != nil {
+			lib.Logger.Error("ReqUploadSharedFile: replace file failed!", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "upload error"})
+			return
+		}
 		lib.Logger.Infow("ReqUploadSharedFile: upload file success", destFilePath, sharedEntry.CurrentUploadSize, file.Size)
+		ws.addUsedSize(destFilePath, file.Size-replacedSize)
+		ws.notifyWrite(destFilePath, existed)
 		sharedEntry.CurrentUploadSize += file.Size
 		err = ws.Database.UpdateShared(sharedEntry)
 		if err != nil {
@@ -750,11 +911,9 @@ func (ws *WebServer) ReqCreateSharedPackage() gin.HandlerFunc {
 				return
 			}
 		}
-		userEntry := db.UserEntry{}
-		if sharedEntry.UserId == 0 {
-			userEntry.RootDir = "/"
-		} else {
-			userEntry, err = ws.Database.GetUserById(sharedEntry.UserId)
+		// 创建者已经被删除的分享不能再访问
+		if sharedEntry.UserId != 0 {
+			_, err = ws.Database.GetUserById(sharedEntry.UserId)
 			if err != nil {
 				c.JSON(http.StatusOK, gin.H{
 					"code":    1000,
@@ -763,7 +922,10 @@ func (ws *WebServer) ReqCreateSharedPackage() gin.HandlerFunc {
 				return
 			}
 		}
-		filePath := filepath.Join(ws.RootDir, userEntry.RootDir, sharedEntry.Path, path)
+		filePath, succeed := ws.resolveSharedPath(c, sharedEntry, path)
+		if !succeed {
+			return
+		}
 		fileInfo, err := os.Stat(filePath)
 		// 检查文件是否存在
 		if os.IsNotExist(err) {
@@ -785,6 +947,7 @@ func (ws *WebServer) ReqCreateSharedPackage() gin.HandlerFunc {
 			TotalFileCount:  0,
 			Finished:        false,
 			DownloadCount:   0,
+			AllowSymlink:    ws.symlinkChecker(ws.RootDir, nil),
 		}
 
 		GetInstance().Lock.Lock()
@@ -8,20 +8,25 @@ import (
 )
 
 type UserInfo struct {
+	SessionId    string
 	UserName     string
 	UserToken    string
 	LoginAt      time.Time
 	FirstLoginAt time.Time
 	UserEntry    db.UserEntry
+	ApiToken     *db.ApiTokenEntry // 使用个人访问令牌登录时不为空
 }
 
 // Singleton 是单例模式类
 type Singleton struct {
 	Lock             sync.Mutex
 	Database         *db.Database
-	Tokens           map[string]UserInfo
 	PackageDownloads map[string]*lib.ProgressReaderWriter // 打包下载任务的信息
 	UploadTask       map[string]*UploadFileEntry          // 分片上传任务的信息
+	LoginAttempts    map[string]*LoginAttempt             // 登录和分享码验证失败的记录
+	CopyTasks        map[string]*CopyTaskEntry            // 后台复制任务的信息
+	BatchTasks       map[string]*BatchTaskEntry           // 批量操作的信息
+	PhotoScans       map[int64]*PhotoScanEntry            // 用户的照片目录的扫描进度
 }
 
 var (
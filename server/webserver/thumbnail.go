@@ -0,0 +1,194 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 缩略图
+// 按预设的尺寸生成图片的 JPEG 缩略图，缓存在 TempDir/thumbnails 下，文件名由路径、修改时间、大小和尺寸计算
+// 文件修改后自然生成新的缓存，旧的缓存超过保留时间未被访问或缓存总大小超过上限时清理
+
+const (
+	ThumbnailDirName = "thumbnails"
+	// 允许解码的最大像素数
+	thumbnailMaxPixels = 50 * 1000 * 1000
+	thumbnailQuality   = 80
+	// 缓存超过该时间未被访问时删除，总大小超过上限时从最久未访问的开始删除
+	thumbnailKeepTime     = 30 * 24 * time.Hour
+	thumbnailMaxCacheSize = 1024 * 1024 * 1024
+	thumbnailCleanPeriod  = time.Hour
+)
+
+// 缩略图的尺寸，长边的像素数
+var thumbnailSizes = map[string]int{
+	"small":  128,
+	"medium": 256,
+	"large":  1024,
+}
+
+var (
+	// 限制同时生成缩略图的数量
+	thumbnailWorkers   = make(chan struct{}, runtime.NumCPU())
+	thumbnailLastClean time.Time
+	thumbnailLock      sync.Mutex
+)
+
+func (ws *WebServer) getThumbnailDir() string {
+	return filepath.Join(ws.TempDir, ThumbnailDirName)
+}
+
+func (ws *WebServer) getThumbnailPath(realPath string, info os.FileInfo, size string) string {
+	key := realPath + "\x00" + strconv.FormatInt(info.ModTime().UnixNano(), 10) +
+		"\x00" + strconv.FormatInt(info.Size(), 10) + "\x00" + size
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(ws.getThumbnailDir(), hex.EncodeToString(sum[:])+".jpg")
+}
+
+// createThumbnail 生成缩略图，先写到临时文件再改名，同时请求同一个缩略图时不会读到不完整的文件
+func (ws *WebServer) createThumbnail(realPath string, cachePath string, maxSize int) error {
+	thumbnailWorkers <- struct{}{}
+	defer func() { <-thumbnailWorkers }()
+	if lib.IsExist(cachePath) {
+		return nil
+	}
+	if err := os.MkdirAll(ws.getThumbnailDir(), 0777); err != nil {
+		return err
+	}
+	suffix, _ := lib.GenerateRandomString(8)
+	tempPath := cachePath + "." + suffix
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	err = lib.CreateThumbnail(realPath, f, maxSize, thumbnailMaxPixels, thumbnailQuality)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, cachePath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
+
+// AutoCleanThumbnails 清理缩略图缓存，由后台定时调用，每小时执行一次
+func (ws *WebServer) AutoCleanThumbnails() {
+	thumbnailLock.Lock()
+	if time.Since(thumbnailLastClean) < thumbnailCleanPeriod {
+		thumbnailLock.Unlock()
+		return
+	}
+	thumbnailLastClean = time.Now()
+	thumbnailLock.Unlock()
+
+	entries, err := os.ReadDir(ws.getThumbnailDir())
+	if err != nil {
+		return
+	}
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	files := []cacheFile{}
+	totalSize := int64(0)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		path := filepath.Join(ws.getThumbnailDir(), entry.Name())
+		// 访问缓存时会更新修改时间，修改时间即最后访问的时间
+		if time.Since(info.ModTime()) > thumbnailKeepTime {
+			os.Remove(path)
+			continue
+		}
+		files = append(files, cacheFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		totalSize += info.Size()
+	}
+	if totalSize <= thumbnailMaxCacheSize {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, file := range files {
+		if totalSize <= thumbnailMaxCacheSize {
+			break
+		}
+		if os.Remove(file.path) == nil {
+			totalSize -= file.size
+		}
+	}
+}
+
+// ReqGetThumbnail 获取图片的缩略图，参数 size 为 small、medium、large，默认 medium
+func (ws *WebServer) ReqGetThumbnail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path, succeed := getPath(c)
+		if !succeed {
+			return
+		}
+		filePath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+		if !succeed {
+			return
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "File or directory not found"})
+			return
+		}
+		if info.IsDir() {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "bad file type"})
+			return
+		}
+		size := c.DefaultQuery("size", "medium")
+		maxSize, exist := thumbnailSizes[size]
+		if !exist {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "size is invalid"})
+			return
+		}
+		// ETag 由原图的 ETag 和尺寸组成，原图修改后客户端不会继续使用旧的缩略图
+		etag := fmt.Sprintf(`"%s-%s"`, strings.Trim(fileETag(info), `"`), size)
+		if etagMatch(c.GetHeader("If-None-Match"), etag) {
+			c.Header("ETag", etag)
+			c.Status(http.StatusNotModified)
+			return
+		}
+		cachePath := ws.getThumbnailPath(filePath, info, size)
+		if lib.IsExist(cachePath) {
+			now := time.Now()
+			os.Chtimes(cachePath, now, now)
+		} else if err := ws.createThumbnail(filePath, cachePath, maxSize); err != nil {
+			if errors.Is(err, lib.ErrImageTooLarge) {
+				c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "image is too large"})
+				return
+			}
+			lib.Logger.Info("ReqGetThumbnail: create thumbnail failed! ", filePath, err)
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "unsupported image"})
+			return
+		}
+		c.Header("ETag", etag)
+		c.Header("Cache-Control", "private, no-cache")
+		c.Header("Content-Type", "image/jpeg")
+		c.File(cachePath)
+	}
+}
@@ -0,0 +1,316 @@
+package webserver
+
+import (
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 个人访问令牌的权限范围，没有指定时拥有和用户相同的权限，但不能访问管理员接口
+const (
+	ApiTokenScopeRead   = "read"   // 只读，只允许查看和下载
+	ApiTokenScopeUpload = "upload" // 只允许上传文件和创建目录
+	ApiTokenScopeAdmin  = "admin"  // 允许访问管理员接口，仅管理员用户可以创建
+)
+
+const (
+	apiTokenPrefix         = "mfs_"          // 令牌的固定前缀，便于识别
+	apiTokenLength         = 40              // 令牌随机部分的长度
+	apiTokenDisplayLength  = 8               // 对外展示的令牌前缀长度
+	apiTokenLastUsedPeriod = 1 * time.Minute // 最后使用时间的更新间隔，避免每个请求都写数据库
+)
+
+type ApiTokenRequest struct {
+	Name        string   `json:"name"`
+	Scopes      []string `json:"scopes"`
+	ExpiresDays int      `json:"expires_days"` // 有效天数，为0时永不过期
+}
+
+// getBearerToken 从 Authorization 头中获取个人访问令牌
+func getBearerToken(c *gin.Context) (string, bool) {
+	authorization := c.GetHeader("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(authorization[7:])
+	return token, token != ""
+}
+
+func isApiTokenExpired(token db.ApiTokenEntry) bool {
+	if token.ExpiresAt == "" {
+		return false
+	}
+	expiresAt, err := time.ParseInLocation(time.DateTime, token.ExpiresAt, time.Local)
+	if err != nil {
+		return true
+	}
+	return time.Now().After(expiresAt)
+}
+
+func splitApiTokenScopes(scopes string) []string {
+	if scopes == "" {
+		return []string{}
+	}
+	return strings.Split(scopes, ",")
+}
+
+// authenticateApiToken 校验个人访问令牌，返回令牌所属用户的信息
+func authenticateApiToken(c *gin.Context, token string) (UserInfo, bool) {
+	database := GetInstance().Database
+	if database == nil {
+		return UserInfo{}, false
+	}
+	tokenEntry, err := database.GetApiTokenByHash(db.HashApiToken(token))
+	if err != nil {
+		lib.Logger.Info("api token not found! ip:", c.ClientIP())
+		return UserInfo{}, false
+	}
+	if isApiTokenExpired(tokenEntry) {
+		lib.Logger.Info("api token expired! token_id:", tokenEntry.Id)
+		return UserInfo{}, false
+	}
+	userEntry, err := database.GetUserById(tokenEntry.UserId)
+	if err != nil || !userEntry.Enabled {
+		lib.Logger.Info("user not found or disabled! user_id:", tokenEntry.UserId)
+		return UserInfo{}, false
+	}
+	now := time.Now()
+	lastUsedAt, err := time.ParseInLocation(time.DateTime, tokenEntry.LastUsedAt, time.Local)
+	if err != nil || now.Sub(lastUsedAt) > apiTokenLastUsedPeriod {
+		tokenEntry.LastUsedAt = now.Format(time.DateTime)
+		database.UpdateApiTokenLastUsedAt(tokenEntry.Id, tokenEntry.LastUsedAt)
+	}
+	// 没有 admin 权限范围的令牌按普通用户处理，不能使用管理员在其他接口中的特权
+	if !hasApiTokenScope(tokenEntry, ApiTokenScopeAdmin) {
+		userEntry.IsAdmin = false
+	}
+	userInfo := UserInfo{
+		UserName:  userEntry.Name,
+		LoginAt:   now,
+		UserEntry: userEntry,
+		ApiToken:  &tokenEntry,
+	}
+	c.Set(loginUserKey, userInfo)
+	return userInfo, true
+}
+
+func hasApiTokenScope(token db.ApiTokenEntry, scope string) bool {
+	for _, v := range splitApiTokenScopes(token.Scopes) {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// checkApiTokenScope 检查个人访问令牌的权限范围是否允许当前请求，使用会话登录时总是允许
+func checkApiTokenScope(c *gin.Context, userInfo UserInfo, isAdminApi bool) bool {
+	if userInfo.ApiToken == nil {
+		return true
+	}
+	scopes := splitApiTokenScopes(userInfo.ApiToken.Scopes)
+	if len(scopes) == 0 {
+		return !isAdminApi
+	}
+	method := c.Request.Method
+	path := c.FullPath()
+	for _, scope := range scopes {
+		switch scope {
+		case ApiTokenScopeAdmin:
+			return true
+		case ApiTokenScopeRead:
+			if isAdminApi || path == "/api/xterm" {
+				continue
+			}
+			// 打包下载需要先创建和查询压缩任务
+			if method == http.MethodGet || method == http.MethodHead || path == "/api/pkg" && method != http.MethodDelete {
+				return true
+			}
+		case ApiTokenScopeUpload:
+			if isAdminApi || method != http.MethodPost {
+				continue
+			}
+			if path == "/api/file" || path == "/api/file/upload" || path == "/api/folder" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ws *WebServer) ReqGetApiTokenList() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		tokens, err := ws.Database.GetApiTokens(loginUserInfo.UserEntry.Id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    tokens,
+		})
+	}
+}
+
+// ReqCreateApiToken 创建个人访问令牌，令牌只在创建时返回一次
+func (ws *WebServer) ReqCreateApiToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := ApiTokenRequest{}
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		// 不允许使用令牌创建令牌，避免权限范围被扩大
+		if loginUserInfo.ApiToken != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "permission denied",
+			})
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "name is empty",
+			})
+			return
+		}
+		if req.ExpiresDays < 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "expires_days is invalid",
+			})
+			return
+		}
+		scopes := []string{}
+		for _, scope := range req.Scopes {
+			switch scope {
+			case ApiTokenScopeRead, ApiTokenScopeUpload:
+			case ApiTokenScopeAdmin:
+				if !loginUserInfo.UserEntry.IsAdmin {
+					c.JSON(http.StatusOK, gin.H{
+						"code":    1000,
+						"message": "permission denied",
+					})
+					return
+				}
+			default:
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1000,
+					"message": "scope is invalid: " + scope,
+				})
+				return
+			}
+			scopes = append(scopes, scope)
+		}
+		random, err := lib.GenerateRandomString(apiTokenLength)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		token := apiTokenPrefix + random
+		tokenEntry := db.ApiTokenEntry{
+			UserId:    loginUserInfo.UserEntry.Id,
+			Name:      req.Name,
+			TokenHash: db.HashApiToken(token),
+			Prefix:    token[:len(apiTokenPrefix)+apiTokenDisplayLength],
+			Scopes:    strings.Join(scopes, ","),
+		}
+		if req.ExpiresDays > 0 {
+			tokenEntry.ExpiresAt = time.Now().AddDate(0, 0, req.ExpiresDays).Format(time.DateTime)
+		}
+		tokenEntry.Id, err = ws.Database.AddApiToken(tokenEntry)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "create_api_token",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"token_id":   strconv.FormatInt(tokenEntry.Id, 10),
+				"name":       tokenEntry.Name,
+				"scopes":     tokenEntry.Scopes,
+				"expires_at": tokenEntry.ExpiresAt,
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "create api token succeed",
+			"data": gin.H{
+				"id":         tokenEntry.Id,
+				"token":      token,
+				"expires_at": tokenEntry.ExpiresAt,
+			},
+		})
+	}
+}
+
+// ReqDeleteApiToken 吊销个人访问令牌，参数 id 为令牌ID
+func (ws *WebServer) ReqDeleteApiToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		id, err := strconv.ParseInt(c.Query("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		count, err := ws.Database.DeleteApiToken(loginUserInfo.UserEntry.Id, id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		if count == 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "token not found",
+			})
+			return
+		}
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "revoke_api_token",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"token_id": strconv.FormatInt(id, 10),
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "revoke api token succeed",
+		})
+	}
+}
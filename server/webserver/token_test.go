@@ -0,0 +1,97 @@
+package webserver
+
+import (
+	"myfileserver/db"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scopeAllowed 按注册的路由发送请求，返回 checkApiTokenScope 的结果
+func scopeAllowed(t *testing.T, userInfo UserInfo, isAdminApi bool, method string, route string) bool {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	allowed := false
+	r.Handle(method, route, func(c *gin.Context) {
+		allowed = checkApiTokenScope(c, userInfo, isAdminApi)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, route, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d", method, route, w.Code)
+	}
+	return allowed
+}
+
+func TestCheckApiTokenScope(t *testing.T) {
+	tokenInfo := func(scopes string) UserInfo {
+		return UserInfo{ApiToken: &db.ApiTokenEntry{Scopes: scopes}}
+	}
+	tests := []struct {
+		name       string
+		userInfo   UserInfo
+		isAdminApi bool
+		method     string
+		route      string
+		want       bool
+	}{
+		{"session user api", UserInfo{}, false, http.MethodDelete, "/api/file", true},
+		{"session admin api", UserInfo{}, true, http.MethodPost, "/api/user", true},
+
+		{"no scope user api", tokenInfo(""), false, http.MethodDelete, "/api/file", true},
+		{"no scope admin api", tokenInfo(""), true, http.MethodGet, "/api/users", false},
+
+		{"read get", tokenInfo("read"), false, http.MethodGet, "/api/files", true},
+		{"read head", tokenInfo("read"), false, http.MethodHead, "/api/file", true},
+		{"read post", tokenInfo("read"), false, http.MethodPost, "/api/file", false},
+		{"read delete", tokenInfo("read"), false, http.MethodDelete, "/api/file", false},
+		{"read create package", tokenInfo("read"), false, http.MethodPost, "/api/pkg", true},
+		{"read delete package", tokenInfo("read"), false, http.MethodDelete, "/api/pkg", false},
+		{"read xterm", tokenInfo("read"), false, http.MethodGet, "/api/xterm", false},
+		{"read admin api", tokenInfo("read"), true, http.MethodGet, "/api/users", false},
+
+		{"upload file", tokenInfo("upload"), false, http.MethodPost, "/api/file", true},
+		{"upload chunk task", tokenInfo("upload"), false, http.MethodPost, "/api/file/upload", true},
+		{"upload folder", tokenInfo("upload"), false, http.MethodPost, "/api/folder", true},
+		{"upload get", tokenInfo("upload"), false, http.MethodGet, "/api/files", false},
+		{"upload other post", tokenInfo("upload"), false, http.MethodPost, "/api/share", false},
+		{"upload admin api", tokenInfo("upload"), true, http.MethodPost, "/api/file", false},
+
+		{"read and upload get", tokenInfo("read,upload"), false, http.MethodGet, "/api/files", true},
+		{"read and upload post", tokenInfo("read,upload"), false, http.MethodPost, "/api/file", true},
+		{"read and upload delete", tokenInfo("read,upload"), false, http.MethodDelete, "/api/file", false},
+
+		{"admin admin api", tokenInfo("admin"), true, http.MethodPost, "/api/user", true},
+		{"admin user api", tokenInfo("admin"), false, http.MethodDelete, "/api/file", true},
+		{"unknown scope", tokenInfo("unknown"), false, http.MethodGet, "/api/files", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scopeAllowed(t, tt.userInfo, tt.isAdminApi, tt.method, tt.route); got != tt.want {
+				t.Errorf("checkApiTokenScope = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasApiTokenScope(t *testing.T) {
+	tests := []struct {
+		scopes string
+		scope  string
+		want   bool
+	}{
+		{"", ApiTokenScopeAdmin, false},
+		{"admin", ApiTokenScopeAdmin, true},
+		{"read,admin", ApiTokenScopeAdmin, true},
+		{"read,upload", ApiTokenScopeAdmin, false},
+		{"administrator", ApiTokenScopeAdmin, false},
+	}
+	for _, tt := range tests {
+		if got := hasApiTokenScope(db.ApiTokenEntry{Scopes: tt.scopes}, tt.scope); got != tt.want {
+			t.Errorf("hasApiTokenScope(%q, %q) = %v, want %v", tt.scopes, tt.scope, got, tt.want)
+		}
+	}
+}
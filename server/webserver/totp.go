@@ -0,0 +1,239 @@
+package webserver
+
+import (
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const recoveryCodeCount = 10 // 启用两步验证时生成的恢复码数量
+
+type TotpRequest struct {
+	Code string `json:"code"` // 验证器 App 上的验证码，或者一次性恢复码
+}
+
+// verifyTotpCode 校验用户的两步验证码，验证码错误时再尝试作为恢复码使用
+func (ws *WebServer) verifyTotpCode(totpEntry db.UserTotpEntry, code string) (bool, bool) {
+	counter, ok := lib.ValidateTotp(totpEntry.Secret, code, totpEntry.LastCounter, time.Now())
+	if ok {
+		ws.Database.UpdateUserTotpCounter(totpEntry.UserId, counter)
+		return true, false
+	}
+	if totpEntry.Enabled && ws.Database.UseRecoveryCode(totpEntry.UserId, code) {
+		return true, true
+	}
+	return false, false
+}
+
+func (ws *WebServer) ReqGetTotp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		totpEntry, err := ws.Database.GetUserTotp(loginUserInfo.UserEntry.Id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    0,
+				"message": "success",
+				"data": gin.H{
+					"enabled": false,
+				},
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data": gin.H{
+				"enabled":                 totpEntry.Enabled,
+				"enabled_at":              totpEntry.EnabledAt,
+				"recovery_code_remaining": ws.Database.GetRecoveryCodeCount(loginUserInfo.UserEntry.Id),
+			},
+		})
+	}
+}
+
+// ReqCreateTotp 开始绑定两步验证，生成新的密钥，需要调用 ReqEnableTotp 验证后才会启用
+func (ws *WebServer) ReqCreateTotp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		// 不允许使用令牌修改两步验证
+		if loginUserInfo.ApiToken != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "permission denied",
+			})
+			return
+		}
+		if ws.Database.IsUserTotpEnabled(loginUserInfo.UserEntry.Id) {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "totp is already enabled",
+			})
+			return
+		}
+		secret, err := lib.GenerateTotpSecret()
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		err = ws.Database.SetUserTotpSecret(loginUserInfo.UserEntry.Id, secret)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		issuer := lib.AppName
+		if issuer == "" {
+			issuer = "myfileserver"
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data": gin.H{
+				"secret": secret,
+				"uri":    lib.TotpURI(issuer, loginUserInfo.UserEntry.Name, secret),
+			},
+		})
+	}
+}
+
+// ReqEnableTotp 校验验证码，通过后启用两步验证，并返回一次性恢复码
+func (ws *WebServer) ReqEnableTotp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := TotpRequest{}
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		// 不允许使用令牌修改两步验证
+		if loginUserInfo.ApiToken != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "permission denied",
+			})
+			return
+		}
+		totpEntry, err := ws.Database.GetUserTotp(loginUserInfo.UserEntry.Id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "totp is not created",
+			})
+			return
+		}
+		if totpEntry.Enabled {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "totp is already enabled",
+			})
+			return
+		}
+		counter, ok := lib.ValidateTotp(totpEntry.Secret, req.Code, totpEntry.LastCounter, time.Now())
+		if !ok {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1003,
+				"message": "验证码错误",
+			})
+			return
+		}
+		recoveryCodes, err := lib.GenerateRecoveryCodes(recoveryCodeCount)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		err = ws.Database.EnableUserTotp(loginUserInfo.UserEntry.Id, counter, recoveryCodes)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:      loginUserInfo.UserEntry.Id,
+			UserName:    loginUserInfo.UserEntry.Name,
+			Action:      "enable_totp",
+			Information: ws.getRequestInfo(c, map[string]string{}),
+			Ip:          c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "enable totp succeed",
+			"data": gin.H{
+				"recovery_codes": recoveryCodes,
+			},
+		})
+	}
+}
+
+// ReqDeleteTotp 关闭两步验证，需要提供当前的验证码或恢复码
+func (ws *WebServer) ReqDeleteTotp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		// 不允许使用令牌修改两步验证
+		if loginUserInfo.ApiToken != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "permission denied",
+			})
+			return
+		}
+		totpEntry, err := ws.Database.GetUserTotp(loginUserInfo.UserEntry.Id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "totp is not enabled",
+			})
+			return
+		}
+		if totpEntry.Enabled {
+			ok, _ := ws.verifyTotpCode(totpEntry, c.Query("code"))
+			if !ok {
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1003,
+					"message": "验证码错误",
+				})
+				return
+			}
+		}
+		err = ws.Database.DeleteUserTotp(loginUserInfo.UserEntry.Id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "disable_totp",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"user_id": strconv.FormatInt(loginUserInfo.UserEntry.Id, 10),
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "disable totp succeed",
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package webserver
+
+import (
+	"errors"
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 回收站
+// 删除的文件移到文件所属用户的 TempDir/trash/<用户ID> 下，数据库中记录原来的路径和删除时间
+// 删除挂载给自己的其他用户的文件时，文件进入所属用户的回收站，由所属用户还原或彻底删除
+// 超过用户设置的保留天数（用户设置 trash_keep_days，默认30天，0表示不自动清理）后自动彻底删除
+// 回收站中的文件计入所属用户的已使用空间，彻底删除后才释放
+
+const (
+	TrashDirName         = "trash"
+	TrashKeepDaysKey     = "trash_keep_days"
+	defaultTrashKeepDays = 30
+)
+
+func (ws *WebServer) getTrashDir(userId int64) string {
+	return filepath.Join(ws.TempDir, TrashDirName, strconv.FormatInt(userId, 10))
+}
+
+// getTrashKeepDays 获取用户回收站中文件的保留天数
+func (ws *WebServer) getTrashKeepDays(userId int64) int {
+	return ws.getUserSettingInt(userId, TrashKeepDaysKey, defaultTrashKeepDays)
+}
+
+// moveToTrash 把文件移到所属用户的回收站，path 为用户看到的路径，realPath 为服务器上的路径
+func (ws *WebServer) moveToTrash(userEntry db.UserEntry, path string, realPath string) (db.TrashEntry, error) {
+	trash := db.TrashEntry{}
+	info, err := os.Lstat(realPath)
+	if err != nil {
+		return trash, err
+	}
+	owner := ws.getPathOwner(userEntry, realPath)
+	ownerRoot := filepath.Join(ws.RootDir, owner.RootDir)
+	if owner.Id != userEntry.Id {
+		// 回收站中显示所属用户看到的路径
+		if rel, err := filepath.Rel(ownerRoot, realPath); err == nil {
+			path = "/" + filepath.ToSlash(rel)
+		}
+	}
+	trashDir := ws.getTrashDir(owner.Id)
+	err = os.MkdirAll(trashDir, 0700)
+	if err != nil {
+		return trash, err
+	}
+	trashName, _ := lib.GenerateRandomString(16)
+	trash = db.TrashEntry{
+		UserId:     owner.Id,
+		Name:       info.Name(),
+		Path:       path,
+		ServerPath: ws.toServerPath(realPath),
+		TrashName:  trashName,
+		Size:       info.Size(),
+		IsDir:      info.IsDir(),
+	}
+	if info.IsDir() {
+		trash.Size = ws.getPathSize(realPath)
+	}
+	// 文件原来已经计入所属用户的已使用空间时，移到回收站后不变；不在所属用户的根目录下时新增了占用的空间
+	if !isSubPath(ownerRoot, realPath) {
+		if err := usersQuotaError([]db.UserEntry{owner}, trash.Size); err != nil {
+			return trash, err
+		}
+	}
+	trashPath := filepath.Join(trashDir, trashName)
+	err = lib.MovePath(realPath, trashPath)
+	if err != nil {
+		return trash, err
+	}
+	trash.Id, err = ws.Database.AddTrash(trash)
+	if err != nil {
+		// 记录失败时还原文件，避免文件丢失
+		lib.MovePath(trashPath, realPath)
+		return trash, err
+	}
+	ws.Database.AddUserUsedSize(owner.Id, trash.Size)
+	return trash, nil
+}
+
+// purgeTrash 彻底删除回收站中的文件
+func (ws *WebServer) purgeTrash(trash db.TrashEntry) error {
+	err := os.RemoveAll(filepath.Join(ws.getTrashDir(trash.UserId), trash.TrashName))
+	if err != nil {
+		return err
+	}
+	err = ws.Database.DeleteTrash(trash.Id)
+	if err != nil {
+		return err
+	}
+	ws.Database.AddUserUsedSize(trash.UserId, -trash.Size)
+	return nil
+}
+
+// purgeUserTrash 删除用户时清空其回收站
+func (ws *WebServer) purgeUserTrash(userId int64) {
+	os.RemoveAll(ws.getTrashDir(userId))
+	ws.Database.DeleteUserTrashes(userId)
+}
+
+// AutoPurgeTrash 彻底删除超过保留天数的文件，由后台定时调用
+func (ws *WebServer) AutoPurgeTrash() {
+	users, err := ws.Database.GetUsers()
+	if err != nil {
+		return
+	}
+	for _, user := range users {
+		days := ws.getTrashKeepDays(user.Id)
+		if days == 0 {
+			continue
+		}
+		trashes, err := ws.Database.GetExpiredTrashes(user.Id, time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			continue
+		}
+		for _, trash := range trashes {
+			err = ws.purgeTrash(trash)
+			if err != nil {
+				lib.Logger.Error("AutoPurgeTrash: purge failed!", err, trash.Id)
+			}
+		}
+	}
+}
+
+// getUserTrash 获取回收站中的文件，只能操作自己的回收站
+func (ws *WebServer) getUserTrash(c *gin.Context) (db.TrashEntry, bool) {
+	id, ok := getQueryInt64(c, "id")
+	if !ok {
+		return db.TrashEntry{}, false
+	}
+	trash, err := ws.Database.GetTrash(id)
+	loginUserInfo := getLoginUser(c)
+	if err != nil || trash.UserId != loginUserInfo.UserEntry.Id {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    1000,
+			"message": "trash not found",
+		})
+		return trash, false
+	}
+	return trash, true
+}
+
+func (ws *WebServer) ReqGetTrashList() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		trashes, err := ws.Database.GetUserTrashes(loginUserInfo.UserEntry.Id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data": gin.H{
+				"keep_days": ws.getTrashKeepDays(loginUserInfo.UserEntry.Id),
+				"trashes":   trashes,
+			},
+		})
+	}
+}
+
+// ReqRestoreTrash 还原回收站中的文件到原来的位置，参数 conflict 为 fail、overwrite、rename 或 skip
+func (ws *WebServer) ReqRestoreTrash() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !checkUserPermission(c, actionUpload) {
+			return
+		}
+		trash, ok := ws.getUserTrash(c)
+		if !ok {
+			return
+		}
+		conflict, ok := getConflict(c, conflictFail)
+		if !ok {
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		realPath, err := ws.resolveSafePath(ws.RootDir, trash.ServerPath, false)
+		if err == nil && ws.getPathAccess(loginUserInfo.UserEntry, realPath) < db.AclAccessLevel(db.AclAccessWrite) {
+			err = &PathError{Path: trash.Path, Err: ErrAccessDenied}
+		}
+		if err != nil {
+			writePathError(c, err)
+			return
+		}
+		path, realPath, ok := ws.resolveConflict(c, conflict, trash.Path, realPath)
+		if !ok {
+			return
+		}
+		// 还原后不再计入回收站占用的空间，先释放再检查配额，还原到自己的目录时不会因为空间不足失败
+		ws.Database.AddUserUsedSize(trash.UserId, -trash.Size)
+		if !ws.checkQuota(c, realPath, trash.Size) {
+			ws.Database.AddUserUsedSize(trash.UserId, trash.Size)
+			return
+		}
+		err = os.MkdirAll(filepath.Dir(realPath), 0777)
+		if err == nil {
+			err = lib.MovePath(filepath.Join(ws.getTrashDir(trash.UserId), trash.TrashName), realPath)
+		}
+		if err != nil {
+			ws.Database.AddUserUsedSize(trash.UserId, trash.Size)
+			lib.Logger.Error("ReqRestoreTrash: restore failed!", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to restore file"})
+			return
+		}
+		ws.Database.DeleteTrash(trash.Id)
+		ws.addUsedSize(realPath, trash.Size)
+		ws.notify(fileEventCreate, realPath, "", trash.IsDir)
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "restore_trash",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"trash_id": strconv.FormatInt(trash.Id, 10),
+				"path":     path,
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "restore succeed",
+			"data": gin.H{
+				"path": path,
+			},
+		})
+	}
+}
+
+// ReqDeleteTrash 彻底删除回收站中的一个文件
+func (ws *WebServer) ReqDeleteTrash() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		trash, ok := ws.getUserTrash(c)
+		if !ok {
+			return
+		}
+		err := ws.purgeTrash(trash)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "delete_trash",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"trash_id": strconv.FormatInt(trash.Id, 10),
+				"path":     trash.Path,
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "delete trash succeed",
+		})
+	}
+}
+
+// ReqDeleteTrashes 清空回收站
+func (ws *WebServer) ReqDeleteTrashes() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		trashes, err := ws.Database.GetUserTrashes(loginUserInfo.UserEntry.Id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		errs := []error{}
+		for _, trash := range trashes {
+			errs = append(errs, ws.purgeTrash(trash))
+		}
+		if err = errors.Join(errs...); err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "empty_trash",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"count": strconv.Itoa(len(trashes)),
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "empty trash succeed",
+		})
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"io"
 	"myfileserver/db"
+	"myfileserver/lib"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,6 +24,10 @@ func (ws *WebServer) ReqGetUserList() gin.HandlerFunc {
 			})
 			return
 		}
+		// 不返回密码哈希
+		for i := range users {
+			users[i].Password = ""
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"code":    0,
 			"message": "success",
@@ -71,6 +79,14 @@ func (ws *WebServer) ReqDeleteUser() gin.HandlerFunc {
 			})
 			return
 		}
+		// 删除用户的所有登录会话、两步验证配置、访问令牌、授权、用户组的成员关系、照片记录和相册
+		ws.Database.DeleteUserSessions(val)
+		ws.Database.DeleteUserTotp(val)
+		ws.Database.DeleteUserApiTokens(val)
+		ws.Database.DeleteUserAcls(val)
+		ws.Database.DeleteUserGroups(val)
+		ws.Database.DeleteUserPhotos(val)
+		ws.purgeUserTrash(val)
 
 		ws.Database.AddUserHistory(db.UserHistoryEntry{
 			UserId:   loginUserInfo.UserEntry.Id,
@@ -90,6 +106,32 @@ func (ws *WebServer) ReqDeleteUser() gin.HandlerFunc {
 	}
 }
 
+// ReqGetUser 获取登录用户的信息，包括空间配额和已使用的空间，available 为-1时表示不限制
+func (ws *WebServer) ReqGetUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginUserInfo := getLoginUser(c)
+		userEntry, err := ws.Database.GetUserById(loginUserInfo.UserEntry.Id)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		userEntry.Password = ""
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data": gin.H{
+				"user":      userEntry,
+				"quota":     userEntry.Quota,
+				"used_size": userEntry.UsedSize,
+				"available": getAvailableSize(userEntry),
+			},
+		})
+	}
+}
+
 func (ws *WebServer) ReqUpdateUser() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		defer c.Request.Body.Close()
@@ -126,8 +168,47 @@ func (ws *WebServer) ReqUpdateUser() gin.HandlerFunc {
 			})
 			return
 		}
-		if userEntry.Password == "" {
-			userEntry.Password = currUserEntry.Password
+		// 非管理员不能修改自己的根目录、管理员标记、权限限制和空间配额
+		if !loginUserInfo.UserEntry.IsAdmin {
+			userEntry.RootDir = currUserEntry.RootDir
+			userEntry.IsAdmin = currUserEntry.IsAdmin
+			userEntry.Permissions = currUserEntry.Permissions
+			userEntry.Quota = currUserEntry.Quota
+		}
+		if userEntry.Quota < 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "quota is invalid",
+			})
+			return
+		}
+		userEntry.Permissions, err = normalizePermissions(userEntry.Permissions)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		// 管理员可以重置用户的两步验证，例如用户丢失了验证器和恢复码
+		updateOption := struct {
+			ResetTotp bool `json:"reset_totp"`
+		}{}
+		json.Unmarshal(data, &updateOption)
+		// 不允许使用令牌修改密码和重置两步验证，避免令牌泄露后账号被接管
+		if loginUserInfo.ApiToken != nil && (userEntry.Password != "" || updateOption.ResetTotp) {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "permission denied",
+			})
+			return
+		}
+		if updateOption.ResetTotp && !loginUserInfo.UserEntry.IsAdmin {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "permission denied",
+			})
+			return
 		}
 		err = ws.Database.UpdateUser(userEntry)
 		if err != nil {
@@ -137,15 +218,39 @@ func (ws *WebServer) ReqUpdateUser() gin.HandlerFunc {
 			})
 			return
 		}
+		// 传入的密码总是按明文处理并重新生成哈希，不能直接保存哈希值
+		if userEntry.Password != "" {
+			err = ws.Database.UpdateUserPassword(userEntry.Id, userEntry.Password)
+			if err != nil {
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1000,
+					"message": err.Error(),
+				})
+				return
+			}
+		}
+		if updateOption.ResetTotp {
+			err = ws.Database.DeleteUserTotp(userEntry.Id)
+			if err != nil {
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1000,
+					"message": err.Error(),
+				})
+				return
+			}
+		}
 
 		ws.Database.AddUserHistory(db.UserHistoryEntry{
 			UserId:   loginUserInfo.UserEntry.Id,
 			UserName: loginUserInfo.UserEntry.Name,
 			Action:   "update_user",
 			Information: ws.getRequestInfo(c, map[string]string{
-				"user_id":    strconv.FormatInt(userEntry.Id, 10),
-				"user_name":  userEntry.Name,
-				"user_email": userEntry.Email,
+				"user_id":     strconv.FormatInt(userEntry.Id, 10),
+				"user_name":   userEntry.Name,
+				"user_email":  userEntry.Email,
+				"reset_totp":  strconv.FormatBool(updateOption.ResetTotp),
+				"permissions": userEntry.Permissions,
+				"quota":       strconv.FormatInt(userEntry.Quota, 10),
 			}),
 			Ip: c.ClientIP(),
 		})
@@ -184,6 +289,56 @@ func (ws *WebServer) ReqCreateUser() gin.HandlerFunc {
 			})
 			return
 		}
+		// 加入的用户组，新用户没有指定根目录、权限限制和空间配额时，使用第一个用户组的默认配置
+		createOption := struct {
+			GroupIds []int64 `json:"group_ids"`
+		}{}
+		json.Unmarshal(data, &createOption)
+		groups := []db.GroupEntry{}
+		for _, groupId := range createOption.GroupIds {
+			group, err := ws.Database.GetGroup(groupId)
+			if err != nil {
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1000,
+					"message": "group not found",
+				})
+				return
+			}
+			groups = append(groups, group)
+		}
+		if len(groups) > 0 {
+			if userEntry.RootDir == "" {
+				userEntry.RootDir = groups[0].GetRootDir(userEntry.Name)
+			}
+			if userEntry.Permissions == "" {
+				userEntry.Permissions = groups[0].Permissions
+			}
+			if userEntry.Quota == 0 {
+				userEntry.Quota = groups[0].Quota
+			}
+		}
+		if userEntry.Quota < 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "quota is invalid",
+			})
+			return
+		}
+		userEntry.Permissions, err = normalizePermissions(userEntry.Permissions)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		if strings.Contains(userEntry.RootDir, "..") {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": "root_dir is invalid",
+			})
+			return
+		}
 		err = ws.Database.AddUser(userEntry)
 		if err != nil {
 			c.JSON(http.StatusOK, gin.H{
@@ -192,15 +347,39 @@ func (ws *WebServer) ReqCreateUser() gin.HandlerFunc {
 			})
 			return
 		}
+		if len(groups) > 0 {
+			newUserEntry, err := ws.Database.GetUser(userEntry.Name)
+			if err != nil {
+				c.JSON(http.StatusOK, gin.H{
+					"code":    1000,
+					"message": err.Error(),
+				})
+				return
+			}
+			userEntry.Id = newUserEntry.Id
+			for _, group := range groups {
+				ws.Database.AddGroupMember(group.Id, userEntry.Id)
+			}
+			// 按模板生成的根目录可能还不存在
+			rootDir := filepath.Join(ws.RootDir, userEntry.RootDir)
+			if !lib.IsExist(rootDir) {
+				err = os.MkdirAll(rootDir, 0755)
+				if err != nil {
+					lib.Logger.Error("create user root dir failed!", err)
+				}
+			}
+		}
 
 		ws.Database.AddUserHistory(db.UserHistoryEntry{
 			UserId:   loginUserInfo.UserEntry.Id,
 			UserName: loginUserInfo.UserEntry.Name,
 			Action:   "create_user",
 			Information: ws.getRequestInfo(c, map[string]string{
-				"user_id":    strconv.FormatInt(userEntry.Id, 10),
-				"user_name":  userEntry.Name,
-				"user_email": userEntry.Email,
+				"user_id":     strconv.FormatInt(userEntry.Id, 10),
+				"user_name":   userEntry.Name,
+				"user_email":  userEntry.Email,
+				"permissions": userEntry.Permissions,
+				"quota":       strconv.FormatInt(userEntry.Quota, 10),
 			}),
 			Ip: c.ClientIP(),
 		})
@@ -230,18 +409,8 @@ func (ws *WebServer) ReqGetUserSetting() gin.HandlerFunc {
 			})
 			return
 		}
-		userSessionId := c.GetHeader("session-id")
-		if userSessionId == "" {
-			c.JSON(http.StatusOK, gin.H{
-				"code":    1000,
-				"message": "user_id is empty",
-			})
-			return
-		}
-		GetInstance().Lock.Lock()
-		userInfo, exist := GetInstance().Tokens[userSessionId]
-		GetInstance().Lock.Unlock()
-		if !exist {
+		userInfo := getLoginUser(c)
+		if userInfo.SessionId == "" {
 			c.JSON(http.StatusOK, gin.H{
 				"code":    1000,
 				"message": "user is not exist",
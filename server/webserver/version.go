@@ -0,0 +1,292 @@
+package webserver
+
+import (
+	"myfileserver/db"
+	"myfileserver/lib"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文件的历史版本
+// 文件被覆盖（上传同名文件、写入文件内容）前，把原来的内容保存到 TempDir/versions 下
+// 每个文件保留的版本数和天数由文件所属用户（见 getPathOwner）的设置决定：
+//   version_keep_count 保留的版本数，默认10，0表示不保存历史版本
+//   version_keep_days  保留的天数，默认30，0表示不按时间清理
+// 历史版本计入文件所属用户的已使用空间，删除版本后释放，所属用户的空间不足时不保存历史版本
+
+const (
+	VersionDirName          = "versions"
+	VersionKeepCountKey     = "version_keep_count"
+	VersionKeepDaysKey      = "version_keep_days"
+	defaultVersionKeepCount = 10
+	defaultVersionKeepDays  = 30
+	// 客户端编辑文件时会分多次写入，这段时间内的多次写入只保存一个版本
+	versionMergeInterval = time.Minute
+)
+
+// getUserSettingInt 获取用户的整数类型的设置，没有设置或设置错误时返回默认值
+func (ws *WebServer) getUserSettingInt(userId int64, key string, defaultValue int) int {
+	setting, err := ws.Database.GetUserSetting(userId, key)
+	if err != nil {
+		return defaultValue
+	}
+	val, err := strconv.Atoi(setting.Value)
+	if err != nil || val < 0 {
+		return defaultValue
+	}
+	return val
+}
+
+func (ws *WebServer) getVersionPath(version db.FileVersionEntry) string {
+	return filepath.Join(ws.TempDir, VersionDirName, version.StorageName)
+}
+
+func (ws *WebServer) purgeVersion(version db.FileVersionEntry) error {
+	err := os.Remove(ws.getVersionPath(version))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = ws.Database.DeleteFileVersion(version.Id)
+	if err != nil {
+		return err
+	}
+	ws.Database.AddUserUsedSize(version.UserId, -version.Size)
+	return nil
+}
+
+// saveVersion 在覆盖文件前保存原来的内容，返回保存的版本，没有保存时返回 nil
+// replace 为 true 时整个文件随后会被改名替换，原来的文件不会再被修改，优先创建硬链接，不能创建时复制一份
+// 原来的文件在替换前一直保留在原来的位置
+func (ws *WebServer) saveVersion(userEntry db.UserEntry, realPath string, replace bool) (*db.FileVersionEntry, error) {
+	info, err := os.Lstat(realPath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return nil, nil
+	}
+	owner := ws.getPathOwner(userEntry, realPath)
+	keepCount := ws.getUserSettingInt(owner.Id, VersionKeepCountKey, defaultVersionKeepCount)
+	if keepCount == 0 {
+		return nil, nil
+	}
+	serverPath := ws.toServerPath(realPath)
+	versions, err := ws.Database.GetFileVersions(serverPath)
+	if err != nil {
+		return nil, err
+	}
+	if !replace && len(versions) > 0 && versions[0].UserId == owner.Id {
+		createdAt, err := time.ParseInLocation(time.DateTime, versions[0].CreatedAt, time.Local)
+		if err == nil && time.Since(createdAt) < versionMergeInterval {
+			return nil, nil
+		}
+	}
+
+	versionDir := filepath.Join(ws.TempDir, VersionDirName)
+	err = os.MkdirAll(versionDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	storageName, _ := lib.GenerateRandomString(16)
+	version := db.FileVersionEntry{
+		ServerPath:  serverPath,
+		Size:        info.Size(),
+		ModifiedAt:  info.ModTime().Format(time.DateTime),
+		StorageName: storageName,
+		UserId:      owner.Id,
+	}
+	// 保存的版本会增加所属用户的已使用空间，超过配额时不保存
+	if err := usersQuotaError([]db.UserEntry{owner}, version.Size); err != nil {
+		lib.Logger.Info("saveVersion: quota exceeded, version not saved! path:", realPath)
+		return nil, nil
+	}
+	if !replace || os.Link(realPath, ws.getVersionPath(version)) != nil {
+		err = lib.CopyPath(realPath, ws.getVersionPath(version))
+	}
+	if err != nil {
+		return nil, err
+	}
+	version.Id, err = ws.Database.AddFileVersion(version)
+	if err != nil {
+		os.Remove(ws.getVersionPath(version))
+		return nil, err
+	}
+	ws.Database.AddUserUsedSize(owner.Id, version.Size)
+
+	// 超过保留的版本数时删除最早的版本
+	versions = append([]db.FileVersionEntry{version}, versions...)
+	for i := keepCount; i < len(versions); i++ {
+		ws.purgeVersion(versions[i])
+	}
+	return &version, nil
+}
+
+// replaceFile 用已经写好的临时文件 tempPath 替换 realPath，原来的文件先保存到历史版本中
+// 保存版本后再把临时文件改名覆盖原来的文件，替换过程中 realPath 一直存在
+// 返回被替换的普通文件的大小，用于计算已使用空间；替换失败时删除保存的版本和临时文件
+func (ws *WebServer) replaceFile(userEntry db.UserEntry, tempPath string, realPath string) (int64, error) {
+	replacedSize := int64(0)
+	if info, err := os.Lstat(realPath); err == nil && info.Mode().IsRegular() {
+		replacedSize = info.Size()
+	}
+	version, err := ws.saveVersion(userEntry, realPath, true)
+	if err != nil {
+		os.Remove(tempPath)
+		return 0, err
+	}
+	err = os.Rename(tempPath, realPath)
+	if err != nil {
+		os.Remove(tempPath)
+		if version != nil {
+			ws.purgeVersion(*version)
+		}
+		return 0, err
+	}
+	return replacedSize, nil
+}
+
+// AutoPurgeVersions 删除超过保留天数的历史版本，由后台定时调用
+func (ws *WebServer) AutoPurgeVersions() {
+	users, err := ws.Database.GetUsers()
+	if err != nil {
+		return
+	}
+	for _, user := range users {
+		days := ws.getUserSettingInt(user.Id, VersionKeepDaysKey, defaultVersionKeepDays)
+		if days == 0 {
+			continue
+		}
+		versions, err := ws.Database.GetExpiredFileVersions(user.Id, time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			continue
+		}
+		for _, version := range versions {
+			err = ws.purgeVersion(version)
+			if err != nil {
+				lib.Logger.Error("AutoPurgeVersions: purge failed!", err, version.Id)
+			}
+		}
+	}
+}
+
+// getFileVersion 获取参数 path 和 version 指定的历史版本
+func (ws *WebServer) getFileVersion(c *gin.Context, access string) (string, db.FileVersionEntry, bool) {
+	version := db.FileVersionEntry{}
+	path, succeed := getPath(c)
+	if !succeed {
+		return "", version, false
+	}
+	realPath, succeed := ws.resolvePath(c, path, access)
+	if !succeed {
+		return "", version, false
+	}
+	number, succeed := getQueryInt64(c, "version")
+	if !succeed {
+		return "", version, false
+	}
+	version, err := ws.Database.GetFileVersion(ws.toServerPath(realPath), number)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "version not found"})
+		return "", version, false
+	}
+	return realPath, version, true
+}
+
+// ReqGetFileVersions 获取文件的历史版本列表
+func (ws *WebServer) ReqGetFileVersions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path, succeed := getPath(c)
+		if !succeed {
+			return
+		}
+		realPath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+		if !succeed {
+			return
+		}
+		versions, err := ws.Database.GetFileVersions(ws.toServerPath(realPath))
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    1000,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    versions,
+		})
+	}
+}
+
+// ReqDownloadFileVersion 下载文件的历史版本
+func (ws *WebServer) ReqDownloadFileVersion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		realPath, version, succeed := ws.getFileVersion(c, db.AclAccessRead)
+		if !succeed {
+			return
+		}
+		info, err := os.Stat(ws.getVersionPath(version))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"code": 1001, "message": "version not found"})
+			return
+		}
+		serveFile(c, ws.getVersionPath(version), filepath.Base(realPath), info)
+	}
+}
+
+// ReqRestoreFileVersion 把文件还原为指定的历史版本，当前的内容保存为新的版本
+func (ws *WebServer) ReqRestoreFileVersion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !checkUserPermission(c, actionModify) {
+			return
+		}
+		realPath, version, succeed := ws.getFileVersion(c, db.AclAccessWrite)
+		if !succeed {
+			return
+		}
+		if info, err := os.Lstat(realPath); err == nil && !info.Mode().IsRegular() {
+			c.JSON(http.StatusOK, gin.H{"code": 1000, "message": "bad file type"})
+			return
+		}
+		if !ws.checkQuota(c, realPath, version.Size-ws.getPathSize(realPath)) {
+			return
+		}
+		// 先复制到临时文件，保存当前内容时可能会按保留的版本数删除要还原的版本
+		taskId, _ := lib.GenerateRandomString(16)
+		tempPath := realPath + "." + taskId
+		err := lib.CopyPath(ws.getVersionPath(version), tempPath)
+		if err != nil {
+			os.Remove(tempPath)
+			lib.Logger.Error("ReqRestoreFileVersion: copy version failed!", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to restore file version"})
+			return
+		}
+		loginUserInfo := getLoginUser(c)
+		replacedSize, err := ws.replaceFile(loginUserInfo.UserEntry, tempPath, realPath)
+		if err != nil {
+			lib.Logger.Error("ReqRestoreFileVersion: restore failed!", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 1001, "message": "Failed to restore file version"})
+			return
+		}
+		ws.addUsedSize(realPath, version.Size-replacedSize)
+		ws.notify(fileEventModify, realPath, "", false)
+
+		ws.Database.AddUserHistory(db.UserHistoryEntry{
+			UserId:   loginUserInfo.UserEntry.Id,
+			UserName: loginUserInfo.UserEntry.Name,
+			Action:   "restore_file_version",
+			Information: ws.getRequestInfo(c, map[string]string{
+				"path":    c.Query("path"),
+				"version": strconv.FormatInt(version.Version, 10),
+			}),
+			Ip: c.ClientIP(),
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "restore succeed",
+		})
+	}
+}
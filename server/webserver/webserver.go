@@ -2,7 +2,6 @@ package webserver
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"myfileserver/db"
 	"myfileserver/lib"
@@ -55,14 +54,17 @@ type MemoryStateInfo struct {
 }
 
 type WebServer struct {
-	InstallMode  bool
-	RootDir      string
-	TempDir      string
-	Database     db.Database
-	CpuStatus    []CpuStateInfo
-	NetStates    []NetStateInfo
-	DiskStates   []DiskStateInfo
-	MemoryStates []MemoryStateInfo
+	InstallMode   bool
+	RootDir       string
+	TempDir       string
+	SymlinkPolicy string // 符号链接的策略：deny、within_root、allow
+	Database      db.Database
+	CpuStatus     []CpuStateInfo
+	NetStates     []NetStateInfo
+	DiskStates    []DiskStateInfo
+	MemoryStates  []MemoryStateInfo
+	Indexer       *FileIndexer
+	Notifier      *EventHub
 }
 
 func (ws *WebServer) ReqVersion() gin.HandlerFunc {
@@ -93,8 +95,14 @@ func AuthSharedMiddleware() gin.HandlerFunc {
 			c.Abort() // 停止后续处理
 			return
 		}
+		if wait, ok := checkAttempt(attemptSharedIpKey(c.ClientIP()), attemptSharedKey(sid)); !ok {
+			tooManyAttempts(c, wait)
+			c.Abort() // 停止后续处理
+			return
+		}
 		sharedEntry, err := GetInstance().Database.GetShared(sid)
 		if err != nil {
+			recordSharedCodeFailure(c, sid)
 			c.JSON(http.StatusOK, gin.H{
 				"code":    404,
 				"message": err.Error(),
@@ -105,6 +113,7 @@ func AuthSharedMiddleware() gin.HandlerFunc {
 
 		code := c.Query("code")
 		if code != sharedEntry.Code {
+			recordSharedCodeFailure(c, sid)
 			c.JSON(http.StatusOK, gin.H{
 				"code":    1001,
 				"message": "code invalid",
@@ -112,6 +121,15 @@ func AuthSharedMiddleware() gin.HandlerFunc {
 			c.Abort() // 停止后续处理
 			return
 		}
+		clearAttempt(attemptSharedKey(sid))
+		if !checkSharedGroup(c, sharedEntry) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code":    1000,
+				"message": "Unauthorized",
+			})
+			c.Abort() // 停止后续处理
+			return
+		}
 
 		c.Next()
 	}
@@ -150,38 +168,10 @@ func LoggerMiddleware() gin.HandlerFunc {
 
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 通过cookie校验用户身份
-		userSessionId, _ := c.Cookie("session-id")
-		userToken, _ := c.Cookie("user-token")
-		// 通过head校验用户身份
-		if userSessionId == "" && userToken == "" {
-			userSessionId = c.GetHeader("session-id")
-			userToken = c.GetHeader("user-token")
-		}
-		// 通过参数校验用户身份
-		if userSessionId == "" && userToken == "" {
-			userSessionId = c.Query("session-id")
-			userToken = c.Query("user-token")
-		}
-		if userSessionId != "" && userToken != "" {
-			GetInstance().Lock.Lock()
-			userInfo, exist := GetInstance().Tokens[userSessionId]
-			GetInstance().Lock.Unlock()
-			if !exist {
-				fmt.Println("user not login!", userSessionId, userToken)
-				c.JSON(http.StatusUnauthorized, gin.H{
-					"code":    1000,
-					"message": "Unauthorized",
-				})
-				c.Abort() // 停止后续处理
-				return
-			}
-			if userInfo.UserToken == userToken && userInfo.UserEntry.Enabled {
-				//fmt.Println("check user token succeed!", token)
-				c.Next()
-				return
-			}
-			fmt.Println("check user token failed!", userInfo.UserToken, userToken)
+		userInfo, ok := authenticate(c)
+		if ok && checkApiTokenScope(c, userInfo, false) {
+			c.Next()
+			return
 		}
 		// 校验失败
 		c.JSON(http.StatusUnauthorized, gin.H{
@@ -194,38 +184,10 @@ func AuthMiddleware() gin.HandlerFunc {
 
 func AuthAdminMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 通过cookie校验用户身份
-		userSessionId, _ := c.Cookie("session-id")
-		userToken, _ := c.Cookie("user-token")
-		// 通过head校验用户身份
-		if userSessionId == "" && userToken == "" {
-			userSessionId = c.GetHeader("session-id")
-			userToken = c.GetHeader("user-token")
-		}
-		// 通过参数校验用户身份
-		if userSessionId == "" && userToken == "" {
-			userSessionId = c.Query("session-id")
-			userToken = c.Query("user-token")
-		}
-		if userSessionId != "" && userToken != "" {
-			GetInstance().Lock.Lock()
-			userInfo, exist := GetInstance().Tokens[userSessionId]
-			GetInstance().Lock.Unlock()
-			if !exist {
-				fmt.Println("user not login!", userSessionId, userToken)
-				c.JSON(http.StatusUnauthorized, gin.H{
-					"code":    1000,
-					"message": "Unauthorized",
-				})
-				c.Abort() // 停止后续处理
-				return
-			}
-			if userInfo.UserToken == userToken && userInfo.UserEntry.IsAdmin && userInfo.UserEntry.Enabled {
-				//fmt.Println("check user token succeed!", token)
-				c.Next()
-				return
-			}
-			fmt.Println("check user token failed!", userInfo.UserToken, userToken)
+		userInfo, ok := authenticate(c)
+		if ok && userInfo.UserEntry.IsAdmin && checkApiTokenScope(c, userInfo, true) {
+			c.Next()
+			return
 		}
 
 		// 校验失败
@@ -304,6 +266,7 @@ func (ws *WebServer) ReqInstall(cfgFileName string, cfg *lib.Config) gin.Handler
 		}
 		ws.RootDir = cfg.Server.RootDir
 		ws.TempDir = cfg.Server.TempDir
+		ws.SymlinkPolicy = cfg.Server.SymlinkPolicy
 		ws.Database = db.Database{
 			FileName: cfg.Server.DatabaseFile,
 		}
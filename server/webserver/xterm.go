@@ -6,10 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"myfileserver/db"
 	"myfileserver/lib"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -58,11 +58,17 @@ func consoleResponse(data_type string, data string) (p []byte) {
 
 func (ws *WebServer) ReqCreateXtermWebSocket() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if !checkUserPermission(c, actionXterm) {
+			return
+		}
 		loginUserInfo := getLoginUser(c)
 		path, succeed := getPath(c)
 		var xterm_config XtermConfig
 		if succeed {
-			filePath := filepath.Join(ws.RootDir, loginUserInfo.UserEntry.RootDir, path)
+			filePath, succeed := ws.resolvePath(c, path, db.AclAccessRead)
+			if !succeed {
+				return
+			}
 
 			data, err := os.ReadFile(filePath)
 			if err != nil {